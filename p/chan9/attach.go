@@ -6,16 +6,19 @@ package chan9
 
 import (
 	"code.google.com/p/go9p/p"
-	"net"
+	"context"
 	"syscall"
 )
 
 // Creates an authentication fid for the specified user. Returns the fid, if
 // successful, or an Error.
 func (clnt *Clnt) Auth(user p.User, aname string) (*Fid, error) {
-	fid := clnt.FidAlloc()
+	fid, err := clnt.FidAllocContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
 	tc := clnt.NewFcall()
-	err := p.PackTauth(tc, fid.Fid, user.Name(), aname, uint32(user.Id()), clnt.Dotu)
+	err = p.PackTauth(tc, fid.Fid, user.Name(), aname, uint32(user.Id()), clnt.Dotu)
 	if err != nil {
 		fid.Clunk()
 		return nil, err
@@ -56,20 +59,25 @@ func (clnt *Clnt) Attach(afid *Fid, user p.User, aname string) (*Fid, error) {
 		afno = p.NOFID
 	}
 
-	fid := clnt.FidAlloc()
+	fid, err := clnt.FidAllocContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
 	tc := clnt.NewFcall()
-	err := p.PackTattach(tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), clnt.Dotu)
+	err = p.PackTattach(tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), clnt.Dotu)
 	if err != nil {
+		fid.Clunk()
 		return nil, err
 	}
 
 	rc, err := clnt.Rpc(tc)
+	if err == nil && rc.Type == p.Rerror {
+		err = &p.Error{rc.Error, syscall.Errno(rc.Errornum)}
+	}
 	if err != nil {
+		fid.Clunk()
 		return nil, err
 	}
-	if rc.Type == p.Rerror {
-		return nil, &p.Error{rc.Error, syscall.Errno(rc.Errornum)}
-	}
 
 	fid.Qid = rc.Qid
 	fid.Cname = fid.Cname[:0]
@@ -80,26 +88,6 @@ func (clnt *Clnt) Attach(afid *Fid, user p.User, aname string) (*Fid, error) {
 	}
 	fid.Path[0] = fid.FileID
 	fid.walked = true
+	clnt.aname = aname
 	return fid, nil
 }
-
-// Dial a server and return a non-attached client "channel."
-func Dial(addr string) (*Clnt, error) {
-	proto, netaddr, e := p.ParseNetName(addr)
-	if e != nil {
-		return nil, &p.Error{e.Error(), p.EIO}
-	}
-	c, e := net.Dial(proto, netaddr)
-	if e != nil {
-		return nil, &p.Error{e.Error(), p.EIO}
-	}
-
-	clnt, err := Connect(c, 8192+p.IOHDRSZ, true)
-	if err != nil {
-		return nil, err
-	}
-	clnt.Id = addr
-
-	return clnt, nil
-}
-
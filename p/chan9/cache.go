@@ -0,0 +1,240 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chan9
+
+/*  The MCACHE page cache.
+    The data read through the fids of a mount made with p.MCACHE is
+    kept in Mcache, in pages indexed by the FileID of the file (with
+    the Qid.Version left out). The pages of a file are good for one
+    version: they are dropped as soon as an Ropen, Rstat or Rgetattr
+    shows another Qid.Version. Writes go through to the server and
+    drop the pages of the file. Directories are not cached.
+*/
+
+import (
+	"code.google.com/p/go9p/p"
+	"container/list"
+	"context"
+	"sync"
+)
+
+// Eviction policies
+const (
+	CacheLRU  = iota // evict the least recently used page
+	CacheFIFO        // evict the page read first
+)
+
+// The cache used by MCACHE mounts. It can be replaced (or set to nil,
+// which disables caching) before the mounts are used.
+var Mcache = NewCache(2048, 8192, CacheLRU)
+
+type Cache struct {
+	sync.Mutex
+	pagesize int
+	maxpages int
+	policy   int
+	files    map[FileID]*cfile
+	pages    *list.List // of *cpage, the next to evict at the back
+	Hits     uint64     // reads served from the cache
+	Misses   uint64     // reads that went to the server
+}
+
+// The cached pages of a file.
+type cfile struct {
+	version uint32
+	pages   map[uint64]*list.Element
+}
+
+type cpage struct {
+	file FileID
+	idx  uint64
+	data []byte // shorter than the pagesize at the end of the file
+}
+
+// Creates a cache of up to maxpages pages of pagesize bytes, evicting
+// pages according to policy (CacheLRU or CacheFIFO). Files with an
+// iounit smaller than pagesize are not cached.
+func NewCache(maxpages, pagesize, policy int) *Cache {
+	c := new(Cache)
+	c.pagesize = pagesize
+	c.maxpages = maxpages
+	c.policy = policy
+	c.files = make(map[FileID]*cfile)
+	c.pages = list.New()
+
+	return c
+}
+
+// Changes the number of pages kept, evicting pages if needed.
+func (c *Cache) Resize(maxpages int) {
+	c.Lock()
+	c.maxpages = maxpages
+	c.evict()
+	c.Unlock()
+}
+
+// Drops all pages.
+func (c *Cache) Flush() {
+	c.Lock()
+	c.files = make(map[FileID]*cfile)
+	c.pages.Init()
+	c.Unlock()
+}
+
+// Returns the number of pages in the cache.
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.pages.Len()
+}
+
+// The index of a file in the cache.
+func cacheKey(fid *Fid) FileID {
+	return FileID{fid.Type &^ NOREMAP, fid.Dev, p.Qid{fid.Qid.Type, 0, fid.Qid.Path}}
+}
+
+// Returns true if the reads of the fid go through the cache.
+func (fid *Fid) cached() bool {
+	return fid.MayCache && Mcache != nil && fid.Qid.Type&(p.QTDIR|p.QTAUTH) == 0 &&
+		fid.Iounit >= uint32(Mcache.pagesize)
+}
+
+// Called with the Qid of the fid's file returned by the server.
+// Drops the cached pages if the version changed.
+func (fid *Fid) cacheValidate(qid p.Qid) {
+	if !fid.MayCache || Mcache == nil || qid.Path != fid.Qid.Path {
+		return
+	}
+
+	c := Mcache
+	key := cacheKey(fid)
+	c.Lock()
+	if f := c.files[key]; f != nil && f.version != qid.Version {
+		c.drop(key, f)
+	}
+	c.Unlock()
+	fid.Qid.Version = qid.Version
+}
+
+// Drops the cached pages of the fid's file, after it was changed.
+func (fid *Fid) cacheForget() {
+	if !fid.MayCache || Mcache == nil {
+		return
+	}
+
+	c := Mcache
+	key := cacheKey(fid)
+	c.Lock()
+	if f := c.files[key]; f != nil {
+		c.drop(key, f)
+	}
+	c.Unlock()
+}
+
+// Reads up to count bytes from offset of a cached fid. The data comes
+// from the page containing offset, which is read from the server if
+// it's not in the cache. A server may return less than asked for, so
+// a page is read until it is full or a read returns no data (EOF);
+// a short page then always ends at the end of the file.
+func (c *Cache) read(ctx context.Context, fid *Fid, offset uint64, count uint32) ([]byte, error) {
+	key := cacheKey(fid)
+	ps := uint64(c.pagesize)
+	idx := offset / ps
+	data := c.lookup(key, fid.Qid.Version, idx)
+	if data == nil {
+		data = make([]byte, 0, ps)
+		for uint64(len(data)) < ps {
+			n := uint64(len(data))
+			b, err := fid.read(ctx, idx*ps+n, uint32(ps-n))
+			if err != nil {
+				return nil, err
+			}
+			if len(b) == 0 {
+				break
+			}
+			data = append(data, b...)
+		}
+		data = c.insert(key, fid.Qid.Version, idx, data)
+	}
+
+	off := offset - idx*ps
+	if off > uint64(len(data)) {
+		off = uint64(len(data))
+	}
+	data = data[off:]
+	if uint32(len(data)) > count {
+		data = data[0:count]
+	}
+
+	return append([]byte(nil), data...), nil
+}
+
+// Returns the data of a page, or nil if it is not cached.
+func (c *Cache) lookup(key FileID, version uint32, idx uint64) []byte {
+	c.Lock()
+	defer c.Unlock()
+
+	f := c.files[key]
+	if f == nil || f.version != version || f.pages[idx] == nil {
+		c.Misses++
+		return nil
+	}
+
+	e := f.pages[idx]
+	if c.policy == CacheLRU {
+		c.pages.MoveToFront(e)
+	}
+	c.Hits++
+	return e.Value.(*cpage).data
+}
+
+// Adds a page read from the server. Returns the data kept.
+func (c *Cache) insert(key FileID, version uint32, idx uint64, data []byte) []byte {
+	data = append([]byte(nil), data...)
+
+	c.Lock()
+	defer c.Unlock()
+	if c.maxpages <= 0 {
+		return data
+	}
+
+	f := c.files[key]
+	if f != nil && f.version != version {
+		c.drop(key, f)
+		f = nil
+	}
+	if f == nil {
+		f = &cfile{version, make(map[uint64]*list.Element)}
+		c.files[key] = f
+	}
+
+	if e := f.pages[idx]; e != nil {
+		c.pages.Remove(e)
+	}
+	f.pages[idx] = c.pages.PushFront(&cpage{key, idx, data})
+	c.evict()
+
+	return data
+}
+
+// Called with the lock held.
+func (c *Cache) drop(key FileID, f *cfile) {
+	for _, e := range f.pages {
+		c.pages.Remove(e)
+	}
+	delete(c.files, key)
+}
+
+// Called with the lock held.
+func (c *Cache) evict() {
+	for c.pages.Len() > 0 && c.pages.Len() > c.maxpages {
+		pg := c.pages.Remove(c.pages.Back()).(*cpage)
+		f := c.files[pg.file]
+		delete(f.pages, pg.idx)
+		if len(f.pages) == 0 {
+			delete(c.files, pg.file)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package chan9
+
+import (
+	"bytes"
+	"context"
+	"code.google.com/p/go9p/p"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	defer func(c *Cache) { Mcache = c }(Mcache)
+	Mcache = NewCache(4, 4096, CacheLRU)
+
+	s := testSrv(t, "d/", "", "d/f", "data")
+	ns, err := NSFromClnt(testConnect(t, s), nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.Mount(testConnect(t, s), nil, "/d", p.MREPL|p.MCACHE, ""); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NSFromClnt(testConnect(t, s), nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(name string) string {
+		file, err := ns.FOpen(ParseName(name), p.OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		buf, err := io.ReadAll(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	if s := read("/d/d/f"); s != "data" || Mcache.Misses != 1 {
+		t.Errorf("first read: %q, %d misses", s, Mcache.Misses)
+	}
+	if s := read("/d/d/f"); s != "data" || Mcache.Misses != 1 {
+		t.Errorf("cached read: %q, %d misses", s, Mcache.Misses)
+	}
+
+	file, err := other.FOpen(ParseName("/d/f"), p.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("DA"))
+	file.Close()
+	if s := read("/d/d/f"); s != "DAta" {
+		t.Errorf("read after a new version: %q", s)
+	}
+
+	file, err = ns.FOpen(ParseName("/d/d/f"), p.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	buf := make([]byte, 4)
+	file.ReadAt(buf, 0)
+	file.WriteAt([]byte("dA"), 0)
+	if n, _ := file.ReadAt(buf, 0); string(buf[:n]) != "dAta" {
+		t.Errorf("read after write: %q", buf[:n])
+	}
+
+	// io.Copy goes through the cache too
+	var out bytes.Buffer
+	hits, misses := Mcache.Hits, Mcache.Misses
+	file.Seek(0, io.SeekStart)
+	if _, err := io.Copy(&out, file); err != nil || out.String() != "dAta" || Mcache.Hits == hits || Mcache.Misses != misses {
+		t.Errorf("copy from cached file: %q %v, %d hits %d misses", out.String(), err, Mcache.Hits-hits, Mcache.Misses-misses)
+	}
+	file.Seek(0, io.SeekStart)
+	if _, err := io.Copy(file, strings.NewReader("DATA")); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := file.ReadAt(buf, 0); string(buf[:n]) != "DATA" {
+		t.Errorf("read after copy to file: %q", buf[:n])
+	}
+}
+
+// A server may answer a read with less than asked for; the cache must
+// not take that for the end of the file.
+func TestCacheShortRead(t *testing.T) {
+	defer func(c *Cache) { Mcache = c }(Mcache)
+	Mcache = NewCache(4, 8, CacheLRU)
+
+	data := "0123456789"
+	clnt, _ := testFakeClnt(t, func(tc, rc *p.Fcall) bool {
+		switch tc.Type {
+		case p.Tattach:
+			p.PackRattach(rc, &p.Qid{Type: p.QTDIR})
+		case p.Topen:
+			p.PackRopen(rc, &p.Qid{Path: 1}, 0)
+		case p.Tread:
+			b := []byte(nil)
+			if tc.Offset < uint64(len(data)) {
+				b = []byte(data[tc.Offset:])
+			}
+			if len(b) > 3 {
+				b = b[:3]
+			}
+			if uint32(len(b)) > tc.Count {
+				b = b[:tc.Count]
+			}
+			p.PackRread(rc, b)
+		default:
+			p.PackRclunk(rc)
+		}
+		return true
+	})
+	defer clnt.Clunk(nil)
+
+	fid, err := clnt.Attach(nil, clnt.User, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fid.Open(p.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	fid.MayCache = true
+
+	for _, r := range []struct {
+		off   uint64
+		count uint32
+		want  string
+	}{
+		{0, 8, "01234567"},
+		{5, 8, "567"},
+		{8, 8, "89"},
+		{10, 8, ""},
+	} {
+		if b, err := fid.ReadContext(context.Background(), r.off, r.count); err != nil || string(b) != r.want {
+			t.Errorf("read %d at %d: %q %v, want %q", r.count, r.off, b, err, r.want)
+		}
+	}
+	if Mcache.Misses != 2 || Mcache.Hits != 2 {
+		t.Errorf("%d hits %d misses, want 2 and 2", Mcache.Hits, Mcache.Misses)
+	}
+}
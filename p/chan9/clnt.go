@@ -8,12 +8,19 @@ package chan9
 
 import (
 	"code.google.com/p/go9p/p"
+	"context"
 	"fmt"
+	"io"
 	"log"
-	"os"
 	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // Debug flags
@@ -22,6 +29,7 @@ const (
 	DbgPrintPackets               // print the raw packets on stderr
 	DbgLogFcalls                  // keep the last N 9P messages (can be accessed over http)
 	DbgLogPackets                 // keep the last N 9P messages (can be accessed over http)
+	DbgTrackFids                  // record where the fids are allocated, to find the ones not clunked
 )
 
 type StatsOps interface {
@@ -31,7 +39,8 @@ type StatsOps interface {
 
 type ClntList struct {
 	sync.Mutex
-	c map[uint32]*Clnt
+	c       map[uint32]*Clnt
+	stats   map[uint32]*Clnt // clients with a stats page, see statsRegister
 	nextdev uint32
 }
 
@@ -44,44 +53,61 @@ var clnts *ClntList
 // the files exported by the server.
 type Clnt struct {
 	sync.Mutex
-	Msize      uint32 // Maximum size of the 9P messages
-	Dotu       bool   // If true, 9P2000.u protocol is spoken
-	User       p.User
-        Type uint16 // Although "ChanOps" interface deprecates
-                        // the Type field, it could be informative.
-        Dev uint32 // Device number for this channel
-	Subpath    []string // "root" to begin requests from the channel
+	Msize uint32 // Maximum size of the 9P messages
+	Dotu  bool   // If true, 9P2000.u protocol is spoken
+	Dotl  bool   // If true, 9P2000.L protocol is spoken (implies Dotu)
+	User  p.User
+	Type  uint16 // Although "ChanOps" interface deprecates
+	// the Type field, it could be informative.
+	Dev     uint32   // Device number for this channel
+	Subpath []string // "root" to begin requests from the channel
+	Aname   string   // file tree attached to by Mount and NSFromClnt when given none
 	//Root       *Fid   // Fid that points to subpath on the server - managed by mount and ns
 	Debuglevel int    // Copied from ns
 	Id         string // Info. about attached server,
-			  // used when printing debug messages
-	Log        *p.Logger
-
-	conn     net.Conn
-	tagpool  *pool // dedicated to this particular connection
-	fidpool  *pool // points to pool of parent Namespace
-	reqout   chan *Req
-	done     chan bool
-	reqfirst *Req
-	reqlast  *Req
-	err      error
+	// used when printing debug messages
+	Log    *p.Logger
+	Window int // Requests kept in flight by bulk I/O on a File (0: DefaultWindow)
+
+	conn    net.Conn
+	tagpool *pool // dedicated to this particular connection
+	fidpool *pool // points to pool of parent Namespace
+	reqout  chan *Req
+	done    chan bool       // closed when the client is torn down, see rm
+	reqs    map[uint16]*Req // requests sent and not answered, by tag
+	err     error
 
 	reqchan chan *Req
 	tchan   chan *p.Fcall
 
-	ref int // ref count.
+	ref   int // ref count.
+	nsref int // number of namespaces using the client
+
+	// connection recovery, see recover.go
+	Reconnect  int                      // Number of redial attempts after the connection fails (0 disables recovery)
+	Reauth     func(afid *Fid) error    // Runs the authentication protocol on afid when recovering (nil: attach without auth)
+	addr       string                   // address dialed
+	dial       func() (net.Conn, error) // dials addr again, see DialOpts
+	ver        string                   // version requested
+	aname      string                   // aname attached to
+	fids       map[uint32]*Fid          // fids walked on the server
+	stale      map[uint32]bool          // fids lost in a recovery
+	recovering chan bool                // non-nil (and closed when done) while recovering
+	rauth      uint32                   // auth fid usable while recovering
 }
 
 type Req struct {
 	sync.Mutex
-	Clnt       *Clnt
-	Tc         *p.Fcall
-	Rc         *p.Fcall
-	Err        error
-	Done       chan *Req
-	tag        uint16
-	prev, next *Req
-	fid        *Fid
+	Clnt    *Clnt
+	Tc      *p.Fcall
+	Rc      *p.Fcall
+	Err     error
+	Done    chan *Req
+	tag     uint16
+	fid     *Fid
+	recover bool      // sent while recovering the connection
+	written chan bool // closed once send is done with Tc, see ReqFree
+	lost    bool      // taken over by a recovery, not to be written, see tryRecover
 }
 
 func PrintClntList() {
@@ -96,78 +122,219 @@ func PrintClntList() {
 }
 
 func (clnt *Clnt) Rpcnb(r *Req) error {
+	return clnt.rpcnb(context.Background(), r)
+}
+
+/* Does the work of Rpcnb. The request takes a tag, held until it's
+ * freed, from the ones of the client (see SetMaxReqs), waiting for
+ * one until ctx is done. The flushes and clunks, and the requests
+ * recovering the connection, don't wait for the limit.
+ */
+func (clnt *Clnt) rpcnb(ctx context.Context, r *Req) error {
 	var tag uint16
 
 	if r.Tc.Type == p.Tversion {
 		tag = p.NOTAG
 	} else {
+		if r.tag == p.NOTAG {
+			over := r.recover || r.Tc.Type == p.Tflush || r.Tc.Type == p.Tclunk
+			id, err := clnt.tagpool.getId(ctx, over)
+			if err != nil {
+				return err
+			}
+			r.tag = uint16(id)
+		}
 		tag = r.tag
 	}
 
 	p.SetTag(r.Tc, tag)
 	clnt.Lock()
+	for clnt.recovering != nil && !r.recover && r.Tc.Fid != clnt.rauth {
+		wait := clnt.recovering
+		clnt.Unlock()
+		<-wait
+		clnt.Lock()
+	}
+
 	if clnt.err != nil {
 		clnt.Unlock()
 		return clnt.err
 	}
 
-	if clnt.reqlast != nil {
-		clnt.reqlast.next = r
-	} else {
-		clnt.reqfirst = r
+	if clnt.isStale(r.Tc) {
+		clnt.Unlock()
+		return Estale
 	}
 
-	r.prev = clnt.reqlast
-	clnt.reqlast = r
+	clnt.reqs[tag] = r
+	r.written = make(chan bool)
+	r.lost = false
+	done := clnt.done
 	clnt.Unlock()
 
-	clnt.reqout <- r
+	// If the client is torn down first, send answers r with the error.
+	select {
+	case clnt.reqout <- r:
+	case <-done:
+		close(r.written)
+	}
 	return nil
 }
 
+// Sends the request and waits for the response. If the client has as
+// many requests outstanding as it may (see SetMaxReqs), waits for one
+// to be freed first.
 func (clnt *Clnt) Rpc(tc *p.Fcall) (rc *p.Fcall, err error) {
+	return clnt.RpcContext(context.Background(), tc)
+}
+
+// Like Rpc, but stops waiting for the response when the context is
+// cancelled or its deadline passes. The request is then flushed: a
+// Tflush is sent for its tag and the tag is only reused after the Rflush
+// arrives. Returns ctx.Err() if the request was abandoned. If the server
+// answered the request before the flush, that answer is returned, since
+// the request took effect. If the client has as many requests
+// outstanding as it may (see SetMaxReqs), waits for one to be freed
+// until the context is done.
+func (clnt *Clnt) RpcContext(ctx context.Context, tc *p.Fcall) (rc *p.Fcall, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	r := clnt.ReqAlloc()
 	r.Tc = tc
-	r.Done = make(chan *Req)
-	err = clnt.Rpcnb(r)
+	r.Done = make(chan *Req, 1)
+	err = clnt.rpcnb(ctx, r)
 	if err != nil {
+		clnt.ReqFree(r)
 		return
 	}
 
-	<-r.Done
+	select {
+	case <-r.Done:
+	case <-ctx.Done():
+		if clnt.flush(r) {
+			return nil, ctx.Err()
+		}
+	}
+
 	rc = r.Rc
 	err = r.Err
 	clnt.ReqFree(r)
 	return
 }
 
-func (clnt *Clnt) Clunk(err error) {
+// Time flush waits for the Rflush before giving up on it.
+var FlushTimeout = 5 * time.Second
+
+// Sends a Tflush for the outstanding request r and waits for the
+// Rflush. Returns true if the request was flushed, in which case r
+// has been freed. Returns false if the response to r arrived before
+// the Rflush; the caller should use it as if there was no flush.
+// If the Rflush doesn't come within FlushTimeout, returns true and
+// leaves r, and its tag, to be freed once the Rflush comes or the
+// connection is torn down.
+func (clnt *Clnt) flush(r *Req) bool {
+	fr := clnt.ReqAlloc()
+	fr.Tc = clnt.NewFcall()
+	fr.Done = make(chan *Req, 1)
+	err := p.PackTflush(fr.Tc, r.tag)
+	if err == nil {
+		err = clnt.rpcnb(context.Background(), fr)
+	}
+	if err != nil {
+		clnt.ReqFree(fr)
+		return clnt.flushed(r, err)
+	}
+
+	select {
+	case <-fr.Done:
+	case <-time.After(FlushTimeout):
+		// the server is stuck, or gone without closing the connection
+		go func() {
+			<-fr.Done
+			err := fr.Err
+			clnt.ReqFree(fr)
+			if !clnt.flushed(r, err) {
+				clnt.ReqFree(r)
+			}
+		}()
+		return true
+	}
+
+	err = fr.Err
+	clnt.ReqFree(fr)
+	return clnt.flushed(r, err)
+}
+
+// Finishes flushing r, once the Rflush came in (err is nil) or the
+// Tflush failed with err. Returns what flush does.
+func (clnt *Clnt) flushed(r *Req, err error) bool {
+	// The server answers requests in order, so once the Rflush is
+	// in, r was either answered or will never be.
+	clnt.Lock()
+	pending := clnt.reqs[r.tag] == r
+	if pending && err == nil {
+		delete(clnt.reqs, r.tag)
+		clnt.Unlock()
+		clnt.ReqFree(r)
+		return true
+	}
+	clnt.Unlock()
+
+	// Answered, or the connection failed. Either way the response
+	// (or error) is delivered through r.Done.
+	<-r.Done
+	if r.Rc != nil && r.Err == nil {
+		return false
+	}
+
+	clnt.ReqFree(r)
+	return true
+}
+
+/* Drops the caller's reference to the client, which is torn down
+ * (failing the requests pending with err) once nothing uses it.
+ * If the client is used by no namespace and still has fids, they
+ * were not clunked by the caller: they keep the client up, and are
+ * reported in the Error returned (see DbgTrackFids).
+ */
+func (clnt *Clnt) Clunk(err error) error {
+	var inuse []string
+
+	clnt.Lock()
+	if clnt.nsref == 0 {
+		inuse = clnt.unclunked()
+	}
+	clnt.Unlock()
 	clnt.edecref(err)
+	return unclunkedError(inuse)
 }
 
+/* Tears the client down: closes the connection and stops send,
+ * which answers the pending requests with err once it's done writing.
+ * Only the first call does anything. Called without the client's
+ * lock held.
+ */
 func rm(clnt *Clnt, err error) {
 	if clnt == nil {
 		return
 	}
+	if err == nil {
+		err = &p.Error{"client closed", p.EIO}
+	}
 	clnt.Lock()
+	if clnt.err != nil {
+		clnt.Unlock()
+		return
+	}
 	clnt.conn.Close()
 	clnt.err = err
-	clnt.done <- true
-
-	/* send error to all pending requests */
-	r := clnt.reqfirst
-	clnt.reqfirst = nil
-	clnt.reqlast = nil
+	close(clnt.done)
 	clnt.Unlock()
-	for ; r != nil; r = r.next {
-		r.Err = err
-		if r.Done != nil {
-			r.Done <- r
-		}
-	}
 
 	clnts.Lock()
-        delete(clnts.c, clnt.Dev)
+	delete(clnts.c, clnt.Dev)
 	clnts.Unlock()
 
 	if sop, ok := (interface{}(clnt)).(StatsOps); ok {
@@ -206,6 +373,9 @@ func (clnt *Clnt) edecref(e error) (ref int) {
 }
 
 func recv(clnt *Clnt) {
+	clnt.Lock()
+	conn := clnt.conn
+	clnt.Unlock()
 	buf := make([]byte, clnt.Msize*8)
 	pos := 0
 	for {
@@ -216,9 +386,15 @@ func recv(clnt *Clnt) {
 			b = nil
 		}
 
-		n, oerr := clnt.conn.Read(buf[pos:len(buf)])
+		n, oerr := conn.Read(buf[pos:len(buf)])
 		if oerr != nil || n == 0 {
-			rm(clnt,&p.Error{oerr.Error(), p.EIO})
+			if oerr == nil {
+				oerr = io.EOF
+			}
+			if clnt.tryRecover(conn, oerr) {
+				return
+			}
+			rm(clnt, &p.Error{oerr.Error(), p.EIO})
 			return
 		}
 
@@ -237,9 +413,8 @@ func recv(clnt *Clnt) {
 			}
 
 			fc, err, fcsize := p.Unpack(buf, clnt.Dotu)
-			clnt.Lock()
 			if err != nil {
-				rm(clnt,err)
+				rm(clnt, err)
 				return
 			}
 
@@ -254,34 +429,24 @@ func recv(clnt *Clnt) {
 				}
 			}
 
-			var r *Req = nil
-			for r = clnt.reqfirst; r != nil; r = r.next {
-				if r.Tc.Tag == fc.Tag {
-					break
-				}
-			}
-
+			clnt.Lock()
+			r := clnt.reqs[fc.Tag]
+			delete(clnt.reqs, fc.Tag)
+			clnt.Unlock()
 			if r == nil {
-				rm(clnt,&p.Error{"unexpected response", p.EINVAL})
+				rm(clnt, &p.Error{"unexpected response", p.EINVAL})
 				return
 			}
 
 			r.Rc = fc
-			if r.prev != nil {
-				r.prev.next = r.next
-			} else {
-				clnt.reqfirst = r.next
-			}
-
-			if r.next != nil {
-				r.next.prev = r.prev
-			} else {
-				clnt.reqlast = r.prev
-			}
-			clnt.Unlock()
 
 			if r.Tc.Type != r.Rc.Type-1 {
-				if r.Rc.Type != p.Rerror {
+				if r.Rc.Type == p.Rlerror {
+					if r.Err == nil {
+						e := syscall.Errno(r.Rc.Errornum)
+						r.Err = &p.Error{e.Error(), e}
+					}
+				} else if r.Rc.Type != p.Rerror {
 					r.Err = &p.Error{"invalid response", p.EINVAL}
 					log.Println(fmt.Sprintf("TTT %v", r.Tc))
 					log.Println(fmt.Sprintf("RRR %v", r.Rc))
@@ -306,6 +471,18 @@ func send(clnt *Clnt) {
 	for {
 		select {
 		case <-clnt.done:
+			/* send error to all pending requests */
+			clnt.Lock()
+			reqs := clnt.reqs
+			clnt.reqs = make(map[uint16]*Req)
+			err := clnt.err
+			clnt.Unlock()
+			for _, r := range reqs {
+				r.Err = err
+				if r.Done != nil {
+					r.Done <- r
+				}
+			}
 			return
 
 		case req := <-clnt.reqout:
@@ -320,21 +497,25 @@ func send(clnt *Clnt) {
 				}
 			}
 
-			for buf := req.Tc.Pkt; len(buf) > 0; {
-				n, err := clnt.conn.Write(buf)
+			clnt.Lock()
+			conn := clnt.conn
+			lost := req.lost
+			clnt.Unlock()
+			for buf := req.Tc.Pkt; len(buf) > 0 && !lost; {
+				n, err := conn.Write(buf)
 				if err != nil {
 					/* just close the socket, will get signal on clnt.done */
-					clnt.conn.Close()
+					conn.Close()
 					break
 				}
 
 				buf = buf[n:len(buf)]
 			}
+			close(req.written)
 		}
 	}
 }
 
-
 // Creates and initializes a new Clnt object. Doesn't send any data
 // on the wire.
 func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
@@ -344,14 +525,18 @@ func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
 	clnt.Dotu = dotu
 	clnt.User = p.OsUsers.Uid2User(os.Geteuid())
 	clnt.Subpath = make([]string, 0) // root
-	clnt.tagpool = newPool(uint32(p.NOTAG))
-	clnt.fidpool = newPool(p.NOFID) // replace when mounting to NS!
+	clnt.tagpool = newPool(uint32(p.NOTAG), DefaultMaxReqs)
+	clnt.fidpool = newPool(p.NOFID, DefaultMaxFids) // replace when mounting to NS!
 	//clnt.fidpool = ns.fidpool
 	clnt.reqout = make(chan *Req)
 	clnt.done = make(chan bool)
+	clnt.reqs = make(map[uint16]*Req)
 	clnt.reqchan = make(chan *Req, 16)
 	clnt.tchan = make(chan *p.Fcall, 16)
 	clnt.ref = 1
+	clnt.fids = make(map[uint32]*Fid)
+	clnt.stale = make(map[uint32]bool)
+	clnt.rauth = p.NOFID
 
 	clnt.Debuglevel = DefaultDebuglevel
 	clnt.Log = DefaultLogger
@@ -366,9 +551,9 @@ func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
 	go recv(clnt)
 	go send(clnt)
 
-	//if sop, ok := (interface{}(clnt)).(StatsOps); ok {
-	//	sop.statsRegister()
-	//}
+	if sop, ok := (interface{}(clnt)).(StatsOps); ok {
+		sop.statsRegister()
+	}
 
 	return clnt
 }
@@ -377,21 +562,36 @@ func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
 // a client object for it. Negotiates the dialect and msize for the
 // connection. Returns a Clnt object, or Error.
 func Connect(c net.Conn, msize uint32, dotu bool) (*Clnt, error) {
-	clnt := NewClnt(c, msize, dotu)
-	clnt.Id = c.RemoteAddr().String() + ":"
-	ver := "9P2000"
-	if clnt.Dotu {
-		ver = "9P2000.u"
+	ver := p.VERSION
+	if dotu {
+		ver = p.VERSIONU
+	}
+
+	return ConnectVersion(c, msize, ver)
+}
+
+// Like Connect, but proposes the named dialect ("9P2000", "9P2000.u"
+// or "9P2000.L") to the server. The server may answer with an older
+// dialect, the dialect spoken is reflected in the Dotu and Dotl fields.
+func ConnectVersion(c net.Conn, msize uint32, ver string) (*Clnt, error) {
+	if ver != p.VERSION && ver != p.VERSIONU && ver != p.VERSIONL {
+		return nil, &p.Error{"unsupported version: " + ver, p.EINVAL}
 	}
 
+	clnt := NewClnt(c, msize, ver != p.VERSION)
+	clnt.Id = c.RemoteAddr().String() + ":"
+	clnt.ver = ver
+
 	tc := p.NewFcall(clnt.Msize)
 	err := p.PackTversion(tc, clnt.Msize, ver)
 	if err != nil {
+		rm(clnt, err)
 		return nil, err
 	}
 
 	rc, err := clnt.Rpc(tc)
 	if err != nil {
+		rm(clnt, err)
 		return nil, err
 	}
 
@@ -399,23 +599,134 @@ func Connect(c net.Conn, msize uint32, dotu bool) (*Clnt, error) {
 		clnt.Msize = rc.Msize
 	}
 
-	clnt.Dotu = rc.Version == "9P2000.u" && clnt.Dotu
+	switch {
+	case rc.Version == p.VERSIONL && ver == p.VERSIONL:
+		clnt.Dotl = true
+		clnt.Dotu = true
+	case rc.Version == p.VERSIONU && ver != p.VERSION:
+		clnt.Dotu = true
+	case rc.Version == p.VERSION:
+		clnt.Dotu = false
+	default:
+		clnt.Clunk(&p.Error{"unsupported version: " + rc.Version, p.EINVAL})
+		return nil, &p.Error{"unsupported version: " + rc.Version, p.EINVAL}
+	}
+
 	return clnt, nil
 }
 
-// Creates a new Fid object for the client
+// Creates a new Fid object for the client. If the namespace of the
+// client has as many fids as it may have (see Namespace.SetMaxFids),
+// waits for one to be clunked first.
 func (clnt *Clnt) FidAlloc() *Fid {
+	fid, _ := clnt.fidAlloc(context.Background(), false)
+	return fid
+}
+
+// Like FidAlloc, but stops waiting for a fid to be clunked once ctx
+// is done, and returns ctx.Err() then.
+func (clnt *Clnt) FidAllocContext(ctx context.Context) (*Fid, error) {
+	return clnt.fidAlloc(ctx, false)
+}
+
+// Does the work of FidAllocContext. If over is set, the limit of
+// the namespace is ignored (see pool.getId).
+func (clnt *Clnt) fidAlloc(ctx context.Context, over bool) (*Fid, error) {
+	id, err := clnt.fidpool.getId(ctx, over)
+	if err != nil {
+		return nil, err
+	}
+
 	fid := new(Fid)
-	fid.Fid = clnt.fidpool.getId()
+	fid.Fid = id
 	fid.Clnt = clnt
+	if clnt.Debuglevel&DbgTrackFids != 0 {
+		pc := make([]uintptr, 32)
+		fid.alloc = pc[:runtime.Callers(2, pc)]
+	}
 	fid.Dev = clnt.Dev
 	fid.Type = clnt.Type
 	fid.User = clnt.User
 	fid.Cname = make([]string, 0)
 	fid.Path = make([]FileID, 0)
 	clnt.incref()
+	clnt.track(fid)
 
-	return fid
+	return fid, nil
+}
+
+// Describes the fids of the client not clunked yet, see
+// Fid.allocator. Called with the client's lock held.
+func (clnt *Clnt) unclunked() []string {
+	var inuse []string
+
+	for _, fid := range clnt.fids {
+		s := fmt.Sprintf("%d=%s", fid.Fid, strings.Join(fid.Cname, "/"))
+		if caller := fid.allocator(); caller != "" {
+			s += " (allocated by " + caller + ")"
+		}
+		inuse = append(inuse, s)
+	}
+
+	return inuse
+}
+
+// Returns the Error reporting the fids in inuse, if any.
+func unclunkedError(inuse []string) error {
+	if len(inuse) == 0 {
+		return nil
+	}
+
+	sort.Strings(inuse)
+	return &p.Error{fmt.Sprintf("%d fids not clunked: %s", len(inuse),
+		strings.Join(inuse, " ")), p.EBUSY}
+}
+
+var pkgPath = reflect.TypeOf(Fid{}).PkgPath() + "."
+
+// Returns where the code that allocated the fid, out of this
+// package, called it from, if the fid was allocated with
+// DbgTrackFids set.
+func (fid *Fid) allocator() string {
+	if len(fid.alloc) == 0 {
+		return ""
+	}
+	frames := runtime.CallersFrames(fid.alloc)
+	for {
+		f, more := frames.Next()
+		if f.Function != "" && (!strings.HasPrefix(f.Function, pkgPath) || strings.HasSuffix(f.File, "_test.go")) {
+			return fmt.Sprintf("%s %s:%d", f.Function, f.File, f.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// Returns the stack the fid was allocated by, if DbgTrackFids
+// was set.
+func (fid *Fid) allocStack() string {
+	var b strings.Builder
+
+	if len(fid.alloc) == 0 {
+		return ""
+	}
+	frames := runtime.CallersFrames(fid.alloc)
+	for more := true; more; {
+		var f runtime.Frame
+		f, more = frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+	}
+
+	return b.String()
+}
+
+// Sets the most requests the client has outstanding, from the time
+// they are sent until they are freed; 0 means as many as 9P allows.
+// Past that, the requests wait for others to be freed; the ones given
+// a context give up once it is done, see RpcContext.
+func (clnt *Clnt) SetMaxReqs(n int) {
+	clnt.tagpool.setMax(n)
 }
 
 func (clnt *Clnt) NewFcall() *p.Fcall {
@@ -445,25 +756,34 @@ func (clnt *Clnt) ReqAlloc() *Req {
 	default:
 		req = new(Req)
 		req.Clnt = clnt
-		req.tag = uint16(clnt.tagpool.getId())
+		req.tag = p.NOTAG // taken when sent, see Rpcnb
 	}
 	return req
 }
 
 func (clnt *Clnt) ReqFree(req *Req) {
+	// The response can come in before send is done writing the
+	// request, Tc can't be reused until then.
+	if req.written != nil {
+		<-req.written
+		req.written = nil
+	}
 	clnt.FreeFcall(req.Tc)
 	req.Tc = nil
 	req.Rc = nil
 	req.Err = nil
 	req.Done = nil
-	req.next = nil
-	req.prev = nil
+	req.fid = nil
+	req.recover = false
+	if req.tag != p.NOTAG {
+		clnt.tagpool.putId(uint32(req.tag))
+		req.tag = p.NOTAG
+	}
 
 	select {
 	case clnt.reqchan <- req:
 		break
 	default:
-		clnt.tagpool.putId(uint32(req.tag))
 	}
 }
 
@@ -485,6 +805,7 @@ func (clnt *Clnt) logFcall(fc *p.Fcall) {
 func init() {
 	clnts = new(ClntList)
 	clnts.c = make(map[uint32]*Clnt)
+	clnts.stats = make(map[uint32]*Clnt)
 	if sop, ok := (interface{}(clnts)).(StatsOps); ok {
 		sop.statsRegister()
 	}
@@ -0,0 +1,478 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"code.google.com/p/go9p/p/srv"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A scripted 9P server on one end of a pipe. Every T-message is
+// passed to answer, which packs the response into rc and returns
+// true, or returns false to leave the request unanswered.
+func fakeServer(t *testing.T, c net.Conn, answer func(tc, rc *p.Fcall) bool) {
+	buf := make([]byte, 8192)
+	dotu := false
+	for {
+		if _, err := io.ReadFull(c, buf[:4]); err != nil {
+			return
+		}
+		sz, _ := p.Gint32(buf)
+		if _, err := io.ReadFull(c, buf[4:sz]); err != nil {
+			return
+		}
+		tc, err, _ := p.Unpack(buf[:sz], dotu)
+		if err != nil {
+			t.Errorf("server unpack: %s", err)
+			return
+		}
+
+		rc := p.NewFcall(8192)
+		switch {
+		case tc.Type == p.Tversion:
+			dotu = tc.Version == p.VERSIONU
+			p.PackRversion(rc, tc.Msize, tc.Version)
+		case !answer(tc, rc):
+			continue
+		}
+		p.SetTag(rc, tc.Tag)
+		if _, err := c.Write(rc.Pkt); err != nil {
+			return
+		}
+	}
+}
+
+// Returns a client of a fakeServer calling answer, and the server's
+// end of the connection.
+func testFakeClnt(t *testing.T, answer func(tc, rc *p.Fcall) bool) (*Clnt, net.Conn) {
+	cc, sc := net.Pipe()
+	go fakeServer(t, sc, answer)
+	clnt, err := Connect(cc, 8192, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clnt, sc
+}
+
+func TestRpcContextFlush(t *testing.T) {
+	flushed := make(chan uint16, 1)
+	clnt, _ := testFakeClnt(t, func(tc, rc *p.Fcall) bool {
+		switch tc.Type {
+		case p.Tread: // hang
+			return false
+		case p.Tflush:
+			flushed <- tc.Oldtag
+			p.PackRflush(rc)
+		default:
+			p.PackRclunk(rc)
+		}
+		return true
+	})
+	defer clnt.Clunk(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	tc := clnt.NewFcall()
+	p.PackTread(tc, 1, 0, 100)
+	_, err := clnt.RpcContext(ctx, tc)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	select {
+	case oldtag := <-flushed:
+		if oldtag != tc.Tag {
+			t.Errorf("flushed tag %d, expected %d", oldtag, tc.Tag)
+		}
+	default:
+		t.Errorf("no Tflush sent")
+	}
+
+	tc = clnt.NewFcall()
+	p.PackTclunk(tc, 1)
+	rc, err := clnt.Rpc(tc)
+	if err != nil || rc.Type != p.Rclunk {
+		t.Errorf("rpc after flush: %v %v", rc, err)
+	}
+}
+
+// RpcContext returns once the context is done even if the server
+// doesn't answer the Tflush either, and the tags are freed when the
+// connection is torn down.
+func TestRpcContextFlushHang(t *testing.T) {
+	defer func(d time.Duration) { FlushTimeout = d }(FlushTimeout)
+	FlushTimeout = 20 * time.Millisecond
+
+	clnt, sc := testFakeClnt(t, func(tc, rc *p.Fcall) bool {
+		return false
+	})
+	clnt.SetMaxReqs(2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	tc := clnt.NewFcall()
+	p.PackTread(tc, 1, 0, 100)
+	if _, err := clnt.RpcContext(ctx, tc); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// the read and the flush hold their tags until the connection dies
+	inuse := func() int {
+		clnt.tagpool.Lock()
+		defer clnt.tagpool.Unlock()
+		return clnt.tagpool.inuse
+	}
+	if n := inuse(); n != 2 {
+		t.Errorf("%d tags in use, expected 2", n)
+	}
+	sc.Close()
+	for i := 0; i < 100 && inuse() != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := inuse(); n != 0 {
+		t.Errorf("%d tags in use after the connection closed", n)
+	}
+	clnt.Clunk(nil)
+}
+
+// The contents of the file "a" read by testRpcs: its byte k is k.
+var testBytes = func() string {
+	b := make([]byte, 256)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return string(b)
+}()
+
+// Returns a client of a server with the file "a" of testBytes, and
+// a fid of the file opened for reading.
+func testRpcClnt(t testing.TB, s *srv.Fsrv) (*Clnt, *Fid) {
+	clnt := testConnect(t, s)
+	return clnt, testRpcFid(t, clnt)
+}
+
+// Returns a fid of the file "a" of the server of clnt, opened for
+// reading.
+func testRpcFid(t testing.TB, clnt *Clnt) *Fid {
+	root, err := clnt.Attach(nil, clnt.User, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Clunk()
+
+	fid := clnt.FidAlloc()
+	if _, err := root.Walk(fid, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fid.Open(p.OREAD); err != nil {
+		t.Fatal(err)
+	}
+
+	return fid
+}
+
+// Reads the bytes of fid from n goroutines at once, count times
+// each, checking every answer is the one to its request.
+func testRpcs(t testing.TB, clnt *Clnt, fid *Fid, n, count int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				off := (i + j) % len(testBytes)
+				tc := clnt.NewFcall()
+				p.PackTread(tc, fid.Fid, uint64(off), 1)
+				rc, err := clnt.Rpc(tc)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if rc.Type != p.Rread || string(rc.Data) != testBytes[off:off+1] {
+					t.Errorf("answer %v to the read at %d", rc, off)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentRpc(t *testing.T) {
+	clnt, fid := testRpcClnt(t, testSrv(t, "a", testBytes))
+	testRpcs(t, clnt, fid, 1000, 4)
+	clnt.Lock()
+	left := len(clnt.reqs)
+	clnt.Unlock()
+	if left != 0 {
+		t.Errorf("%d requests left", left)
+	}
+
+	fid.Clunk()
+	clnt.Clunk(nil)
+	tc := clnt.NewFcall()
+	p.PackTclunk(tc, 1)
+	if _, err := clnt.Rpc(tc); err == nil {
+		t.Errorf("rpc on a closed client succeeded")
+	}
+}
+
+// Over a socket, the answer to a request can come in before send
+// returns from writing it; the request mustn't be reused until then.
+// Meant to be run with -race.
+func TestRpcWritten(t *testing.T) {
+	clnt, err := Dial(testListen(t, testSrv(t, "a", testBytes)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clnt.Clunk(nil)
+	fid := testRpcFid(t, clnt)
+	defer fid.Clunk()
+
+	testRpcs(t, clnt, fid, 4, 200)
+}
+
+// A client whose Tversion fails is torn down.
+func TestConnectError(t *testing.T) {
+	nclnts := func() int {
+		clnts.Lock()
+		defer clnts.Unlock()
+		return len(clnts.c)
+	}
+
+	n := nclnts()
+	cc, sc := net.Pipe()
+	sc.Close()
+	if _, err := Connect(cc, 8192+p.IOHDRSZ, true); err == nil {
+		t.Fatal("connected to a closed pipe")
+	}
+	if nclnts() != n {
+		t.Errorf("%d clients left, expected %d", nclnts(), n)
+	}
+}
+
+// A response the client can't make sense of tears it down, failing
+// the requests pending.
+func TestRpcProtocolError(t *testing.T) {
+	bad := map[string][]byte{
+		"unexpected tag": {11, 0, 0, 0, p.Rclunk, 0x34, 0x12, 0, 0, 0, 0},
+		"bad message":    {7, 0, 0, 0, 0, 0, 0},
+	}
+	for name, pkt := range bad {
+		cc, sc := net.Pipe()
+		go fakeServer(t, sc, func(tc, rc *p.Fcall) bool {
+			if tc.Type == p.Tread {
+				sc.Write(pkt)
+			}
+			return false
+		})
+
+		clnt, err := Connect(cc, 8192, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			go func(i int) {
+				tc := clnt.NewFcall()
+				if i == 0 {
+					p.PackTclunk(tc, 1) // unanswered
+				} else {
+					p.PackTread(tc, 1, 0, 100)
+				}
+				_, err := clnt.Rpc(tc)
+				done <- err
+			}(i)
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Errorf("%s: rpc succeeded", name)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: client hung", name)
+			}
+		}
+		clnt.Clunk(nil)
+	}
+}
+
+// Measures the reads of a byte with n requests outstanding.
+func BenchmarkRpc(b *testing.B) {
+	s := testSrv(b, "a", testBytes)
+	for _, n := range []int{1, 4, 16, 64, 256, 1024} {
+		b.Run(fmt.Sprintf("outstanding=%d", n), func(b *testing.B) {
+			clnt, fid := testRpcClnt(b, s)
+			defer clnt.Clunk(nil)
+			defer fid.Clunk()
+
+			b.ResetTimer()
+			testRpcs(b, clnt, fid, n, (b.N+n-1)/n)
+		})
+	}
+}
+
+// A synthetic file with fixed contents.
+type testFile struct {
+	srv.File
+	data []byte
+}
+
+func (f *testFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if offset > uint64(len(f.data)) {
+		return 0, nil
+	}
+
+	return copy(buf, f.data[offset:]), nil
+}
+
+func (f *testFile) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if end := int(offset) + len(data); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+		f.Length = uint64(end)
+	}
+	f.Qid.Version++
+
+	return copy(f.data[offset:], data), nil
+}
+
+func (f *testFile) Remove(fid *srv.FFid) error {
+	return nil
+}
+
+// A directory of the tree, whose permissions can be changed unless
+// it is read-only.
+type testDir struct {
+	srv.File
+	ro bool
+}
+
+func (d *testDir) Wstat(fid *srv.FFid, dir *p.Dir) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.ro {
+		return srv.Eperm
+	}
+	if dir.Mode != ^uint32(0) {
+		d.Mode = d.Mode&^0777 | dir.Mode&0777
+	}
+
+	return nil
+}
+
+// Serves a tree of testFiles, given by their paths and contents
+// (a trailing / makes a directory, read-only if the contents are
+// "ro", and a trailing @ a symbolic link to the contents), and
+// returns a namespace with the tree at its root.
+func testNS(t *testing.T, files ...string) *Namespace {
+	ns, err := NSFromClnt(testConnect(t, testSrv(t, files...)), nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ns
+}
+
+// Returns a server for a tree of testFiles, see testNS.
+func testSrv(t testing.TB, files ...string) *srv.Fsrv {
+	s := srv.NewFileSrv(testTree(t, files...))
+	s.Dotu = true
+	s.Start(s)
+	return s
+}
+
+// Returns the root of a tree of testFiles, see testNS.
+func testTree(t testing.TB, files ...string) *srv.File {
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	root := new(srv.File)
+	if err := root.Add(nil, "/", user, nil, p.DMDIR|0555, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(files); i += 2 {
+		name := strings.TrimRight(files[i], "/@")
+		elems := strings.Split(name, "/")
+		dir := root
+		for _, elem := range elems[:len(elems)-1] {
+			dir = dir.Find(elem)
+		}
+
+		name = elems[len(elems)-1]
+		if strings.HasSuffix(files[i], "/") {
+			d := &testDir{ro: files[i+1] == "ro"}
+			if err := d.Add(dir, name, user, nil, p.DMDIR|0555, d); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if strings.HasSuffix(files[i], "@") {
+			f := new(srv.File)
+			if err := f.Add(dir, name, user, nil, p.DMSYMLINK|0777, nil); err != nil {
+				t.Fatal(err)
+			}
+			f.Ext = files[i+1]
+			continue
+		}
+
+		f := &testFile{data: []byte(files[i+1])}
+		if err := f.Add(dir, name, user, nil, 0666, f); err != nil {
+			t.Fatal(err)
+		}
+		f.Length = uint64(len(f.data))
+	}
+
+	return root
+}
+
+// Serves s on a TCP port until the end of the test, and returns
+// its address for Dial.
+func testListen(t *testing.T, s *srv.Fsrv) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.NewConn(c)
+		}
+	}()
+
+	return fmt.Sprintf("tcp!127.0.0.1!%d", l.Addr().(*net.TCPAddr).Port)
+}
+
+// Returns a client connected to the server.
+func testConnect(t testing.TB, s *srv.Fsrv) *Clnt {
+	return testConnectVersion(t, s, p.VERSIONU)
+}
+
+// Like testConnect, proposing the dialect ver.
+func testConnectVersion(t testing.TB, s *srv.Fsrv, ver string) *Clnt {
+	cc, sc := net.Pipe()
+	go s.NewConn(sc)
+
+	clnt, err := ConnectVersion(cc, 8192+p.IOHDRSZ, ver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clnt
+}
@@ -5,25 +5,82 @@
 package chan9
 
 import "code.google.com/p/go9p/p"
+import "context"
+import "sync"
+
+// Guards the refs of the fids, and the prev/next links of the
+// unions of the mount tables, which Mount and Umount change while
+// walks follow them (see Namespace).
+var unionlk sync.Mutex
 
 // Clunks a fid. Returns nil if successful.
 func (fid *Fid) Clunk() (err error) {
+	return fid.ClunkContext(context.Background())
+}
+
+// Like Clunk, but stops waiting for the Rclunk once the context is
+// done and returns ctx.Err(). The fid is released in either case.
+func (fid *Fid) ClunkContext(ctx context.Context) (err error) {
 	err = nil
-	if fid.walked {
+	stale := fid.Clnt.untrack(fid)
+	if fid.walked && !stale {
 		tc := fid.Clnt.NewFcall()
-		err := p.PackTclunk(tc, fid.Fid)
+		err = p.PackTclunk(tc, fid.Fid)
 		if err != nil {
 			return err
 		}
 
-		_, err = fid.Clnt.Rpc(tc)
+		_, err = fid.Clnt.RpcContext(ctx, tc)
 	}
 
+	fid.release()
+	return
+}
+
+// Returns the fid number to the pool and drops the fid's reference
+// to the client, once the fid is clunked or removed.
+func (fid *Fid) release() {
 	fid.Clnt.fidpool.putId(fid.Fid)
 	fid.Clnt.decref()
 	fid.walked = false
+	fid.opened = false
 	fid.Fid = p.NOFID
-	return
+
+	unionlk.Lock()
+	next := fid.next
+	fid.prev = nil
+	fid.next = nil
+	unionlk.Unlock()
+	if next != nil {
+		next.decref()
+	}
+}
+
+/* Takes a reference to a fid shared by goroutines: the Root and
+ * Cwd of a Namespace and the fids of its mount table, which start
+ * with one, held by their owner. The next link of a union member
+ * holds one too, so the rest of a union stays usable by the walks
+ * that reached it, until they are done. Returns false if the fid
+ * was already released. Called with unionlk held.
+ */
+func (fid *Fid) incref() bool {
+	if fid.ref <= 0 {
+		return false
+	}
+	fid.ref++
+	return true
+}
+
+// Drops a reference to a shared fid, clunking it if it was the
+// last one. A fid never shared is clunked.
+func (fid *Fid) decref() {
+	unionlk.Lock()
+	fid.ref--
+	last := fid.ref <= 0
+	unionlk.Unlock()
+	if last {
+		fid.Clunk()
+	}
 }
 
 // Closes a file. Returns nil if successful.
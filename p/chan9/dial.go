@@ -0,0 +1,344 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chan9
+
+/*  Dialing.
+    DialOpts connects to a server by its Plan 9 style network name
+    (tcp!host!port), as Dial does, with the settings of the connection
+    given as Options: msize, dialect, user, attach name and subpath,
+    TLS, a timeout and the net.Dialer to use. The same settings are
+    used when the connection is recovered (see recover.go).
+
+    The network of the name is looked up in the networks registered
+    with RegisterNetwork, and dialed by net if it's not there. Besides
+    tcp, udp and the rest of net's, names can use:
+
+	tls!host!service	TLS over tcp (WithTLS gives the tls.Config)
+	unix!/path/of/socket	a Unix domain socket
+	net!host!service	tcp, the network in common with any host
+
+    DialCmd speaks 9P with a server it starts, over the standard input
+    and output of the process.
+*/
+
+import (
+	"code.google.com/p/go9p/p"
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dials addr, the part of a network name after the network. If the
+// name gave a service, addr has the form host:port (see p.ParseNetName).
+// Returns once ctx is done at the latest.
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+var networks = struct {
+	sync.RWMutex
+	m map[string]DialFunc
+}{m: map[string]DialFunc{
+	"tls":  dialTLS,
+	"unix": dialUnix,
+}}
+
+/* Makes Dial (and so NewNS, for the mounts of namespace files) dial
+ * the network names of network name with f. A later registration of
+ * the same name replaces the earlier one, including the ones of tls
+ * and unix, registered by default.
+ */
+func RegisterNetwork(name string, f DialFunc) {
+	if name == "" || name == "net" || strings.Contains(name, "!") || f == nil {
+		panic("chan9: bad RegisterNetwork of " + name)
+	}
+
+	networks.Lock()
+	networks.m[name] = f
+	networks.Unlock()
+}
+
+func lookupNetwork(name string) DialFunc {
+	networks.RLock()
+	defer networks.RUnlock()
+	return networks.m[name]
+}
+
+// An option of DialOpts.
+type Option func(*dialOpts)
+
+type dialOpts struct {
+	msize   uint32
+	ver     string
+	user    p.User
+	aname   string
+	subpath []string
+	tls     *tls.Config
+	timeout time.Duration
+	dialer  *net.Dialer
+}
+
+// Proposes msize as the maximum size of the 9P messages (8192+IOHDRSZ
+// by default). The server may lower it.
+func WithMsize(msize uint32) Option {
+	return func(o *dialOpts) { o.msize = msize }
+}
+
+// Proposes the dialect ver, see ConnectVersion (9P2000.u by default).
+func WithVersion(ver string) Option {
+	return func(o *dialOpts) { o.ver = ver }
+}
+
+// Sets the user the client attaches as (the owner of the process
+// by default).
+func WithUser(user p.User) Option {
+	return func(o *dialOpts) { o.user = user }
+}
+
+// Sets the file tree Mount and NSFromClnt attach to, when given
+// no aname, see Clnt.Aname.
+func WithAname(aname string) Option {
+	return func(o *dialOpts) { o.aname = aname }
+}
+
+// Sets the directory of the server Mount mounts, see Clnt.Subpath.
+func WithSubpath(path string) Option {
+	return func(o *dialOpts) { o.subpath = ParseName(path).Elems }
+}
+
+// Speaks TLS over the connection, configured by config, whatever its
+// network. Without a ServerName, the host of the address is used.
+func WithTLS(config *tls.Config) Option {
+	return func(o *dialOpts) { o.tls = config }
+}
+
+// Gives up if the connection isn't up, with the version negotiated,
+// after d.
+func WithTimeout(d time.Duration) Option {
+	return func(o *dialOpts) { o.timeout = d }
+}
+
+// Dials net's networks, tls and unix with d rather than a net.Dialer
+// with the default settings. The earlier of the timeout set by
+// WithTimeout and d's applies.
+func WithDialer(d *net.Dialer) Option {
+	return func(o *dialOpts) { o.dialer = d }
+}
+
+// Dial a server and return a non-attached client "channel."
+func Dial(addr string) (*Clnt, error) {
+	return DialOpts(addr)
+}
+
+// Like Dial, with the settings of the connection given by opts.
+func DialOpts(addr string, opts ...Option) (*Clnt, error) {
+	o := newDialOpts(opts)
+	c, err := o.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.connect(c, addr, func() (net.Conn, error) { return o.dial(addr) })
+}
+
+func newDialOpts(opts []Option) *dialOpts {
+	o := &dialOpts{msize: 8192 + p.IOHDRSZ, ver: p.VERSIONU}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// Negotiates the version over c, the connection to addr, and sets up
+// the client with the options. dial opens the connection again, to
+// recover it.
+func (o *dialOpts) connect(c net.Conn, addr string, dial func() (net.Conn, error)) (*Clnt, error) {
+	if o.timeout > 0 {
+		c.SetDeadline(time.Now().Add(o.timeout))
+	}
+
+	clnt, err := ConnectVersion(c, o.msize, o.ver)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if o.timeout > 0 {
+		c.SetDeadline(time.Time{})
+	}
+	clnt.Id = addr
+	clnt.addr = addr
+	clnt.dial = dial
+	if o.user != nil {
+		clnt.User = o.user
+	}
+	clnt.Aname = o.aname
+	if o.subpath != nil {
+		clnt.Subpath = o.subpath
+	}
+
+	return clnt, nil
+}
+
+// Opens the network connection for a Plan 9 style address.
+func (o *dialOpts) dial(addr string) (net.Conn, error) {
+	proto, netaddr, e := p.ParseNetName(addr)
+	if e != nil {
+		return nil, &p.Error{e.Error(), p.EIO}
+	}
+
+	ctx := context.WithValue(context.Background(), dialOptsKey{}, o)
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	var c net.Conn
+	if f := lookupNetwork(proto); f != nil {
+		c, e = f(ctx, netaddr)
+	} else {
+		c, e = o.netDialer().DialContext(ctx, proto, netaddr)
+	}
+	if e == nil && o.tls != nil && proto != "tls" {
+		c, e = tlsClient(ctx, c, netaddr, o.tls)
+	}
+	if e != nil {
+		return nil, &p.Error{e.Error(), p.EIO}
+	}
+
+	return c, nil
+}
+
+// The dialOpts of the DialOpts a DialFunc is called by are in the
+// context under this key, for the default networks.
+type dialOptsKey struct{}
+
+func optsFrom(ctx context.Context) *dialOpts {
+	if o, ok := ctx.Value(dialOptsKey{}).(*dialOpts); ok {
+		return o
+	}
+
+	return new(dialOpts)
+}
+
+func (o *dialOpts) netDialer() *net.Dialer {
+	if o.dialer != nil {
+		return o.dialer
+	}
+
+	return new(net.Dialer)
+}
+
+func dialTLS(ctx context.Context, addr string) (net.Conn, error) {
+	o := optsFrom(ctx)
+	d := &tls.Dialer{NetDialer: o.netDialer(), Config: o.tls}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func dialUnix(ctx context.Context, addr string) (net.Conn, error) {
+	return optsFrom(ctx).netDialer().DialContext(ctx, "unix", addr)
+}
+
+// Speaks TLS over c, a connection to addr of a network other than tls.
+func tlsClient(ctx context.Context, c net.Conn, addr string, config *tls.Config) (net.Conn, error) {
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = addr
+		if host, _, e := net.SplitHostPort(addr); e == nil {
+			config.ServerName = host
+		}
+	}
+
+	tc := tls.Client(c, config)
+	if e := tc.HandshakeContext(ctx); e != nil {
+		c.Close()
+		return nil, e
+	}
+
+	return tc, nil
+}
+
+// Time a server started by DialCmd has to exit once its client is
+// closed, before it is killed.
+var CmdWaitDelay = 5 * time.Second
+
+/* Starts the command name with the args, a 9P server speaking over
+ * its standard input and output (u9fs, exportfs, ssh host exportfs),
+ * and returns a non-attached client connected to it, like Dial.
+ * The standard error of the command is the one of the process. The
+ * process is told to exit by closing its standard input once the
+ * client is removed, when the last reference to it is dropped, and
+ * killed if it hasn't after CmdWaitDelay. If Clnt.Reconnect is set,
+ * the command is started again to recover the connection.
+ */
+func DialCmd(name string, args ...string) (*Clnt, error) {
+	return DialCmdOpts(name, args)
+}
+
+// Like DialCmd, with the settings of the connection given by opts
+// (WithTLS and WithDialer aside), as for DialOpts.
+func DialCmdOpts(name string, args []string, opts ...Option) (*Clnt, error) {
+	o := newDialOpts(opts)
+	c, err := startCmd(name, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.connect(c, c.RemoteAddr().String(), func() (net.Conn, error) { return startCmd(name, args) })
+}
+
+// The connection to a server started by DialCmd.
+type cmdConn struct {
+	p.PipeConn
+	cmd    *exec.Cmd
+	closed sync.Once
+}
+
+func startCmd(name string, args []string) (net.Conn, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, &p.Error{err.Error(), p.EIO}
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		w.Close()
+		return nil, &p.Error{err.Error(), p.EIO}
+	}
+	if err = cmd.Start(); err != nil {
+		w.Close()
+		r.Close()
+		return nil, &p.Error{err.Error(), p.EIO}
+	}
+
+	return &cmdConn{PipeConn: p.PipeConn{r, w, strings.Join(cmd.Args, " ")}, cmd: cmd}, nil
+}
+
+// Closes the pipes, and waits for the process in the background,
+// killing it if it takes longer than CmdWaitDelay to exit.
+func (c *cmdConn) Close() error {
+	err := c.PipeConn.Close()
+	c.closed.Do(func() {
+		exited := make(chan bool)
+		go func() {
+			c.cmd.Wait()
+			close(exited)
+		}()
+		go func() {
+			select {
+			case <-exited:
+			case <-time.After(CmdWaitDelay):
+				c.cmd.Process.Kill()
+			}
+		}()
+	})
+
+	return err
+}
@@ -0,0 +1,185 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialOpts(t *testing.T) {
+	addr := testListen(t, testSrv(t, "d/", "", "d/b", "hello"))
+	clnt, err := DialOpts(addr, WithMsize(4096+p.IOHDRSZ), WithVersion(p.VERSION), WithSubpath("/d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clnt.Msize != 4096+p.IOHDRSZ || clnt.Dotu {
+		t.Errorf("msize %d dotu %v", clnt.Msize, clnt.Dotu)
+	}
+
+	ns, err := NSFromClnt(clnt, nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	file, err := ns.FOpen(ParseName("/b"), p.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := file.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("read /b: %q %v", buf[:n], err)
+	}
+	file.Close()
+
+	// a server that never answers Tversion
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			defer c.Close()
+			io.Copy(io.Discard, c)
+		}
+	}()
+	silent := fmt.Sprintf("tcp!127.0.0.1!%d", l.Addr().(*net.TCPAddr).Port)
+	_, err = DialOpts(silent, WithTimeout(50*time.Millisecond))
+	if err == nil {
+		t.Error("dialed a silent server")
+	}
+}
+
+func TestRegisterNetwork(t *testing.T) {
+	s := testSrv(t, "a", "hello")
+	var dialed string
+	RegisterNetwork("test", func(ctx context.Context, addr string) (net.Conn, error) {
+		dialed = addr
+		cc, sc := net.Pipe()
+		go s.NewConn(sc)
+		return cc, nil
+	})
+
+	sock := t.TempDir() + "/sock"
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.NewConn(c)
+		}
+	}()
+
+	for _, addr := range []string{"test!srv!9fs", "unix!" + sock} {
+		clnt, err := Dial(addr)
+		if err != nil {
+			t.Fatalf("dial %s: %v", addr, err)
+		}
+		ns, err := NSFromClnt(clnt, nil, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := ns.FOpen(ParseName("/a"), p.OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		n, err := file.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Errorf("%s: read /a: %q %v", addr, buf[:n], err)
+		}
+		file.Close()
+		ns.Close()
+	}
+	if dialed != "srv:564" {
+		t.Errorf("test network dialed %q", dialed)
+	}
+
+	if _, err := Dial("nosuchnet!srv"); err == nil {
+		t.Error("dialed an unknown network")
+	}
+}
+
+// Serves testSrv over stdio when run by TestDialCmd.
+func TestStdioServer(t *testing.T) {
+	if os.Getenv("GO9P_TEST_STDIO") == "" {
+		t.Skip("run by TestDialCmd")
+	}
+
+	if err := testSrv(t, "a", "hello").ServeStdio(); err != nil {
+		t.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+func TestDialCmd(t *testing.T) {
+	t.Setenv("GO9P_TEST_STDIO", "1")
+	var nss []*Namespace
+	var cmds []*exec.Cmd
+	run := "-test.run=^TestStdioServer$"
+	for i := 0; i < 2; i++ { // same command, same Id
+		var clnt *Clnt
+		var err error
+		msize, dotu := uint32(8192+p.IOHDRSZ), true
+		if i == 0 {
+			clnt, err = DialCmd(os.Args[0], run)
+		} else {
+			msize, dotu = 4096+p.IOHDRSZ, false
+			clnt, err = DialCmdOpts(os.Args[0], []string{run}, WithMsize(msize), WithVersion(p.VERSION))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clnt.Msize != msize || clnt.Dotu != dotu {
+			t.Errorf("msize %d dotu %v", clnt.Msize, clnt.Dotu)
+		}
+		cmds = append(cmds, clnt.conn.(*cmdConn).cmd)
+
+		ns, err := NSFromClnt(clnt, nil, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nss = append(nss, ns)
+	}
+
+	for _, ns := range nss {
+		file, err := ns.FOpen(ParseName("/a"), p.OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		n, err := file.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Errorf("read /a: %q %v", buf[:n], err)
+		}
+		file.Close()
+		if err := ns.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the servers exit once their stdin is closed
+	for _, cmd := range cmds {
+		for i := 0; cmd.Process.Signal(syscall.Signal(0)) == nil; i++ {
+			if i == 100 {
+				t.Fatal("server still running")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
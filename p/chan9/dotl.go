@@ -0,0 +1,542 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chan9
+
+// Low level methods that correspond directly to the 9P2000.L
+// message requests. They can only be used if the Clnt speaks
+// 9P2000.L (Clnt.Dotl is set). Fid.Open, Fid.Create, Fid.Stat,
+// Fid.Wstat and File.Readdir use them automatically.
+
+import (
+	"code.google.com/p/go9p/p"
+	"context"
+	"strconv"
+	"syscall"
+)
+
+var Enotdotl = &p.Error{"9P2000.L not negotiated", p.ENOSYS}
+var Etoolarge error = &p.Error{"directory entry too large for the buffer", p.EINVAL}
+
+func (fid *Fid) dotlRpc(tc *p.Fcall) (*p.Fcall, error) {
+	return fid.dotlRpcContext(context.Background(), tc)
+}
+
+func (fid *Fid) dotlRpcContext(ctx context.Context, tc *p.Fcall) (*p.Fcall, error) {
+	if !fid.Clnt.Dotl {
+		return nil, Enotdotl
+	}
+
+	return fid.Clnt.RpcContext(ctx, tc)
+}
+
+// Opens the file associated with the fid using Linux open(2) flags.
+// Returns nil if the operation is successful.
+func (fid *Fid) Lopen(flags uint32) error {
+	return fid.lopen(context.Background(), flags)
+}
+
+func (fid *Fid) lopen(ctx context.Context, flags uint32) error {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTlopen(tc, fid.Fid, flags)
+	if err != nil {
+		return err
+	}
+
+	rc, err := fid.dotlRpcContext(ctx, tc)
+	if err != nil {
+		return err
+	}
+
+	fid.cacheValidate(rc.Qid)
+	fid.Qid = rc.Qid
+	fid.setIounit(rc.Iounit)
+	fid.Mode = p.Lflags2Omode(flags)
+	fid.opened = true
+	return nil
+}
+
+// Creates and opens a regular file in the directory associated with
+// the fid. On success the fid points to the new file.
+func (fid *Fid) Lcreate(name string, flags uint32, mode uint32, gid uint32) error {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTlcreate(tc, fid.Fid, name, flags, mode, gid)
+	if err != nil {
+		return err
+	}
+
+	rc, err := fid.dotlRpc(tc)
+	if err != nil {
+		return err
+	}
+
+	fid.Qid = rc.Qid
+	fid.setIounit(rc.Iounit)
+	fid.Mode = p.Lflags2Omode(flags)
+	fid.opened = true
+	fid.Cname = append(fid.Cname, name)
+	return nil
+}
+
+// Returns the attributes selected by mask (GETATTR_* values) of
+// the file associated with the fid, or an Error.
+func (fid *Fid) Getattr(mask uint64) (*p.Attr, error) {
+	return fid.getattr(context.Background(), mask)
+}
+
+func (fid *Fid) getattr(ctx context.Context, mask uint64) (*p.Attr, error) {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTgetattr(tc, fid.Fid, mask)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := fid.dotlRpcContext(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Attr, nil
+}
+
+// Modifies the attributes of the file associated with the fid.
+func (fid *Fid) Setattr(attr *p.SetAttr) error {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTsetattr(tc, fid.Fid, attr)
+	if err != nil {
+		return err
+	}
+
+	_, err = fid.dotlRpc(tc)
+	return err
+}
+
+// Reads directory entries from the open directory associated with the
+// fid, starting at the entry following the offset cookie (0 for the
+// first entry). Returns an empty slice at the end of the directory.
+func (fid *Fid) Lreaddir(offset uint64, count uint32) ([]*p.Dirent, error) {
+	if count > fid.Iounit {
+		count = fid.Iounit
+	}
+
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTreaddir(tc, fid.Fid, offset, count)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := fid.dotlRpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.UnpackDirents(rc.Data)
+}
+
+// Creates a directory in the directory associated with the fid.
+// Returns the Qid of the new directory, or an Error.
+func (fid *Fid) Mkdir(name string, mode uint32, gid uint32) (*p.Qid, error) {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTmkdir(tc, fid.Fid, name, mode, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := fid.dotlRpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Qid, nil
+}
+
+// Creates a symbolic link in the directory associated with the fid.
+// Returns the Qid of the link, or an Error.
+func (fid *Fid) Symlink(name string, target string, gid uint32) (*p.Qid, error) {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTsymlink(tc, fid.Fid, name, target, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := fid.dotlRpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Qid, nil
+}
+
+// Creates a device node or named pipe in the directory associated with
+// the fid. Returns the Qid of the node, or an Error.
+func (fid *Fid) Mknod(name string, mode, major, minor, gid uint32) (*p.Qid, error) {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTmknod(tc, fid.Fid, name, mode, major, minor, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := fid.dotlRpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Qid, nil
+}
+
+// Returns the target of the symbolic link associated with the fid.
+func (fid *Fid) Readlink() (string, error) {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTreadlink(tc, fid.Fid)
+	if err != nil {
+		return "", err
+	}
+
+	rc, err := fid.dotlRpc(tc)
+	if err != nil {
+		return "", err
+	}
+
+	return rc.Target, nil
+}
+
+// Creates a hard link named name in the directory associated with
+// the fid, pointing to the file associated with target.
+func (fid *Fid) Link(target *Fid, name string) error {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTlink(tc, fid.Fid, target.Fid, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = fid.dotlRpc(tc)
+	return err
+}
+
+// Moves the file associated with the fid to the directory dir under
+// the new name.
+func (fid *Fid) Rename(dir *Fid, name string) error {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTrename(tc, fid.Fid, dir.Fid, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = fid.dotlRpc(tc)
+	return err
+}
+
+// Renames oldname in the directory associated with the fid to newname
+// in the directory newdir.
+func (fid *Fid) Renameat(oldname string, newdir *Fid, newname string) error {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTrenameat(tc, fid.Fid, oldname, newdir.Fid, newname)
+	if err != nil {
+		return err
+	}
+
+	_, err = fid.dotlRpc(tc)
+	return err
+}
+
+// Removes name from the directory associated with the fid. The flags
+// can be p.AT_REMOVEDIR to remove a directory.
+func (fid *Fid) Unlinkat(name string, flags uint32) error {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTunlinkat(tc, fid.Fid, name, flags)
+	if err != nil {
+		return err
+	}
+
+	_, err = fid.dotlRpc(tc)
+	return err
+}
+
+// Flushes the data of the open file associated with the fid to stable
+// storage. If datasync is true, only the file data is flushed.
+func (fid *Fid) Fsync(datasync bool) error {
+	var ds uint32
+	if datasync {
+		ds = 1
+	}
+
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTfsync(tc, fid.Fid, ds)
+	if err != nil {
+		return err
+	}
+
+	_, err = fid.dotlRpc(tc)
+	return err
+}
+
+// Returns the file system information for the file system containing
+// the file associated with the fid.
+func (fid *Fid) Statfs() (*p.Statfs, error) {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTstatfs(tc, fid.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := fid.dotlRpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Statfs, nil
+}
+
+// Acquires or releases a POSIX record lock on the open file associated
+// with the fid (Tlock; named so as not to hide Fid.Lock). Returns one
+// of the p.LOCK_* status values.
+func (fid *Fid) Flock(lk *p.Flock) (uint8, error) {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTlock(tc, fid.Fid, lk)
+	if err != nil {
+		return p.LOCK_ERROR, err
+	}
+
+	rc, err := fid.dotlRpc(tc)
+	if err != nil {
+		return p.LOCK_ERROR, err
+	}
+
+	return rc.Status, nil
+}
+
+// Tests for the existence of a POSIX record lock conflicting with lk.
+// Returns the conflicting lock, or lk with Type set to p.LOCK_TYPE_UNLCK.
+func (fid *Fid) Getlock(lk *p.Flock) (*p.Flock, error) {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTgetlock(tc, fid.Fid, lk)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := fid.dotlRpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Flock, nil
+}
+
+// Prepares newfid for reading the extended attribute name of the file
+// associated with the fid (all attribute names if name is empty).
+// Returns the size of the attribute value.
+func (fid *Fid) Xattrwalk(newfid *Fid, name string) (uint64, error) {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTxattrwalk(tc, fid.Fid, newfid.Fid, name)
+	if err != nil {
+		return 0, err
+	}
+
+	rc, err := fid.dotlRpc(tc)
+	if err != nil {
+		return 0, err
+	}
+
+	newfid.walked = true
+	newfid.xattr = true
+	newfid.setIounit(0)
+	newfid.Mode = p.OREAD
+	return rc.Xsize, nil
+}
+
+// Prepares the fid for writing size bytes of the extended attribute
+// name. The attribute is set when the fid is clunked.
+func (fid *Fid) Xattrcreate(name string, size uint64, flags uint32) error {
+	tc := fid.Clnt.NewFcall()
+	err := p.PackTxattrcreate(tc, fid.Fid, name, size, flags)
+	if err != nil {
+		return err
+	}
+
+	_, err = fid.dotlRpc(tc)
+	if err != nil {
+		return err
+	}
+
+	fid.xattr = true
+	fid.setIounit(0)
+	fid.Mode = p.OWRITE
+	return nil
+}
+
+func (fid *Fid) setIounit(iounit uint32) {
+	fid.Iounit = iounit
+	if fid.Iounit == 0 || fid.Iounit > fid.Clnt.Msize-p.IOHDRSZ {
+		fid.Iounit = fid.Clnt.Msize - p.IOHDRSZ
+	}
+}
+
+// 9P2000.L replacement for Fid.Stat
+func (fid *Fid) lstat(ctx context.Context) (*p.Dir, error) {
+	attr, err := fid.getattr(ctx, p.GETATTR_BASIC)
+	if err != nil {
+		return nil, err
+	}
+
+	fid.cacheValidate(attr.Qid)
+	return Attr2Dir(attr, fid.basename()), nil
+}
+
+// Returns the last element of the Cname of the fid, "/" if it is empty.
+func (fid *Fid) basename() string {
+	if n := len(fid.Cname); n > 0 {
+		return fid.Cname[n-1]
+	}
+
+	return "/"
+}
+
+// 9P2000.L replacement for Fid.Wstat. The name is changed with
+// Trename relative to the parent directory of the fid (the Cname is
+// updated by Wstat).
+func (fid *Fid) lwstat(dir *p.Dir) error {
+	var sa p.SetAttr
+
+	if dir.Mode != 0xFFFFFFFF {
+		sa.Valid |= p.SETATTR_MODE
+		sa.Mode = dir.Mode & 0777
+		if dir.Mode&p.DMSETUID != 0 {
+			sa.Mode |= syscall.S_ISUID
+		}
+		if dir.Mode&p.DMSETGID != 0 {
+			sa.Mode |= syscall.S_ISGID
+		}
+	}
+	if dir.Length != 0xFFFFFFFFFFFFFFFF {
+		sa.Valid |= p.SETATTR_SIZE
+		sa.Size = dir.Length
+	}
+	if dir.Atime != 0xFFFFFFFF {
+		sa.Valid |= p.SETATTR_ATIME | p.SETATTR_ATIME_SET
+		sa.AtimeSec = uint64(dir.Atime)
+	}
+	if dir.Mtime != 0xFFFFFFFF {
+		sa.Valid |= p.SETATTR_MTIME | p.SETATTR_MTIME_SET
+		sa.MtimeSec = uint64(dir.Mtime)
+	}
+	if dir.Uidnum != p.NOUID {
+		sa.Valid |= p.SETATTR_UID
+		sa.Uid = dir.Uidnum
+	}
+	if dir.Gidnum != p.NOUID {
+		sa.Valid |= p.SETATTR_GID
+		sa.Gid = dir.Gidnum
+	}
+
+	if sa.Valid != 0 {
+		err := fid.Setattr(&sa)
+		if err != nil {
+			return err
+		}
+	}
+
+	if dir.Name == "" {
+		return nil
+	}
+
+	// The parent is walked to in a new fid, from fid itself: WalkOne
+	// would go on to the other members of a union.
+	pfid := fid.Clnt.FidAlloc()
+	if _, err := fid.Walk(pfid, []string{".."}); err != nil {
+		pfid.Clunk()
+		return err
+	}
+
+	err := fid.Rename(pfid, dir.Name)
+	pfid.Clunk()
+	return err
+}
+
+// Fills buf with directory entries in the 9P2000.u stat format, read
+// with Treaddir. The Offset of the File holds the readdir cookie.
+// Returns the number of bytes filled in, 0 at the end of the directory,
+// or Etoolarge if the next entry doesn't fit in buf.
+func (file *File) lreaddir(buf []byte) (int, error) {
+	for {
+		// stat entries are up to three times larger than dirents
+		des, err := file.Fid.Lreaddir(file.Offset, uint32(len(buf)/3))
+		if err != nil || len(des) == 0 {
+			return 0, err
+		}
+
+		n := 0
+		for _, de := range des {
+			if de.Name != "." && de.Name != ".." {
+				sz := p.PackDir(Dirent2Dir(de), buf[n:], true)
+				if sz == 0 {
+					if n == 0 { // would be read again and again
+						return 0, Etoolarge
+					}
+					break
+				}
+				n += sz
+			}
+			file.Offset = de.Offset
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Converts the 9P2000.L attributes of a file to a 9P2000.u Dir.
+func Attr2Dir(attr *p.Attr, name string) *p.Dir {
+	d := new(p.Dir)
+	d.Qid = attr.Qid
+	d.Name = name
+	d.Mode = attr.Mode & 0777
+	switch attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		d.Mode |= p.DMDIR
+	case syscall.S_IFLNK:
+		d.Mode |= p.DMSYMLINK
+	case syscall.S_IFSOCK:
+		d.Mode |= p.DMSOCKET
+	case syscall.S_IFIFO:
+		d.Mode |= p.DMNAMEDPIPE
+	case syscall.S_IFBLK, syscall.S_IFCHR:
+		d.Mode |= p.DMDEVICE
+	}
+	if attr.Mode&syscall.S_ISUID != 0 {
+		d.Mode |= p.DMSETUID
+	}
+	if attr.Mode&syscall.S_ISGID != 0 {
+		d.Mode |= p.DMSETGID
+	}
+
+	d.Atime = uint32(attr.AtimeSec)
+	d.Mtime = uint32(attr.MtimeSec)
+	d.Length = attr.Size
+	d.Uidnum = attr.Uid
+	d.Gidnum = attr.Gid
+	d.Muidnum = p.NOUID
+	d.Uid = strconv.FormatUint(uint64(attr.Uid), 10)
+	d.Gid = strconv.FormatUint(uint64(attr.Gid), 10)
+	return d
+}
+
+// Converts a 9P2000.L directory entry to a minimal Dir. Only the
+// Qid, Name and the file type bits of Mode are filled in.
+func Dirent2Dir(de *p.Dirent) *p.Dir {
+	d := new(p.Dir)
+	d.Qid = de.Qid
+	d.Name = de.Name
+	d.Uidnum = p.NOUID
+	d.Gidnum = p.NOUID
+	d.Muidnum = p.NOUID
+	if de.Qid.Type&p.QTDIR != 0 {
+		d.Mode |= p.DMDIR
+	}
+	if de.Qid.Type&p.QTSYMLINK != 0 {
+		d.Mode |= p.DMSYMLINK
+	}
+
+	return d
+}
@@ -0,0 +1,201 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"code.google.com/p/go9p/p/srv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// A server of a tree of testFiles that speaks 9P2000.L too, reading
+// only: Tlopen, Tgetattr and Treaddir are answered, and Trename of a
+// file in its directory.
+type testLSrv struct {
+	*srv.Fsrv
+	names map[*srv.File][]string // the entries of the directories
+}
+
+var Etestro error = &p.Error{"read-only test server", p.EPERM}
+
+func newTestLSrv(t testing.TB, files ...string) *testLSrv {
+	root := testTree(t, files...)
+	s := &testLSrv{srv.NewFileSrv(root), make(map[*srv.File][]string)}
+	for i := 0; i < len(files); i += 2 {
+		elems := strings.Split(strings.TrimRight(files[i], "/@"), "/")
+		dir := root
+		for _, elem := range elems[:len(elems)-1] {
+			dir = dir.Find(elem)
+		}
+		s.names[dir] = append(s.names[dir], elems[len(elems)-1])
+	}
+
+	s.Dotu = true
+	s.Dotl = true
+	s.Start(s)
+	return s
+}
+
+func (s *testLSrv) Lopen(req *srv.Req) {
+	f := req.Fid.Aux.(*srv.FFid).F
+	req.RespondRlopen(&f.Qid, 0)
+}
+
+func (s *testLSrv) Getattr(req *srv.Req) {
+	f := req.Fid.Aux.(*srv.FFid).F
+	attr := &p.Attr{Valid: p.GETATTR_BASIC, Qid: f.Qid, Nlink: 1, Size: f.Length}
+	attr.Mode = f.Mode & 0777
+	if f.Mode&p.DMDIR != 0 {
+		attr.Mode |= syscall.S_IFDIR
+	} else {
+		attr.Mode |= syscall.S_IFREG
+	}
+	attr.MtimeSec = uint64(f.Mtime)
+	req.RespondRgetattr(attr)
+}
+
+func (s *testLSrv) Readdir(req *srv.Req) {
+	f := req.Fid.Aux.(*srv.FFid).F
+	names := s.names[f]
+	buf := make([]byte, req.Tc.Count)
+	n := 0
+	for i := int(req.Tc.Offset); i < len(names); i++ {
+		c := f.Find(names[i])
+		sz := p.PackDirent(&p.Dirent{c.Qid, uint64(i + 1), c.Qid.Type, names[i]}, buf[n:])
+		if sz == 0 {
+			break
+		}
+		n += sz
+	}
+	req.RespondRreaddir(buf[:n])
+}
+
+func (s *testLSrv) Lcreate(req *srv.Req)  { req.RespondError(Etestro) }
+func (s *testLSrv) Setattr(req *srv.Req)  { req.RespondError(Etestro) }
+func (s *testLSrv) Mkdir(req *srv.Req)    { req.RespondError(Etestro) }
+func (s *testLSrv) Renameat(req *srv.Req) { req.RespondError(Etestro) }
+func (s *testLSrv) Unlinkat(req *srv.Req) { req.RespondError(Etestro) }
+func (s *testLSrv) Fsync(req *srv.Req)    { req.RespondRempty() }
+func (s *testLSrv) Statfs(req *srv.Req)   { req.RespondError(Etestro) }
+
+func (s *testLSrv) Symlink(req *srv.Req)  { req.RespondError(Etestro) }
+func (s *testLSrv) Readlink(req *srv.Req) { req.RespondError(Etestro) }
+func (s *testLSrv) Link(req *srv.Req)     { req.RespondError(Etestro) }
+func (s *testLSrv) Mknod(req *srv.Req)    { req.RespondError(Etestro) }
+
+func (s *testLSrv) Rename(req *srv.Req) {
+	f := req.Fid.Aux.(*srv.FFid).F
+	if req.Fid2.Aux.(*srv.FFid).F != f.Parent {
+		req.RespondError(Etestro)
+		return
+	}
+	if f.Parent.Find(f.Name) != f {
+		req.RespondError(srv.Enoent)
+		return
+	}
+	old := f.Name
+	if err := f.Rename(req.Tc.Name); err != nil {
+		req.RespondError(err)
+		return
+	}
+	names := s.names[f.Parent]
+	for i := range names {
+		if names[i] == old {
+			names[i] = f.Name
+		}
+	}
+	req.RespondRempty()
+}
+
+// chan9 and srv agree on 9P2000.L, and the namespace calls use it.
+func TestDotl(t *testing.T) {
+	s := newTestLSrv(t, "a", "hello", "d/", "", "d/b", "world", "d/c", "")
+	clnt := testConnectVersion(t, s.Fsrv, p.VERSIONL)
+	if !clnt.Dotl || !clnt.Dotu {
+		t.Fatalf("dotl %v dotu %v", clnt.Dotl, clnt.Dotu)
+	}
+	ns, err := NSFromClnt(clnt, nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+
+	file, err := ns.FOpen(ParseName("/d/b"), p.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := file.Read(buf)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Errorf("read /d/b: %q %v", buf[:n], err)
+	}
+	file.Close()
+
+	d, err := ns.FStat(ParseName("/a"))
+	if err != nil || d.Name != "a" || d.Length != 5 || d.Mode&p.DMDIR != 0 {
+		t.Errorf("stat /a: %v %v", d, err)
+	}
+	d, err = ns.FStat(ParseName("/d"))
+	if err != nil || d.Mode&p.DMDIR == 0 {
+		t.Errorf("stat /d: %v %v", d, err)
+	}
+
+	for dir, want := range map[string]string{"/": "a d", "/d": "b c"} {
+		file, err := ns.FOpen(ParseName(dir), p.OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs, err := file.Readdir(0)
+		file.Close()
+		var names []string
+		for _, d := range dirs {
+			names = append(names, d.Name)
+		}
+		if err != nil || strings.Join(names, " ") != want {
+			t.Errorf("readdir %s: %v %v", dir, names, err)
+		}
+	}
+}
+
+// A rename of a union renames its first member still there in its
+// own directory, and changes the Cname of the fid renamed only, not
+// that of the member.
+func TestDotlUnionRename(t *testing.T) {
+	s := newTestLSrv(t, "d/", "", "e/", "", "n/", "")
+	ns, err := NSFromClnt(testConnectVersion(t, s.Fsrv, p.VERSIONL), nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	if err := ns.Bind("/e", "/n", p.MREPL); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Bind("/d", "/n", p.MAFTER); err != nil {
+		t.Fatal(err)
+	}
+
+	fid, err := ns.FWalk(ParseName("/n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Clunk()
+	members := ns.Mnt.Union(fid.FileID)
+	s.Fsrv.Root.Find("e").Remove()
+	var d p.Dir
+	d.Null()
+	d.Name = "x"
+	if err := fid.Wstat(&d); err != nil {
+		t.Fatal(err)
+	}
+	if fid.basename() != "x" {
+		t.Errorf("Cname of the fid renamed: %v", fid.Cname)
+	}
+	for _, m := range members {
+		if m.basename() == "x" {
+			t.Errorf("Cname of the union member changed: %v", m.Cname)
+		}
+	}
+	if s.Fsrv.Root.Find("x") == nil || s.Fsrv.Root.Find("d") != nil {
+		t.Errorf("not /d renamed to /x")
+	}
+}
@@ -6,12 +6,15 @@ import (
 	"bufio"
 	"code.google.com/p/go9p/p"
 	"code.google.com/p/go9p/p/chan9"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var addr = flag.String("addr", "127.0.0.1:5640", "network address")
@@ -41,11 +44,13 @@ func init() {
 	cmds["mkdir"]   = &Cmd{cmdmkdir, "mkdir dir [...]\t«create dir on remote server»"}
 	cmds["get"]     = &Cmd{cmdget, "get file [local]\t«get file from remote server»"}
 	cmds["put"]     = &Cmd{cmdput, "put file [remote]\t«put file on the remote server as 'file'»"}
-	cmds["mount"]   = &Cmd{cmdmount, "mount [-bacCq] remote mountpoint\t«mount the remote server on mountpoint»"}
+	cmds["mount"]   = &Cmd{cmdmount, "mount [-bacCqsk] [-m msize] [-v version] [-u user] [-p subpath] [-t timeout] remote mountpoint [aname]\t«mount the remote server on mountpoint, over TLS with -s (-k: without checking its certificate)»"}
 	cmds["bind"]    = &Cmd{cmdbind, "bind [-bacq] target mountpoint\t«mount the target directory on mountpoint»"}
 	cmds["netstat"] = &Cmd{cmdnetstat, "netstat\t«list open connections and reference numbers»"}
 	cmds["lsmount"] = &Cmd{cmdlsmount, "lsmount mountpoint\t«list the mounts from/to mountpoint»"}
-	cmds["umount"]  = &Cmd{cmdumount, "umount remote mountpoint\t«remove the given mount»"}
+	cmds["umount"]  = &Cmd{cmdumount, "umount [remote] mountpoint | umount -s addr\t«remove the given mount, all mounts on mountpoint, or all mounts of the server»"}
+	cmds["ns"]      = &Cmd{cmdns, "ns\t«print the mount table as a namespace file»"}
+	cmds["newns"]   = &Cmd{cmdnewns, "newns file\t«apply the (local) namespace file, see namespace(6)»"}
 	cmds["pwd"]     = &Cmd{cmdpwd, "pwd\t«print working directory»"}
 	cmds["rm"]      = &Cmd{cmdrm, "rm file [...]\t«remove file from remote server»"}
 	cmds["help"]    = &Cmd{cmdhelp, "help [cmd]\t«print available commands or help on cmd»"}
@@ -142,6 +147,7 @@ func lsone(s chan9.Elemlist, long bool) {
 			return
 		}
 		defer file.Close()
+		file.Unique = true
 		for {
 			d, oserr := file.Readdir(0)
 			if oserr != nil {
@@ -352,40 +358,71 @@ func helpstring(cmd string) string {
 func cmdmount(s []string) {
 	repterr := true
 	var opts uint32
+	var dopts []chan9.Option
+	var conf *tls.Config
+
+	for len(s) > 0 && strings.HasPrefix(s[0], "-") {
+		flags := s[0][1:]
+		s = s[1:]
+		for _, f := range flags {
+			switch f {
+			case 'b':
+				opts = opts&^p.MORDER | p.MBEFORE
+			case 'a':
+				opts = opts&^p.MORDER | p.MAFTER
+			case 'c':
+				opts |= p.MCREATE
+			case 'C':
+				opts |= p.MCACHE
+			case 'q':
+				repterr = false
+			case 's', 'k':
+				if conf == nil {
+					conf = new(tls.Config)
+				}
+				if f == 'k' {
+					conf.InsecureSkipVerify = true
+				}
+			case 'm', 'v', 'u', 'p', 't':
+				if len(s) == 0 {
+					fmt.Fprintf(os.Stderr, "%s\n", helpstring("mount"))
+					return
+				}
+				opt, err := mountopt(f, s[0])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Bad -%c %s: %s\n", f, s[0], err)
+					return
+				}
+				dopts = append(dopts, opt)
+				s = s[1:]
+			default:
+				fmt.Fprintf(os.Stderr, "%s\n", helpstring("mount"))
+				return
+			}
+		}
+	}
+	if conf != nil {
+		dopts = append(dopts, chan9.WithTLS(conf))
+	}
 
 	l := len(s)
 	if l < 2 || l > 3 {
 		fmt.Fprintf(os.Stderr, "%s\n", helpstring("mount"))
 		return
 	}
-	
+	aname := ""
 	if l > 2 {
-		switch {
-		case strings.ContainsRune(s[0], 'b'):
-			opts = p.MBEFORE
-		case strings.ContainsRune(s[0], 'a'):
-			opts = p.MAFTER
-		}
-		if strings.ContainsRune(s[0], 'c') {
-			opts |= p.MCREATE
-		}
-		if strings.ContainsRune(s[0], 'C') {
-			opts |= p.MCACHE
-		}
-		if strings.ContainsRune(s[0], 'q') {
-			repterr = false
-		}
-	s = s[1:]
+		aname = s[2]
 	}
 
-	c, err := chan9.Dial(s[0])
+	c, err := chan9.DialOpts(s[0], dopts...)
 	if err != nil {
 		if repterr {
 			fmt.Fprintf(os.Stderr, "Error opening connection to %s: %s\n", s[0], err)
 		}
 		return
 	}
-	err = ns.Mount(c, nil, s[1], opts, "")
+	err = ns.Mount(c, nil, s[1], opts, aname)
 	if err != nil {
 		if repterr {
 			fmt.Fprintf(os.Stderr, "Error mounting connection to %s: %s\n", s[0], err)
@@ -395,6 +432,36 @@ func cmdmount(s []string) {
 	}
 }
 
+// Returns the dial option set by the mount flag f to val.
+func mountopt(f rune, val string) (chan9.Option, error) {
+	switch f {
+	case 'm':
+		msize, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		return chan9.WithMsize(uint32(msize)), nil
+	case 'v':
+		return chan9.WithVersion(val), nil
+	case 'u':
+		user := p.OsUsers.Uname2User(val)
+		if user == nil {
+			return nil, fmt.Errorf("unknown user")
+		}
+		return chan9.WithUser(user), nil
+	case 'p':
+		return chan9.WithSubpath(val), nil
+	case 't':
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, err
+		}
+		return chan9.WithTimeout(d), nil
+	}
+
+	return nil, fmt.Errorf("unknown option")
+}
+
 // Mount the given dir on mountpoint
 func cmdbind(s []string) {
 	repterr := true
@@ -464,20 +531,73 @@ func cmdlsmount(s []string) {
 	fmt.Fprintf(os.Stdout, "%s\n", str)
 }
 
-// Remove the given mount.
+// Remove the given mount, all mounts on the mountpoint, or all
+// mounts of a server.
 func cmdumount(s []string) {
-	if len(s) != 2 {
+	var err error
+
+	switch {
+	case len(s) == 1:
+		err = ns.Umount("", s[0])
+	case len(s) == 2 && s[0] == "-s":
+		err = ns.UmountServer(s[1])
+	case len(s) == 2:
+		err = ns.Umount(s[0], s[1])
+	default:
 		fmt.Fprintf(os.Stderr, "%s\n", helpstring("umount"))
 		return
 	}
-	err := ns.Umount(s[0], s[1])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 		return
 	}
 }
 
-func cmdpwd(s []string) { fmt.Fprintf(os.Stdout, "/"+strings.Join(ns.Cwd.Cname,"/")+"\n") }
+// Print the mount table as mount and bind commands.
+func cmdns(s []string) {
+	err := ns.WriteNS(os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	}
+}
+
+// Apply a local namespace file, with the environment for $variables.
+func cmdnewns(s []string) {
+	if len(s) != 1 {
+		fmt.Fprintf(os.Stderr, "%s\n", helpstring("newns"))
+		return
+	}
+	f, err := os.Open(s[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return
+	}
+	defer f.Close()
+
+	vars := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			vars[kv[:i]] = kv[i+1:]
+		}
+	}
+	if _, ok := vars["user"]; !ok {
+		vars["user"] = vars["USER"]
+	}
+
+	err = chan9.NewNS(ns, f, vars)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	}
+}
+
+func cmdpwd(s []string) {
+	dir, err := ns.Fd2Path(ns.Cwd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "%s\n", dir)
+}
 
 // Remove f from remote server
 func rmone(fname chan9.Elemlist) {
@@ -487,6 +607,7 @@ func rmone(fname chan9.Elemlist) {
 		return
 	}
 }
+
 // Remove one or more files from the server
 func cmdrm(s []string) {
 	for _, f := range s {
@@ -2,29 +2,33 @@ package main
 
 import (
 	"code.google.com/p/go9p/p"
-	"code.google.com/p/go9p/p/clnt"
+	"code.google.com/p/go9p/p/chan9"
 	"flag"
 	"log"
 	"os"
-	"strings"
 )
 
 var debuglevel = flag.Int("d", 0, "debuglevel")
-var addr = flag.String("addr", "127.0.0.1:5640", "network address")
+var addr = flag.String("addr", "tcp!127.0.0.1!5640", "network address")
 
 func main() {
-	var user p.User
 	var ba [][]byte
 	var nreqs int
-	var rchan chan *clnt.Req
-	var tag *clnt.Tag
-	var fid *clnt.Fid
-	var wnames []string
+	var rchan chan *chan9.Req
+	var tag *chan9.Tag
+	var fid, from *chan9.Fid
+	var ns *chan9.Namespace
+	var e chan9.Elemlist
+	var r *chan9.Req
 
 	flag.Parse()
-	user = p.OsUsers.Uid2User(os.Geteuid())
-	clnt.DefaultDebuglevel = *debuglevel
-	c, err := clnt.Mount("tcp", *addr, "", user)
+	chan9.DefaultDebuglevel = *debuglevel
+	c, err := chan9.Dial(*addr)
+	if err != nil {
+		goto error
+	}
+
+	ns, err = chan9.NSFromClnt(c, nil, p.MREPL, "")
 	if err != nil {
 		goto error
 	}
@@ -39,36 +43,40 @@ func main() {
 		ba[i] = make([]byte, 8192)
 	}
 
-	nreqs = 0
-	rchan = make(chan *clnt.Req)
-	tag = c.TagAlloc(rchan)
+	rchan = make(chan *chan9.Req)
+	tag = ns.TagAlloc(rchan)
 
-	// walk the file
-	wnames = strings.Split(flag.Arg(0), "/")
-	for wnames[0] == "" {
-		wnames = wnames[1:]
+	// walk the file, the walk may cross mount points
+	e = chan9.ParseName(flag.Arg(0))
+	from = ns.Root
+	if e.Ref == '.' {
+		from = ns.Cwd
+	}
+	err = tag.Walk(from, e.Elems)
+	if err != nil {
+		goto error
 	}
 
-	fid = c.FidAlloc()
-	for root := c.Root; len(wnames) > 0; root = fid {
-		n := len(wnames)
-		if n > 8 {
-			n = 8
-		}
-
-		err = tag.Walk(root, fid, wnames[0:n])
-		if err != nil {
-			goto error
-		}
-
-		nreqs++
-		wnames = wnames[n:]
+	r = <-rchan
+	fid, err = r.Fid(), r.Err
+	tag.ReqFree(r)
+	if err != nil {
+		goto error
 	}
+
+	// the reads need the iounit of the open fid
 	err = tag.Open(fid, p.OREAD)
 	if err != nil {
 		goto error
 	}
 
+	r = <-rchan
+	err = r.Err
+	tag.ReqFree(r)
+	if err != nil {
+		goto error
+	}
+
 	for i := 0; i < len(ba); i++ {
 		err = tag.Read(fid, uint64(i*8192), 8192)
 		if err != nil {
@@ -77,19 +85,29 @@ func main() {
 		nreqs++
 	}
 
-	err = tag.Clunk(fid)
-
 	// now start reading...
 	for nreqs > 0 {
 		r := <-rchan
 		if r.Tc.Type == p.Tread {
 			i := r.Tc.Offset / 8192
-			copy(ba[i], r.Rc.Data)
-			ba[i] = ba[i][0:r.Rc.Count]
+			if r.Err != nil {
+				ba[i] = ba[i][0:0]
+			} else {
+				copy(ba[i], r.Rc.Data)
+				ba[i] = ba[i][0:r.Rc.Count]
+			}
 		}
+		tag.ReqFree(r)
 		nreqs--
 	}
 
+	err = tag.Clunk(fid)
+	if err == nil {
+		r = <-rchan
+		tag.ReqFree(r)
+	}
+	ns.TagFree(tag)
+
 	for i := 0; i < len(ba); i++ {
 		os.Stdout.Write(ba[i])
 	}
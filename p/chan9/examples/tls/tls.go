@@ -3,54 +3,54 @@ package main
 
 import (
 	"code.google.com/p/go9p/p"
-	"code.google.com/p/go9p/p/clnt"
+	"code.google.com/p/go9p/p/chan9"
 	"crypto/rand"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
 var debuglevel = flag.Int("d", 0, "debuglevel")
 var addr = flag.String("addr", "127.0.0.1:5640", "network address")
+var timeout = flag.Duration("t", 10*time.Second, "connection timeout")
 
 func main() {
-	var user p.User
-	var file *clnt.File
+	var file *chan9.File
 
 	flag.Parse()
-	user = p.OsUsers.Uid2User(os.Geteuid())
-	clnt.DefaultDebuglevel = *debuglevel
+	chan9.DefaultDebuglevel = *debuglevel
 
-	c, oerr := tls.Dial("tcp", *addr, &tls.Config{
-		Rand: rand.Reader,
-		InsecureSkipVerify: true,
-	})
-	if oerr != nil {
-		log.Println("can't dial", oerr)
+	if flag.NArg() != 1 {
+		log.Println("invalid arguments")
 		return
 	}
 
-	clnt, err := clnt.MountConn(c, "", user)
+	c, err := chan9.DialOpts(*addr, chan9.WithTimeout(*timeout), chan9.WithTLS(&tls.Config{
+		Rand:               rand.Reader,
+		InsecureSkipVerify: true,
+	}))
 	if err != nil {
-		goto error
+		log.Println("can't dial", err)
+		return
 	}
 
-	if flag.NArg() != 1 {
-		log.Println("invalid arguments")
-		return
+	ns, err := chan9.NSFromClnt(c, nil, p.MREPL, "")
+	if err != nil {
+		goto error
 	}
 
-	file, oerr = clnt.FOpen(flag.Arg(0), p.OREAD)
-	if oerr != nil {
-		goto oerror
+	file, err = ns.FOpen(chan9.ParseName(flag.Arg(0)), p.OREAD)
+	if err != nil {
+		goto error
 	}
 
 	for {
-		d, oerr := file.Readdir(0)
-		if oerr != nil {
-			goto oerror
+		d, err := file.Readdir(0)
+		if err != nil {
+			goto error
 		}
 
 		if d == nil || len(d) == 0 {
@@ -63,12 +63,9 @@ func main() {
 	}
 
 	file.Close()
+	ns.Close()
 	return
 
 error:
 	log.Println(fmt.Sprintf("Error: %s", err))
-	return
-
-oerror:
-	log.Println("Error", oerr)
 }
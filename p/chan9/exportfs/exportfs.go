@@ -0,0 +1,354 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The exportfs package serves a chan9.Namespace to 9P clients, like
+// Plan 9's exportfs(4): the mounts, binds and unions put together in
+// the namespace are seen by the clients as a single file tree.
+//
+// Every fid of the clients maps to a fid of the namespace, and the
+// requests are forwarded on it. Walks go through Namespace.Walk, so
+// mount points and unions are crossed. Reading a union directory
+// returns the entries of all of its members, each name once, as
+// found by the walks. The requests are made
+// as the users the namespace was attached as, whatever the user
+// of the client. Tflush flushes the request sent upstream.
+//
+//	e := exportfs.New(ns)
+//	e.Dotu = true
+//	e.Start(e)
+//	e.StartNetListener("tcp", ":5640")
+package exportfs
+
+import (
+	"code.google.com/p/go9p/p"
+	"code.google.com/p/go9p/p/chan9"
+	"code.google.com/p/go9p/p/srv"
+	"context"
+	"sync"
+)
+
+type Exportfs struct {
+	srv.Srv
+	ns *chan9.Namespace
+
+	reqlock sync.Mutex
+	reqs    map[*srv.Req]context.CancelFunc // requests in progress
+}
+
+// The namespace fid of a client fid (srv.Fid.Aux).
+type Fid struct {
+	fid  *chan9.Fid
+	file *chan9.File // if an opened directory
+	dirs []*p.Dir    // entries read from file, not sent yet
+}
+
+// Returns a server for the namespace. It has to be started with
+// Start(e) (see srv.Srv).
+func New(ns *chan9.Namespace) *Exportfs {
+	e := new(Exportfs)
+	e.ns = ns
+	e.reqs = make(map[*srv.Req]context.CancelFunc)
+	e.Id = "exportfs"
+
+	return e
+}
+
+// Returns the context the request's operations on the namespace
+// are done with. It's canceled if the request is flushed.
+func (e *Exportfs) start(req *srv.Req) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.reqlock.Lock()
+	e.reqs[req] = cancel
+	e.reqlock.Unlock()
+
+	return ctx
+}
+
+func (e *Exportfs) done(req *srv.Req) {
+	e.reqlock.Lock()
+	cancel := e.reqs[req]
+	delete(e.reqs, req)
+	e.reqlock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Responds with err, unless the request was flushed.
+func (e *Exportfs) fail(req *srv.Req, ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		req.Flush()
+		return
+	}
+
+	req.RespondError(err)
+}
+
+func (e *Exportfs) Flush(req *srv.Req) {
+	e.reqlock.Lock()
+	cancel := e.reqs[req]
+	e.reqlock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (e *Exportfs) FidDestroy(sfid *srv.Fid) {
+	if fid, ok := sfid.Aux.(*Fid); ok {
+		fid.clunk()
+		sfid.Aux = nil
+	}
+}
+
+func (fid *Fid) clunk() error {
+	if fid.file != nil {
+		return fid.file.Close()
+	}
+
+	return fid.fid.Clunk()
+}
+
+func (e *Exportfs) Attach(req *srv.Req) {
+	var fid *chan9.Fid
+	var err error
+
+	if req.Afid != nil {
+		req.RespondError(srv.Enoauth)
+		return
+	}
+
+	aname := req.Tc.Aname
+	if aname == "" {
+		aname = "/"
+	}
+	fid, err = e.ns.FWalk(chan9.ParseName(aname))
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.Fid.Aux = &Fid{fid: fid}
+	req.RespondRattach(&fid.Qid)
+}
+
+// Walks one name at a time, so the Qids returned are those of the
+// files reached, after crossing the mount points.
+func (e *Exportfs) Walk(req *srv.Req) {
+	ctx := e.start(req)
+	defer e.done(req)
+
+	fid := req.Fid.Aux.(*Fid)
+	wnames := req.Tc.Wname
+	nfid, err := e.ns.WalkContext(ctx, fid.fid, nil)
+	if err != nil {
+		e.fail(req, ctx, err)
+		return
+	}
+
+	wqids := make([]p.Qid, 0, len(wnames))
+	for _, name := range wnames {
+		f, err := e.ns.WalkContext(ctx, nfid, []string{name})
+		if err != nil {
+			if len(wqids) == 0 {
+				nfid.Clunk()
+				e.fail(req, ctx, err)
+				return
+			}
+			break
+		}
+
+		nfid.Clunk()
+		nfid = f
+		wqids = append(wqids, f.Qid)
+	}
+	if len(wqids) < len(wnames) {
+		nfid.Clunk()
+		req.RespondRwalk(wqids)
+		return
+	}
+
+	if req.Newfid == req.Fid {
+		fid.clunk()
+	}
+	req.Newfid.Aux = &Fid{fid: nfid}
+	req.RespondRwalk(wqids)
+}
+
+func (e *Exportfs) Open(req *srv.Req) {
+	ctx := e.start(req)
+	defer e.done(req)
+
+	fid := req.Fid.Aux.(*Fid)
+	err := fid.fid.OpenContext(ctx, req.Tc.Mode)
+	if err != nil {
+		e.fail(req, ctx, err)
+		return
+	}
+
+	if fid.fid.Qid.Type&p.QTDIR != 0 {
+		fid.file = &chan9.File{Fid: fid.fid, Unique: true}
+	}
+	req.RespondRopen(&fid.fid.Qid, e.iounit(req, fid))
+}
+
+// The iounit of the fid, if it fits in the messages of the client.
+func (e *Exportfs) iounit(req *srv.Req, fid *Fid) uint32 {
+	if fid.fid.Iounit > req.Conn.Msize-p.IOHDRSZ {
+		return 0
+	}
+
+	return fid.fid.Iounit
+}
+
+func (e *Exportfs) Create(req *srv.Req) {
+	tc := req.Tc
+	fid := req.Fid.Aux.(*Fid)
+	err := fid.fid.Create(tc.Name, tc.Perm, tc.Mode, tc.Ext)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if fid.fid.Qid.Type&p.QTDIR != 0 {
+		fid.file = &chan9.File{Fid: fid.fid, Unique: true}
+	}
+	req.RespondRcreate(&fid.fid.Qid, e.iounit(req, fid))
+}
+
+func (e *Exportfs) Read(req *srv.Req) {
+	ctx := e.start(req)
+	defer e.done(req)
+
+	tc := req.Tc
+	fid := req.Fid.Aux.(*Fid)
+	if fid.file != nil {
+		e.readdir(req, fid)
+		return
+	}
+
+	count := tc.Count
+	if count > fid.fid.Iounit {
+		count = fid.fid.Iounit
+	}
+	buf, err := fid.fid.ReadContext(ctx, tc.Offset, count)
+	if err != nil {
+		e.fail(req, ctx, err)
+		return
+	}
+
+	req.RespondRread(buf)
+}
+
+// Reads a directory through a chan9.File, which goes through all
+// the members of a union (listing each name once), and packs as
+// many entries as fit.
+func (e *Exportfs) readdir(req *srv.Req, fid *Fid) {
+	tc := req.Tc
+	if tc.Offset == 0 && (fid.file.Offset != 0 || fid.dirs != nil) {
+		_, err := fid.file.Seek(0, 0)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+		fid.fid = fid.file.Fid
+		fid.dirs = nil
+	}
+
+	buf := make([]byte, tc.Count)
+	n := 0
+	for {
+		if len(fid.dirs) == 0 {
+			dirs, err := fid.file.Readdir(16)
+			fid.fid = fid.file.Fid
+			if err != nil {
+				req.RespondError(err)
+				return
+			}
+			if len(dirs) == 0 {
+				break
+			}
+			fid.dirs = dirs
+		}
+
+		sz := p.PackDir(fid.dirs[0], buf[n:], req.Conn.Dotu)
+		if sz == 0 {
+			if n == 0 {
+				req.RespondError(srv.Etoolarge)
+				return
+			}
+			break
+		}
+		n += sz
+		fid.dirs = fid.dirs[1:]
+	}
+
+	req.RespondRread(buf[0:n])
+}
+
+func (e *Exportfs) Write(req *srv.Req) {
+	ctx := e.start(req)
+	defer e.done(req)
+
+	tc := req.Tc
+	fid := req.Fid.Aux.(*Fid)
+	n, err := fid.fid.WriteContext(ctx, tc.Data, tc.Offset)
+	if err != nil {
+		e.fail(req, ctx, err)
+		return
+	}
+
+	req.RespondRwrite(uint32(n))
+}
+
+func (e *Exportfs) Clunk(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	req.Fid.Aux = nil
+	err := fid.clunk()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRclunk()
+}
+
+func (e *Exportfs) Remove(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	req.Fid.Aux = nil
+	if fid.file != nil {
+		fid.fid = fid.file.Fid
+	}
+	err := fid.fid.Remove()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRremove()
+}
+
+func (e *Exportfs) Stat(req *srv.Req) {
+	ctx := e.start(req)
+	defer e.done(req)
+
+	fid := req.Fid.Aux.(*Fid)
+	d, err := fid.fid.StatContext(ctx)
+	if err != nil {
+		e.fail(req, ctx, err)
+		return
+	}
+
+	req.RespondRstat(d)
+}
+
+func (e *Exportfs) Wstat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	err := fid.fid.Wstat(&req.Tc.Dir)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRwstat()
+}
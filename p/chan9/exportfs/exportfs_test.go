@@ -0,0 +1,134 @@
+package exportfs
+
+import (
+	"code.google.com/p/go9p/p"
+	"code.google.com/p/go9p/p/chan9"
+	"code.google.com/p/go9p/p/srv"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type testFile struct {
+	srv.File
+	data []byte
+}
+
+func (f *testFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	if offset > uint64(len(f.data)) {
+		return 0, nil
+	}
+	return copy(buf, f.data[offset:]), nil
+}
+
+func (f *testFile) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	f.data = append(f.data[:offset], data...)
+	f.Length = uint64(len(f.data))
+	return len(data), nil
+}
+
+// Returns a client of a server for a tree of testFiles, given by
+// their paths and contents (a trailing / makes a directory).
+func testClnt(t *testing.T, files ...string) *chan9.Clnt {
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	root := new(srv.File)
+	if err := root.Add(nil, "/", user, nil, p.DMDIR|0777, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(files); i += 2 {
+		elems := strings.Split(strings.TrimSuffix(files[i], "/"), "/")
+		dir := root
+		for _, elem := range elems[:len(elems)-1] {
+			dir = dir.Find(elem)
+		}
+		name := elems[len(elems)-1]
+		if strings.HasSuffix(files[i], "/") {
+			if err := new(srv.File).Add(dir, name, user, nil, p.DMDIR|0777, nil); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		f := &testFile{data: []byte(files[i+1])}
+		if err := f.Add(dir, name, user, nil, 0666, f); err != nil {
+			t.Fatal(err)
+		}
+		f.Length = uint64(len(f.data))
+	}
+
+	s := srv.NewFileSrv(root)
+	s.Dotu = true
+	s.Start(s)
+	return testConnect(t, &s.Srv)
+}
+
+func testConnect(t *testing.T, s *srv.Srv) *chan9.Clnt {
+	cc, sc := net.Pipe()
+	go s.NewConn(sc)
+	clnt, err := chan9.Connect(cc, 8192+p.IOHDRSZ, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clnt
+}
+
+func TestExportfs(t *testing.T) {
+	ns, err := chan9.NSFromClnt(testClnt(t, "a", "1", "u/", "", "u/b", "2"), nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.Mount(testClnt(t, "c", "3", "d/", ""), nil, "/u", p.MAFTER, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	e := New(ns)
+	e.Dotu = true
+	e.Start(e)
+	rns, err := chan9.NSFromClnt(testConnect(t, &e.Srv), nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := rns.FOpen(chan9.ParseName("/u"), p.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := dir.Readdir(0)
+	dir.Close()
+	var names []string
+	for _, d := range dirs {
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	if err != nil || strings.Join(names, " ") != "b c d" {
+		t.Errorf("union read: %v %v", names, err)
+	}
+
+	file, err := rns.FOpen(chan9.ParseName("/u/c"), p.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.WriteAt([]byte("three"), 0); err != nil {
+		t.Error(err)
+	}
+	file.Close()
+	file, err = ns.FOpen(chan9.ParseName("/u/c"), p.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(file)
+	file.Close()
+	if string(buf) != "three" {
+		t.Errorf("read after write: %q %v", buf, err)
+	}
+
+	d, err := rns.FStat(chan9.ParseName("/u/d"))
+	if err != nil || d.Mode&p.DMDIR == 0 {
+		t.Errorf("stat of a dir in the mount: %v %v", d, err)
+	}
+	if _, err = rns.FWalk(chan9.ParseName("/u/d/nothing")); err == nil {
+		t.Error("walk to a missing file succeeded")
+	}
+}
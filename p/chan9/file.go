@@ -0,0 +1,82 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"io"
+	"io/fs"
+)
+
+// Returns the name the File was opened (or created) by.
+func (file *File) Name() string {
+	return file.name
+}
+
+// Returns the metadata for the File, or an Error.
+func (file *File) Stat() (fs.FileInfo, error) {
+	d, err := file.Fid.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &dirInfo{d}, nil
+}
+
+// Reads the content of the directory associated with the File, like
+// os.File.ReadDir. If n > 0, returns at most n entries, and io.EOF
+// when there are none left. If n <= 0, returns all remaining entries.
+func (file *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n < 0 {
+		n = 0
+	}
+
+	dirs, err := file.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 && len(dirs) == 0 {
+		return nil, io.EOF
+	}
+
+	return dirEntries(dirs), nil
+}
+
+// Changes the size of the file. Returns nil if successful.
+func (file *File) Truncate(size int64) error {
+	if size < 0 {
+		return &p.Error{"invalid size", p.EINVAL}
+	}
+
+	var d p.Dir
+	d.Null()
+	d.Length = uint64(size)
+	return file.Fid.Wstat(&d)
+}
+
+// Changes the permissions (and the append, exclusive, temporary,
+// setuid and setgid bits) of the file. Returns nil if successful.
+func (file *File) Chmod(mode fs.FileMode) error {
+	var d p.Dir
+	d.Null()
+	d.Mode = Mode2Dir(mode)
+	if file.Fid.Qid.Type&p.QTDIR != 0 {
+		d.Mode |= p.DMDIR
+	}
+
+	return file.Fid.Wstat(&d)
+}
+
+// Asks the server to commit the file to stable storage, with a
+// Twstat that changes nothing (or Tfsync in 9P2000.L).
+func (file *File) Sync() error {
+	if file.Fid.Clnt.Dotl {
+		return file.Fid.Fsync(false)
+	}
+
+	var d p.Dir
+	d.Null()
+	return file.Fid.Wstat(&d)
+}
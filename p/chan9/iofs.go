@@ -0,0 +1,335 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chan9
+
+/*  io/fs adapter.
+    A *Namespace is an fs.FS (and ReadDirFS, StatFS, ReadFileFS,
+    SubFS), with names resolved from the namespace Root. Directories
+    read through it include the entries of every member of a union,
+    each name once, like File.Readdir with Unique set.
+*/
+
+import (
+	"code.google.com/p/go9p/p"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	_ fs.FS         = (*Namespace)(nil)
+	_ fs.ReadDirFS  = (*Namespace)(nil)
+	_ fs.StatFS     = (*Namespace)(nil)
+	_ fs.ReadFileFS = (*Namespace)(nil)
+	_ fs.SubFS      = (*Namespace)(nil)
+)
+
+// Translates an io/fs name into an Elemlist rooted at ns.Root.
+func fsElems(op, name string) (Elemlist, error) {
+	if !fs.ValidPath(name) {
+		return Elemlist{}, &fs.PathError{op, name, fs.ErrInvalid}
+	}
+
+	e := Elemlist{Elems: make([]string, 0), Ref: '/'}
+	if name != "." {
+		e.Elems = strings.Split(name, "/")
+	}
+
+	return e, nil
+}
+
+// Opens the named file for reading, as fs.FS.
+func (ns *Namespace) Open(name string) (fs.File, error) {
+	e, err := fsElems("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ns.FOpen(e, p.OREAD)
+	if err != nil {
+		return nil, &fs.PathError{"open", name, err}
+	}
+	file.Unique = true
+
+	return &fsFile{file: file, name: name}, nil
+}
+
+// Returns the metadata for the named file, as fs.StatFS.
+func (ns *Namespace) Stat(name string) (fs.FileInfo, error) {
+	e, err := fsElems("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := ns.FStat(e)
+	if err != nil {
+		return nil, &fs.PathError{"stat", name, err}
+	}
+
+	return fileInfo(d, name), nil
+}
+
+// Returns the entries of the named directory, sorted by name,
+// as fs.ReadDirFS.
+func (ns *Namespace) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := fsElems("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ns.FOpen(e, p.OREAD)
+	if err != nil {
+		return nil, &fs.PathError{"readdir", name, err}
+	}
+	defer file.Fid.Clunk()
+
+	file.Unique = true
+	dirs, err := file.Readdir(0)
+	if err != nil {
+		return nil, &fs.PathError{"readdir", name, err}
+	}
+
+	ents := dirEntries(dirs)
+	sort.Slice(ents, func(i, j int) bool {
+		return ents[i].Name() < ents[j].Name()
+	})
+
+	return ents, nil
+}
+
+// Returns the contents of the named file, as fs.ReadFileFS.
+func (ns *Namespace) ReadFile(name string) ([]byte, error) {
+	e, err := fsElems("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ns.FOpen(e, p.OREAD)
+	if err != nil {
+		return nil, &fs.PathError{"readfile", name, err}
+	}
+	defer file.Fid.Clunk()
+
+	buf, err := io.ReadAll(file)
+	if err != nil {
+		return nil, &fs.PathError{"readfile", name, err}
+	}
+
+	return buf, nil
+}
+
+// Returns the fs.FS rooted at the named directory, as fs.SubFS.
+// Names are resolved anew on every call, so mounts done later
+// show up in it.
+func (ns *Namespace) Sub(dir string) (fs.FS, error) {
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{"sub", dir, fs.ErrInvalid}
+	}
+	if dir == "." {
+		return ns, nil
+	}
+
+	return &subFS{ns, dir}, nil
+}
+
+// A file opened through the fs.FS interface.
+type fsFile struct {
+	file *File
+	name string
+}
+
+func (f *fsFile) Read(buf []byte) (int, error) {
+	return f.file.Read(buf)
+}
+
+func (f *fsFile) Close() error {
+	if f.file == nil {
+		return &fs.PathError{"close", f.name, fs.ErrClosed}
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	d, err := f.file.Fid.Stat()
+	if err != nil {
+		return nil, &fs.PathError{"stat", f.name, err}
+	}
+
+	return fileInfo(d, f.name), nil
+}
+
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	ents, err := f.file.ReadDir(n)
+	if err != nil && err != io.EOF {
+		err = &fs.PathError{"readdir", f.name, err}
+	}
+
+	return ents, err
+}
+
+func dirEntries(dirs []*p.Dir) []fs.DirEntry {
+	ents := make([]fs.DirEntry, len(dirs))
+	for i, d := range dirs {
+		ents[i] = &dirInfo{d}
+	}
+
+	return ents
+}
+
+// Describes a file by its p.Dir. It is both an fs.FileInfo
+// and an fs.DirEntry.
+type dirInfo struct {
+	d *p.Dir
+}
+
+// Returns the FileInfo for a file stat-ed by its io/fs name.
+// The server's name for the root of a tree is replaced by
+// the last element of the name.
+func fileInfo(d *p.Dir, name string) *dirInfo {
+	nd := *d
+	nd.Name = path.Base(name)
+	return &dirInfo{&nd}
+}
+
+func (di *dirInfo) Name() string       { return di.d.Name }
+func (di *dirInfo) Size() int64        { return int64(di.d.Length) }
+func (di *dirInfo) Mode() fs.FileMode  { return Dir2Mode(di.d) }
+func (di *dirInfo) ModTime() time.Time { return time.Unix(int64(di.d.Mtime), 0) }
+func (di *dirInfo) IsDir() bool        { return di.d.Mode&p.DMDIR != 0 }
+func (di *dirInfo) Sys() interface{}   { return di.d }
+
+func (di *dirInfo) Type() fs.FileMode          { return di.Mode().Type() }
+func (di *dirInfo) Info() (fs.FileInfo, error) { return di, nil }
+
+func (di *dirInfo) String() string { return fs.FormatFileInfo(di) }
+
+var dmodes = []struct {
+	dm uint32
+	fm fs.FileMode
+}{
+	{p.DMDIR, fs.ModeDir},
+	{p.DMAPPEND, fs.ModeAppend},
+	{p.DMEXCL, fs.ModeExclusive},
+	{p.DMTMP, fs.ModeTemporary},
+	{p.DMSYMLINK, fs.ModeSymlink},
+	{p.DMDEVICE, fs.ModeDevice},
+	{p.DMNAMEDPIPE, fs.ModeNamedPipe},
+	{p.DMSOCKET, fs.ModeSocket},
+	{p.DMSETUID, fs.ModeSetuid},
+	{p.DMSETGID, fs.ModeSetgid},
+}
+
+// Converts the mode of a p.Dir to an fs.FileMode.
+func Dir2Mode(d *p.Dir) fs.FileMode {
+	m := fs.FileMode(d.Mode & 0777)
+	for _, x := range dmodes {
+		if d.Mode&x.dm != 0 {
+			m |= x.fm
+		}
+	}
+
+	return m
+}
+
+// Converts an fs.FileMode to the mode of a p.Dir. The type bits
+// other than the ones kept by Dir2Mode are dropped.
+func Mode2Dir(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	for _, x := range dmodes {
+		if m&x.fm != 0 {
+			mode |= x.dm
+		}
+	}
+
+	return mode
+}
+
+// The fs.FS of a directory in a namespace, see Namespace.Sub.
+type subFS struct {
+	ns  *Namespace
+	dir string
+}
+
+// Returns the name in the namespace of a name in the sub-tree.
+func (s *subFS) full(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{op, name, fs.ErrInvalid}
+	}
+
+	return path.Join(s.dir, name), nil
+}
+
+// Strips the directory from the name in a PathError.
+func (s *subFS) fixErr(err error) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		if name, ok := strings.CutPrefix(pe.Path, s.dir+"/"); ok {
+			pe.Path = name
+		} else if pe.Path == s.dir {
+			pe.Path = "."
+		}
+	}
+
+	return err
+}
+
+func (s *subFS) Open(name string) (fs.File, error) {
+	full, err := s.full("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := s.ns.Open(full)
+	if err != nil {
+		return nil, s.fixErr(err)
+	}
+	f.(*fsFile).name = name
+
+	return f, nil
+}
+
+func (s *subFS) Stat(name string) (fs.FileInfo, error) {
+	full, err := s.full("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := s.ns.Stat(full)
+	return fi, s.fixErr(err)
+}
+
+func (s *subFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := s.full("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	ents, err := s.ns.ReadDir(full)
+	return ents, s.fixErr(err)
+}
+
+func (s *subFS) ReadFile(name string) ([]byte, error) {
+	full, err := s.full("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := s.ns.ReadFile(full)
+	return buf, s.fixErr(err)
+}
+
+func (s *subFS) Sub(dir string) (fs.FS, error) {
+	full, err := s.full("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ns.Sub(full)
+}
@@ -0,0 +1,32 @@
+package chan9
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	ns := testNS(t, "a", "hello", "d/", "", "d/b", "world", "d/e/", "")
+	if err := fstest.TestFS(ns, "a", "d/b", "d/e"); err != nil {
+		t.Error(err)
+	}
+
+	sub, err := fs.Sub(ns, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := fs.ReadFile(sub, "b")
+	if err != nil || string(buf) != "world" {
+		t.Errorf("read d/b: %q %v", buf, err)
+	}
+
+	_, err = fs.Stat(sub, "x")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist, got %v", err)
+	}
+	if pe, ok := err.(*fs.PathError); !ok || pe.Path != "x" {
+		t.Errorf("bad error path in %v", err)
+	}
+}
@@ -29,7 +29,6 @@ type mntstack struct {
  */
 
 /* TODO: implement mutable mounts and intermediate folding
-   TODO: fix Umount in mount.go to allow 'all parent' unmounting
  */
  
 type Mnttab struct {
@@ -39,6 +38,17 @@ type Mnttab struct {
 	FromDev  map[uint32]*mntstack
 	ToDev    map[uint32]*mntstack
 	Root     uint32
+	share    *mntshare // the tables above may be shared with forks
+	clunks   []*Fid    // dropped by the tables, clunked by unlock
+}
+
+/* Counts the Mnttabs sharing the same tables after a fork.
+ * The first one to change them gets copies of its own (with
+ * new fids), see own().
+ */
+type mntshare struct {
+	sync.Mutex
+	n int
 }
 
 func (f FileID) String() string {
@@ -108,14 +118,238 @@ func NewMnttab(dev uint32) (*Mnttab) {
 	m.Parents  = make(map[FileID][]*Fid) // all mounts are union mounts.
 	m.FromDev  = make(map[uint32]*mntstack)
 	m.ToDev  = make(map[uint32]*mntstack)
+	m.share = &mntshare{n: 1}
 	return m
 }
 
+/* Returns a Mnttab sharing the mounts of m until either one
+ * is changed.
+ */
+func (m *Mnttab) fork() *Mnttab {
+	m.Lock()
+	defer m.Unlock()
+	m.share.Lock()
+	defer m.share.Unlock()
+
+	n := new(Mnttab)
+	n.Root = m.Root
+	n.Children = m.Children
+	n.Parents = m.Parents
+	n.FromDev = m.FromDev
+	n.ToDev = m.ToDev
+	n.share = m.share
+	m.share.n++
+	return n
+}
+
+/* Called with Mnttab's lock held, before changing the tables.
+ * If they are shared, replaces them with copies holding fids
+ * cloned from the shared ones. The lock is dropped while the fids
+ * are cloned, and the tables may have changed by the time own
+ * returns: the caller must look at them after own.
+ */
+func (m *Mnttab) own() error {
+	for {
+		sh := m.share
+		sh.Lock()
+		shared := sh.n > 1
+		sh.Unlock()
+		if !shared {
+			return nil
+		}
+
+		fids := m.tablefids()
+		m.Unlock()
+		clones := make(map[*Fid]*Fid) // shared -> cloned
+		var err error
+		for _, fid := range fids {
+			var nfid *Fid
+			if nfid, err = fid.Clone(false); err != nil {
+				break
+			}
+			nfid.Type = fid.Type
+			nfid.Cname = append([]string(nil), fid.Cname...)
+			nfid.Path = append([]FileID(nil), fid.Path...)
+			nfid.MayCreate = fid.MayCreate
+			nfid.MayCache = fid.MayCache
+			nfid.mounted = fid.mounted
+			nfid.ref = 1
+			clones[fid] = nfid
+		}
+		m.Lock()
+
+		copied := err == nil && m.copy_tables(sh, clones)
+		for _, nfid := range clones { // not in the tables
+			m.clunks = append(m.clunks, nfid)
+		}
+		if err != nil {
+			return &p.Error{"cannot copy mount table", p.EIO}
+		}
+		if copied {
+			return nil
+		}
+		// unshared or changed while cloning, start over
+	}
+}
+
+/* Called with Mnttab's lock held, by own. Replaces the tables by
+ * copies holding the fids cloned from theirs, unless they are no
+ * longer shared or changed while the fids were cloned. The clones
+ * put in the copies are taken out of clones.
+ */
+func (m *Mnttab) copy_tables(sh *mntshare, clones map[*Fid]*Fid) bool {
+	if m.share != sh {
+		return false
+	}
+	sh.Lock()
+	defer sh.Unlock()
+	if sh.n == 1 {
+		return false
+	}
+	for _, fid := range m.tablefids() {
+		if clones[fid] == nil {
+			return false
+		}
+	}
+
+	children := make(map[FileID]*Fid)
+	parents := make(map[FileID][]*Fid)
+	for id, c := range m.Children {
+		var last *Fid
+		for ; c != nil; c = c.next {
+			nfid := clones[c]
+			if last == nil {
+				children[id] = nfid
+			} else {
+				last.next = nfid
+				nfid.prev = last
+				nfid.ref++
+			}
+			last = nfid
+		}
+	}
+	for id, pl := range m.Parents {
+		npl := make([]*Fid, len(pl))
+		for i, pfid := range pl {
+			npl[i] = clones[pfid]
+		}
+		parents[id] = npl
+	}
+	for _, fid := range m.tablefids() {
+		delete(clones, fid)
+	}
+
+	m.Children = children
+	m.Parents = parents
+	m.FromDev = copy_devs(m.FromDev)
+	m.ToDev = copy_devs(m.ToDev)
+	sh.n--
+	m.share = &mntshare{n: 1}
+	return true
+}
+
+// Returns the fids held by the mount table.
+func (m *Mnttab) fids() []*Fid {
+	m.Lock()
+	defer m.Unlock()
+	return m.tablefids()
+}
+
+// Called with Mnttab's lock held.
+func (m *Mnttab) tablefids() []*Fid {
+	seen := make(map[*Fid]bool)
+	var fids []*Fid
+	add := func(fid *Fid) {
+		if !seen[fid] {
+			seen[fid] = true
+			fids = append(fids, fid)
+		}
+	}
+	for _, c := range m.Children {
+		for ; c != nil; c = c.next {
+			add(c)
+		}
+	}
+	for _, pl := range m.Parents {
+		for _, pfid := range pl {
+			add(pfid)
+		}
+	}
+
+	return fids
+}
+
+/* Called with Mnttab's lock held. Drops a reference of the tables
+ * to fid; if it was the last one, the fid is clunked by unlock.
+ */
+func (m *Mnttab) decref(fid *Fid) {
+	unionlk.Lock()
+	fid.ref--
+	last := fid.ref <= 0
+	unionlk.Unlock()
+	if last {
+		m.clunks = append(m.clunks, fid)
+	}
+}
+
+/* Unlocks the tables, then clunks the fids they dropped: a clunk
+ * waits for the server, and the walks must not wait for it too.
+ */
+func (m *Mnttab) unlock() {
+	clunks := m.clunks
+	m.clunks = nil
+	m.Unlock()
+	for _, fid := range clunks {
+		fid.Clunk()
+	}
+}
+
+/* Empties the mount table, dropping its references to its fids
+ * unless the tables are still shared with a fork.
+ */
+func (m *Mnttab) release() {
+	m.Lock()
+	defer m.unlock()
+	m.share.Lock()
+	m.share.n--
+	shared := m.share.n > 0
+	m.share.Unlock()
+	if !shared {
+		for _, fid := range m.tablefids() {
+			m.decref(fid)
+		}
+	}
+
+	m.Children = make(map[FileID]*Fid)
+	m.Parents = make(map[FileID][]*Fid)
+	m.FromDev = make(map[uint32]*mntstack)
+	m.ToDev = make(map[uint32]*mntstack)
+	m.share = &mntshare{n: 1}
+}
+
+func copy_devs(devs map[uint32]*mntstack) map[uint32]*mntstack {
+	ndevs := make(map[uint32]*mntstack)
+	for dev, s := range devs {
+		var head, last *mntstack
+		for ; s != nil; s = s.next {
+			sp := &mntstack{parent: s.parent, child: s.child, prev: last}
+			if last == nil {
+				head = sp
+			} else {
+				last.next = sp
+			}
+			last = sp
+		}
+		ndevs[dev] = head
+	}
+	return ndevs
+}
+
 func (m *Mnttab) Umount(child, parent *Fid) error {
 	var s *mntstack
 
 	m.Lock()
-	defer m.Unlock()
+	defer m.unlock()
 	if parent == nil {
 		parent = child
 		child = nil
@@ -124,24 +358,69 @@ func (m *Mnttab) Umount(child, parent *Fid) error {
 		return Ebaduse
 	}
 
+	// Only the ids are needed: the fids are clunked by unlock.
 	pid := parent.FileID
-	parent.Clunk()
+	m.clunks = append(m.clunks, parent)
+	var cid FileID
+	if child != nil {
+		cid = child.FileID
+		m.clunks = append(m.clunks, child)
+	}
+	if err := m.own(); err != nil {
+		return err
+	}
 
 	c, ok := m.Children[pid]
 	if ! ok {
 		return &p.Error{"mount not found", p.ENOENT}
 	}
+	self := FileID{pid.Type | NOREMAP, pid.Dev, pid.Qid} // parent in its union
 	if child == nil { // remove all mounts from parent, useful for remote fs
-		for s = s.push(pid, c.FileID); c.next != nil; c = c.next {
+		for ; c != nil; c = c.next {
+			if c.FileID != self {
+				s = s.push(pid, c.FileID)
+			}
 		}
 	} else {
 		s = new(mntstack)
 		s.parent = pid
-		s.child = child.FileID
-		child.Clunk()
+		s.child = cid
 	}
 	m.rm_mnt(s)
+	m.gc()
+
+	return nil
+}
+
+/* Removes every mount and bind of the files of device dev, and
+ * what was mounted on them.
+ */
+func (m *Mnttab) UmountDev(dev uint32) error {
+	var s *mntstack
+
+	m.Lock()
+	defer m.unlock()
+	if err := m.own(); err != nil {
+		return err
+	}
+	if dev == m.Root {
+		return &p.Error{"cannot unmount the root device", p.EBUSY}
+	}
+
+	for pid, c := range m.Children {
+		self := FileID{pid.Type | NOREMAP, pid.Dev, pid.Qid}
+		for ; c != nil; c = c.next {
+			if c.Dev == dev && c.FileID != self {
+				s = s.push(pid, c.FileID)
+			}
+		}
+	}
+	if s == nil {
+		return &p.Error{"device not mounted", p.ENOENT}
+	}
 
+	m.rm_mnt(s)
+	m.gc()
 	return nil
 }
 
@@ -159,6 +438,7 @@ func (s *mntstack) push(parent, child FileID) *mntstack {
 	}
 	return sp
 }
+
 // Traverse s to tack on sp.
 func (s *mntstack) app(sp *mntstack) *mntstack {
 	if s == nil {
@@ -175,6 +455,7 @@ func (s *mntstack) app(sp *mntstack) *mntstack {
 	end.next = sp
 	return s
 }
+
 /*
 func (s *mntstack) pop() (FileID, *Fid, *mntstack) {
 	if s == nil {
@@ -205,13 +486,13 @@ func (m *Mnttab) rm_mnt(s *mntstack) {
 			s = s.app(m.FromDev[dev])
 		}
 		//}
-		
-		m.Parents[s.child] = remove_from_sl(m.Parents[s.child], s.parent)
+
+		m.Parents[s.child] = m.remove_from_sl(m.Parents[s.child], s.parent)
 		clist := m.Children[s.parent]
 		if is_noremap { // silently discard remapped parent, but don't Clunk.
-			clist = remove_from_union(clist, s.parent, false)
+			clist = m.remove_from_union(clist, s.parent, false)
 		}
-		m.Children[s.parent] = remove_from_union(clist, s.child, true)
+		m.Children[s.parent] = m.remove_from_union(clist, s.child, true)
 	}
 }
 
@@ -252,12 +533,15 @@ func (m *Mnttab) Mount(child, parent *Fid, flags uint32) error {
 	}
 
 	m.Lock()
-	defer m.Unlock()
+	defer m.unlock()
 
 	// Require some ref. of parent's dev.
-	if parent.Dev != m.Root && m.ToDev[parent.Dev] == nil  {
+	if err = m.own(); err == nil && parent.Dev != m.Root && m.ToDev[parent.Dev] == nil {
 		err = &p.Error{"Cannot mount from a nonexistent device", p.ENOSYS}
-		goto error
+	}
+	if err != nil {
+		m.clunks = append(m.clunks, child, parent)
+		return err
 	}
 	goto fine
 error:
@@ -265,6 +549,8 @@ error:
 	parent.Clunk()
 	return err
 fine:
+	child.ref = 1 // held by the table
+	parent.ref = 1
 
 	pid := parent.FileID
 	cid := child.FileID
@@ -293,10 +579,28 @@ fine:
 	// Update child table
 	if flags&p.MORDER == p.MREPL {
 		var s *mntstack // unlink old.
+		self := FileID{pid.Type | NOREMAP, pid.Dev, pid.Qid}
 		for ; ch != nil; ch=ch.next {
-			s = s.push(pid, ch.FileID)
+			if ch.FileID != self { // not mounted, see below
+				s = s.push(pid, ch.FileID)
+			}
 		}
 		m.rm_mnt(s)
+		if ch = m.Children[pid]; ch != nil { // the parent, left alone
+			s = nil
+			for _, pfid := range m.Parents[pid] {
+				if pfid != parent && pfid.FileID == pid { // bound on itself
+					s = s.push(pid, pid)
+					break
+				}
+			}
+			if s != nil {
+				ch.Type &^= NOREMAP // for rm_mnt to find it
+				m.rm_mnt(s)
+			} else {
+				m.decref(ch)
+			}
+		}
 
 		if pid == cid { // self-replace.
 			child.Type |= NOREMAP
@@ -305,6 +609,15 @@ fine:
 	} else {
 		var lst *Fid // last child in existing union
 
+		var s *mntstack // for removing duplicate parent,child mnt
+		for ; ch != nil; ch=ch.next {
+			if ch.FileID == cid {
+				s = s.push(pid, cid)
+			}
+		}
+		m.rm_mnt(s)
+		ch = m.Children[pid]
+
 		if ch == nil {
 			parent.Type |= NOREMAP
 			parent.MayCreate = true
@@ -314,23 +627,23 @@ fine:
 			lst = parent
 			// special case for parent GC, but this extra ref is
 		} else { // redundant and simply ignored by rm_mnt
-			var s *mntstack // for removing duplicate parent,child mnt
 			for lst=ch; lst.next != nil; lst=lst.next {
-				if lst.FileID == cid {
-					s = s.push(pid, cid)
-				}
 			}
-			m.rm_mnt(s)
 		}
 
+		unionlk.Lock()
 		switch flags&p.MORDER {
 		case p.MAFTER:
 			child.prev = lst
 			lst.next = child
+			child.ref++
 		case p.MBEFORE:
 			child.next = ch
+			ch.prev = child
+			ch.ref++
 			m.Children[pid] = child
 		}
+		unionlk.Unlock()
 	}
 	return nil
 }
@@ -346,6 +659,20 @@ func (m *Mnttab) CheckMount(id FileID) *Fid {
 	return c
 }
 
+/*  Like CheckMount, but takes a reference to the fid returned
+    (see Fid.incref), for the caller to drop with decref.
+ */
+func (m *Mnttab) mount(id FileID) *Fid {
+	m.Lock()
+	defer m.Unlock()
+	unionlk.Lock()
+	defer unionlk.Unlock()
+	if c := m.Children[id]; c != nil && c.incref() {
+		return c
+	}
+	return nil
+}
+
 /*  Check parents for those with a matching FileID
     to decide whether to step back through a mount.
  */
@@ -355,9 +682,9 @@ func (m *Mnttab) CheckParent(parent, child FileID) *Fid {
 		p.Type |= NOREMAP
 		return p == mask_id
 	}
-	fmt.Printf("Checking Parents for %v against %v\n", child, parent)
+	m.Lock()
+	defer m.Unlock()
 	for _, p := range(m.Parents[child]) {
-		fmt.Printf("  %v\n", p.FileID)
 		if ck_equiv(p.FileID) {
 			return p
 		}
@@ -365,11 +692,48 @@ func (m *Mnttab) CheckParent(parent, child FileID) *Fid {
 	return nil
 }
 
+// Like CheckParent, but takes a reference to the fid returned.
+func (m *Mnttab) parent(parent, child FileID) *Fid {
+	m.Lock()
+	defer m.Unlock()
+	unionlk.Lock()
+	defer unionlk.Unlock()
+	for _, p := range(m.Parents[child]) {
+		if p.FileID.Type|NOREMAP == parent.Type|NOREMAP &&
+			p.FileID.Dev == parent.Dev && p.FileID.Qid == parent.Qid && p.incref() {
+			return p
+		}
+	}
+	return nil
+}
+
+/*  Returns the members of the union mounted on id, or nil if
+    id is not a mount point. id itself is left out if it's part
+    of the union, unless it was bound on itself alone.
+ */
+func (m *Mnttab) Union(id FileID) []*Fid {
+	var u []*Fid
+
+	m.Lock()
+	defer m.Unlock()
+	self := FileID{id.Type | NOREMAP, id.Dev, id.Qid}
+	c := m.Children[id]
+	if c != nil && c.next == nil {
+		return []*Fid{c}
+	}
+	for ; c != nil; c = c.next {
+		if c.FileID != self {
+			u = append(u, c)
+		}
+	}
+	return u
+}
+
 /*  List Parents of the current Fid (those mounting Fid).
  */
 func (m *Mnttab) Mounted(id FileID) []*Fid {
 	m.Lock()
-	c := m.Parents[id]
+	c := append([]*Fid(nil), m.Parents[id]...)
 	m.Unlock()
 	return c
 }
@@ -406,12 +770,15 @@ func (ns *Namespace) unlink(loc *NSElem) {
 
 /* Generic function to remove val from slice.
  */
-func remove_from_sl(slice []*Fid, val FileID) []*Fid {
+func (m *Mnttab) remove_from_sl(slice []*Fid, val FileID) []*Fid {
         var off int
+	self := FileID{val.Type | NOREMAP, val.Dev, val.Qid}
         for i, v := range slice {
                 slice[i-off] = slice[i]
-                if off == 0 && v.FileID == val {
-			v.Clunk()
+                if off == 0 && (v.FileID == val || v.FileID == self) {
+			if v.FileID == val { // else still in the union, see Mount
+				m.decref(v)
+			}
                         off++
                 }
         }
@@ -454,12 +821,16 @@ func (s *mntstack) remove_from(parent, child FileID) (*mntstack) {
         return head
 }
 
-// Remove the first elem. from the union.
-func remove_from_union(s *Fid, v FileID, clunk bool) *Fid {
+/* Remove the first elem. from the union. The fid removed keeps
+ * its links, for the walks still going through it, and the table's
+ * reference to it is dropped if clunk is set.
+ */
+func (m *Mnttab) remove_from_union(s *Fid, v FileID, clunk bool) *Fid {
 	if s == nil {
 		fmt.Printf("Error! tried to remove fid from non-existant union.\n")
 		return s
 	}
+	unionlk.Lock()
 	if s.FileID == v {
 		next := s.next
 		if next != nil {
@@ -468,30 +839,111 @@ func remove_from_union(s *Fid, v FileID, clunk bool) *Fid {
 		/* if s.prev != nil {
 			s.prev.next = next
 		} */
+		unionlk.Unlock()
 		if clunk {
-			s.Clunk()
+			m.decref(s)
 		}
 		return next
 	}
 	head := s
         for s=s.next; s != nil; s=s.next {
                 if s.FileID == v {
-			if s.prev != nil {
+			linked := s.prev != nil
+			if linked {
 				s.prev.next = s.next
+				if s.next != nil {
+					s.next.ref++
+				}
 			}
 			if s.next != nil {
 				s.next.prev = s.prev
 			}
+			unionlk.Unlock()
+			if linked { // no longer from prev
+				m.decref(s)
+			}
 			if clunk {
-				s.Clunk()
+				m.decref(s)
 			}
 			return head
 		}
         }
+	unionlk.Unlock()
 	fmt.Printf("Error! tried to remove absentee fid from union.\n")
         return head
 }
 
-// Todo - check for cycles.
+/* Removes the mounts that can no longer be reached from the root
+ * device, like those left by unmounting one of a cycle of mounts,
+ * and clunks their fids.
+ */
 func (m *Mnttab) GC() {
+	m.Lock()
+	defer m.unlock()
+	if m.garbage() == nil {
+		return
+	}
+	if err := m.own(); err != nil {
+		return // keep them until the next GC
+	}
+
+	m.gc()
+}
+
+/* Called with Mnttab's lock held, after own().
+ * Collects the unreachable mounts, one at a time since rm_mnt
+ * may remove more of them, then the unions left with only
+ * their parent.
+ */
+func (m *Mnttab) gc() {
+	for s := m.garbage(); s != nil; s = m.garbage() {
+		m.rm_mnt(s)
+	}
+
+	for pid, c := range m.Children {
+		self := FileID{pid.Type | NOREMAP, pid.Dev, pid.Qid}
+		if c == nil {
+			delete(m.Children, pid)
+		} else if c.next == nil && c.FileID == self && !m.FromDev[pid.Dev].has(pid) {
+			delete(m.Children, pid) // nothing left but the parent
+			m.decref(c)
+		}
+	}
+}
+
+// Whether s has a mount from parent (the parent of a self-replace
+// mount is also left alone in its union).
+func (s *mntstack) has(parent FileID) bool {
+	for ; s != nil; s = s.next {
+		if s.parent == parent {
+			return true
+		}
+	}
+	return false
+}
+
+/* Called with Mnttab's lock held.
+ * Returns a mount from a device that the mounts starting
+ * from the root device don't lead to, or nil.
+ */
+func (m *Mnttab) garbage() *mntstack {
+	reached := map[uint32]bool{m.Root: true}
+	devs := []uint32{m.Root}
+	for len(devs) > 0 {
+		dev := devs[len(devs)-1]
+		devs = devs[:len(devs)-1]
+		for s := m.FromDev[dev]; s != nil; s = s.next {
+			if !reached[s.child.Dev] {
+				reached[s.child.Dev] = true
+				devs = append(devs, s.child.Dev)
+			}
+		}
+	}
+
+	for dev, s := range m.FromDev {
+		if s != nil && !reached[dev] {
+			return &mntstack{parent: s.parent, child: s.child}
+		}
+	}
+	return nil
 }
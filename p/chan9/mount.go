@@ -13,13 +13,24 @@ import (
 //    The call to Attach creates a fid and runs Clnt.incref(), which will be destroyed
 //    if the ns.Root is ever clunk()-ed
 //    so call Clnt.incref() if you need to keep it.
+//    The namespace takes over the caller's reference to clnt, which is
+//    dropped by Namespace.Close. An empty aname stands for clnt.Aname.
 func (ns *Namespace) Mount(clnt *Clnt, afd *Fid, oldloc string, flags uint32, aname string) error {
 	var e Elemlist
 	var parent *Fid
+	var used bool
 
 	if flags > p.MMASK-1 {
 		return &p.Error{"bad mount flags", p.EINVAL}
 	}
+	clnt.Lock()
+	if len(clnt.fids) == 0 { // else they'd be put back in the wrong pool
+		clnt.fidpool = ns.fidpool
+	}
+	clnt.Unlock()
+	if aname == "" {
+		aname = clnt.Aname
+	}
 	fid, err := clnt.Attach(afd, clnt.User, aname)
 	if err != nil {
 		return err
@@ -50,13 +61,28 @@ func (ns *Namespace) Mount(clnt *Clnt, afd *Fid, oldloc string, flags uint32, an
 	}
 	fid.Cname[0] = clnt.Id+"!"
 	copy(fid.Cname[1:], clnt.Subpath)
+	fid.mounted = true
 
+	// Whether the namespace uses clnt already is checked, and the
+	// mount made, under mountlk (not the namespace's lock, which the
+	// walks take), for no Mount or Umount to count clnt in or out of
+	// the namespace meanwhile.
+	ns.mountlk.Lock()
+	defer ns.mountlk.Unlock()
+	ns.Lock()
+	used = ns.clnts()[clnt]
+	ns.Unlock()
 	err = ns.Mnt.Mount(fid, parent, flags)
 	if err != nil {
-		parent.Clunk()
-		goto err
+		return err // both clunked
 	}
-	clnt.fidpool = ns.fidpool
+	clnt.Lock()
+	if used {
+		clnt.ref-- // the namespace holds one already
+	} else {
+		clnt.nsref++
+	}
+	clnt.Unlock()
 
 	return nil
 err:
@@ -84,22 +110,36 @@ func (ns *Namespace) Bind(cname, pname string, flags uint32) error {
 	// the bind, not when the binding is later used.
 	child, err := ns.FWalkTo(cpath)
 	if err != nil {
+		parent.Clunk()
 		return err
 	}
 	// Handle special case of chroot-ing
-	if flags&p.MORDER == p.MREPL && parent.FileID == ns.Root.FileID {
-		ns.Mnt.Root = child.Dev
-		ns.Root.Clunk()
-		parent.Clunk()
-		ns.Root = child
-		ns.Mnt.GC()
-		return nil
+	if flags&p.MORDER == p.MREPL {
+		ns.Lock()
+		old := ns.Root
+		if old != nil && parent.FileID == old.FileID {
+			child.Path = child.Path[len(child.Path)-1:] // .. stops here
+			child.name = nil
+			child.ref = 1
+			ns.Mnt.Lock()
+			ns.Mnt.Root = child.Dev
+			ns.Mnt.Unlock()
+			ns.Root = child
+			ns.Unlock()
+			old.decref()
+			parent.Clunk()
+			ns.Mnt.GC()
+			return nil
+		}
+		ns.Unlock()
 	}
-	
+
 	return ns.Mnt.Mount(child, parent, flags)
 }
 
 /* Returns a list of things pointing here and things here points at (if a mount/union).
+ * The last element of path is not walked through, so path has
+ * things pointing at it exactly when FRemove refuses to remove it.
  */
 func (ns *Namespace) LsMounts(path string) ([]string, []string, error) {
 	parents := make([]string, 0)
@@ -113,20 +153,28 @@ func (ns *Namespace) LsMounts(path string) ([]string, []string, error) {
 	for _, p := range ns.Mnt.Mounted(fid.FileID) {
 		parents = append(parents, strings.Join(p.Cname, "/"))
 	}
-	for c := ns.Mnt.CheckMount(fid.FileID); c != nil; c=c.next {
+	for _, c := range ns.Mnt.Union(fid.FileID) {
 		children = append(children, strings.Join(c.Cname, "/"))
 	}
 	fid.Clunk()
 	return parents, children, nil
 }
 
-/* TODO: Provide an unmount that works with strings -> find network names.
- *       or to unmount all.
+/* Removes the mount (or bind) of cname from pname, or everything
+ * mounted on pname if cname is "". The mounts left unreachable
+ * are collected (see Mnttab.GC), and the clients no longer used
+ * are released.
+ * To unmount a server by its network name, see UmountServer.
  */
 func (ns *Namespace) Umount(cname, pname string) error {
 	//var oper func()
 	var child *Fid
 
+	ns.mountlk.Lock()
+	defer ns.mountlk.Unlock()
+	ns.Lock()
+	cs := ns.clnts()
+	ns.Unlock()
 	ppath := ParseName(pname)
 	cpath := ParseName(cname)
 	// walk both locations
@@ -135,13 +183,71 @@ func (ns *Namespace) Umount(cname, pname string) error {
 		return err
 	}
 
-	//if cpath != "" { // specify umount all?
-	child, err = ns.FWalkTo(cpath)
+	if cname != "" { // else unmount all from pname
+		child, err = ns.FWalkTo(cpath)
+		if err != nil {
+			parent.Clunk()
+			return err
+		}
+	}
+	
+	err = ns.Mnt.Umount(child, parent)
 	if err != nil {
 		return err
 	}
-	//}
-	
-	return ns.Mnt.Umount(child, parent)
+	ns.drop(cs)
+	return nil
+}
+
+/* Removes every mount of the server dialed at addr (or of the
+ * client with Id addr), along with the binds of its files and
+ * whatever was mounted on them.
+ */
+func (ns *Namespace) UmountServer(addr string) error {
+	var err error
+
+	ns.mountlk.Lock()
+	defer ns.mountlk.Unlock()
+	ns.Lock()
+	cs := ns.clnts()
+	ns.Unlock()
+	found := false
+	for c := range cs {
+		if c.addr != addr && c.Id != addr {
+			continue
+		}
+		e := ns.Mnt.UmountDev(c.Dev)
+		if perr, ok := e.(*p.Error); ok && perr.Errornum == p.ENOENT {
+			continue // not mounted, only walked to
+		}
+		if e != nil {
+			err = e
+			break
+		}
+		found = true
+	}
+	ns.drop(cs)
+	if err == nil && !found {
+		err = &p.Error{"server not mounted", p.ENOENT}
+	}
+
+	return err
+}
+
+// Drops the references of the namespace to the clients in cs
+// it no longer uses (see Close).
+func (ns *Namespace) drop(cs map[*Clnt]bool) {
+	ns.Lock()
+	used := ns.clnts()
+	ns.Unlock()
+	for c := range cs {
+		if used[c] {
+			continue
+		}
+		c.Lock()
+		c.nsref--
+		c.Unlock()
+		c.edecref(&p.Error{"unmounted", p.EINVAL})
+	}
 }
 
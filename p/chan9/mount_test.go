@@ -0,0 +1,161 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUmount(t *testing.T) {
+	ns := testNS(t, "d/", "", "n/", "")
+	x := testSrv(t, "a", "1", "x/", "", "z/", "", "z/b", "2")
+	y := testConnect(t, testSrv(t, "y/", ""))
+	addr := testListen(t, x)
+
+	nsfile := "mount " + addr + " /n\n" +
+		"bind -a /n/z /d\n"
+	if err := NewNS(ns, strings.NewReader(nsfile), nil); err != nil {
+		t.Fatal(err)
+	}
+	var mnt *Clnt
+	for c := range ns.clnts() {
+		if c.addr == addr {
+			mnt = c
+		}
+	}
+	exists := func(name string) bool {
+		fid, err := ns.FWalk(ParseName(name))
+		if err != nil {
+			return false
+		}
+		fid.Clunk()
+		return true
+	}
+	connected := func(c *Clnt) bool {
+		clnts.Lock()
+		defer clnts.Unlock()
+		return clnts.c[c.Dev] == c
+	}
+
+	if err := ns.UmountServer(addr); err != nil {
+		t.Fatal(err)
+	}
+	if exists("/n/a") || exists("/d/b") || len(ns.Mounts()) != 0 {
+		t.Errorf("after UmountServer: /n/a %v, /d/b %v, mounts %v",
+			exists("/n/a"), exists("/d/b"), ns.Mounts())
+	}
+	if mnt == nil || connected(mnt) {
+		t.Error("unmounted client still connected")
+	}
+	if err := ns.UmountServer(addr); !errors.Is(err, p.ENOENT) {
+		t.Errorf("UmountServer of a server not mounted: %v", err)
+	}
+
+	// a cycle of mounts, x on y and y on x, left by the unmount of x
+	mnt = testConnect(t, x)
+	if err := ns.Mount(mnt, nil, "/n", p.MREPL, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Mount(y, nil, "/n/x", p.MREPL, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Bind("/n/z", "/n/x/y", p.MREPL); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("/n/x/y/b") {
+		t.Fatal("bind of x on y not seen")
+	}
+	if err := ns.Umount("", "/n"); err != nil {
+		t.Fatal(err)
+	}
+	if exists("/n/x") || len(ns.Mounts()) != 0 {
+		t.Errorf("after unmount: /n/x %v, mounts %v", exists("/n/x"), ns.Mounts())
+	}
+	if connected(mnt) || connected(y) {
+		t.Errorf("clients of the cycle connected: %v %v", connected(mnt), connected(y))
+	}
+}
+
+// The mount table is not locked while the fids of a mount are cloned
+// or clunked: a slow server holds up no walk meanwhile.
+func TestMountStalled(t *testing.T) {
+	var mu sync.Mutex
+	var hold uint8 // the type of the request to hold
+	held, release := make(chan bool), make(chan bool)
+	slow, _ := testFakeClnt(t, func(tc, rc *p.Fcall) bool {
+		mu.Lock()
+		h := hold
+		mu.Unlock()
+		if tc.Type == h {
+			held <- true
+			<-release
+		}
+		switch tc.Type {
+		case p.Tattach:
+			p.PackRattach(rc, &p.Qid{Type: p.QTDIR})
+		case p.Twalk: // only clones
+			p.PackRwalk(rc, nil)
+		default:
+			p.PackRclunk(rc)
+		}
+		return true
+	})
+
+	ns := testNS(t, "d/", "", "n/", "", "a", "x")
+	if err := ns.Mount(slow, nil, "/d", p.MREPL, ""); err != nil {
+		t.Fatal(err)
+	}
+	ns2, err := ns.Fork(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stalled := func(what string, typ uint8, ns *Namespace, op func() error) {
+		mu.Lock()
+		hold = typ
+		mu.Unlock()
+		done := make(chan error, 1)
+		go func() { done <- op() }()
+		<-held
+
+		walked := make(chan error, 1)
+		go func() {
+			fid, err := ns.FWalk(ParseName("/a"))
+			if err == nil {
+				fid.Clunk()
+			}
+			walked <- err
+		}()
+		select {
+		case err := <-walked:
+			if err != nil {
+				t.Errorf("%s: walk: %v", what, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: walk held up", what)
+		}
+
+		mu.Lock()
+		hold = 0
+		mu.Unlock()
+		release <- true
+		if err := <-done; err != nil {
+			t.Errorf("%s: %v", what, err)
+		}
+	}
+
+	// the first change to the mount table of a fork clones its fids
+	stalled("mount on a fork", p.Twalk, ns2, func() error {
+		return ns2.Mount(testConnect(t, testSrv(t)), nil, "/n", p.MREPL, "")
+	})
+	// the unmount of slow from ns clunks its fid
+	stalled("unmount", p.Tclunk, ns, func() error {
+		return ns.Umount("", "/d")
+	})
+
+	ns.Close()
+	ns2.Close()
+}
@@ -0,0 +1,193 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// An entry of the mount table, as returned by Namespace.Mounts.
+type MountEntry struct {
+	Source string // the address of the server mounted, or the path bound
+	Target string // the path mounted (or bound) on
+	Spec   string // the aname attached to, for mounts
+	Server string // the Id of the client the source is on
+	Flags  uint32 // p.MREPL, p.MBEFORE or p.MAFTER, or-ed with p.MCREATE and p.MCACHE
+	Bind   bool   // true for a bind, false for a mount
+	Order  int    // position in the union at Target, from 0 (Target itself takes one if not replaced)
+}
+
+/* Returns the mounts and binds of the namespace, by Target and then
+ * Order. The order the entries were made in is not kept: the flags
+ * are those that give the same unions. Targets and bound sources
+ * are given as paths in the namespace.
+ */
+func (ns *Namespace) Mounts() []MountEntry {
+	var mnts []MountEntry
+
+	m := ns.Mnt
+	m.Lock()
+	defer m.Unlock()
+	for id, c := range m.Children {
+		pid := FileID{id.Type | NOREMAP, id.Dev, id.Qid}
+		self := -1
+		var union []*Fid
+		for ; c != nil; c = c.next {
+			if c.FileID == pid {
+				self = len(union) // the parent, in its union
+			}
+			union = append(union, c)
+		}
+
+		var target string
+		for _, c := range union {
+			for _, pfid := range m.Parents[c.FileID] {
+				if pfid.FileID == id || pfid.FileID == pid {
+					target = ns.fidPath(pfid)
+				}
+			}
+			if target != "" {
+				break
+			}
+		}
+		if target == "" && self >= 0 {
+			target = ns.fidPath(union[self])
+		}
+
+		for i, c := range union {
+			if i == self {
+				continue
+			}
+
+			e := MountEntry{Target: target, Server: c.Clnt.Id, Order: i}
+			switch {
+			case self < 0 && i == 0:
+				e.Flags = p.MREPL
+			case self >= 0 && i < self:
+				e.Flags = p.MBEFORE
+			default:
+				e.Flags = p.MAFTER
+			}
+			if c.MayCreate {
+				e.Flags |= p.MCREATE
+			}
+			if c.MayCache {
+				e.Flags |= p.MCACHE
+			}
+
+			if c.mounted {
+				e.Source = c.Clnt.addr
+				if e.Source == "" {
+					e.Source = c.Clnt.Id
+				}
+				e.Spec = c.Clnt.aname
+			} else {
+				e.Bind = true
+				e.Source = ns.fidPath(c)
+			}
+			mnts = append(mnts, e)
+		}
+	}
+
+	sort.Slice(mnts, func(i, j int) bool {
+		if mnts[i].Target != mnts[j].Target {
+			return mnts[i].Target < mnts[j].Target
+		}
+		return mnts[i].Order < mnts[j].Order
+	})
+	return mnts
+}
+
+// Returns the path in the namespace of a fid of the mount table.
+func (ns *Namespace) fidPath(fid *Fid) string {
+	path, _ := ns.Fd2Path(fid)
+	return path
+}
+
+/* Writes the mount table as the mount and bind commands of a namespace
+ * file (see NewNS) that rebuild it, starting from the same root. The
+ * commands are ordered so the mounts a path needs come before it.
+ */
+func (ns *Namespace) WriteNS(w io.Writer) error {
+	mnts := ns.Mounts()
+
+	// replay the unions in an order that gives the same result
+	var cmds []MountEntry
+	for i := 0; i < len(mnts); {
+		j := i
+		for j < len(mnts) && mnts[j].Target == mnts[i].Target {
+			j++
+		}
+		union := mnts[i:j]
+		for _, e := range union {
+			if e.Flags&p.MORDER != p.MBEFORE {
+				cmds = append(cmds, e)
+			}
+		}
+		for k := len(union) - 1; k >= 0; k-- {
+			if union[k].Flags&p.MORDER == p.MBEFORE {
+				cmds = append(cmds, union[k])
+			}
+		}
+		i = j
+	}
+
+	depth := func(e MountEntry) int {
+		d := strings.Count(e.Target, "/")
+		if e.Bind && strings.Count(e.Source, "/") > d {
+			d = strings.Count(e.Source, "/")
+		}
+		return d
+	}
+	sort.SliceStable(cmds, func(i, j int) bool {
+		return depth(cmds[i]) < depth(cmds[j])
+	})
+
+	for _, e := range cmds {
+		cmd := "mount"
+		if e.Bind {
+			cmd = "bind"
+		}
+		flags := ""
+		switch e.Flags & p.MORDER {
+		case p.MBEFORE:
+			flags = "b"
+		case p.MAFTER:
+			flags = "a"
+		}
+		if e.Flags&p.MCREATE != 0 {
+			flags += "c"
+		}
+		if e.Flags&p.MCACHE != 0 {
+			flags += "C"
+		}
+		if flags != "" {
+			cmd += " -" + flags
+		}
+
+		line := cmd + " " + nsQuote(e.Source) + " " + nsQuote(e.Target)
+		if !e.Bind && e.Spec != "" {
+			line += " " + nsQuote(e.Spec)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Quotes a word of a namespace file, if needed (see tokenize).
+func nsQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r'#") {
+		return s
+	}
+
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
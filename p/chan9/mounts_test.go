@@ -0,0 +1,59 @@
+package chan9
+
+import (
+	"bytes"
+	"code.google.com/p/go9p/p"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWriteNS(t *testing.T) {
+	addr := testListen(t, testSrv(t, "a", "1", "e/", "", "e/x", "2"))
+	local := testSrv(t, "d/", "", "e/", "", "n/", "", "x", "0")
+	ns, err := NSFromClnt(testConnect(t, local), nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nsfile := "mount -C " + addr + " /n\n" +
+		"bind -a /n/e /d\n" +
+		"bind -bc /e /d\n" +
+		"bind /n/e/x /x\n"
+	if err = NewNS(ns, strings.NewReader(nsfile), nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []MountEntry{
+		{"/e", "/d", "", "", p.MBEFORE | p.MCREATE, true, 0},
+		{"/n/e", "/d", "", "", p.MAFTER, true, 2},
+		{addr, "/n", "", addr, p.MREPL | p.MCACHE, false, 0},
+		{"/n/e/x", "/x", "", "", p.MREPL, true, 0},
+	}
+	mounts := func(ns *Namespace) string {
+		mnts := ns.Mounts()
+		for i := range mnts {
+			if mnts[i].Bind {
+				mnts[i].Server = "" // differs for the local clients
+			}
+		}
+		return fmt.Sprint(mnts)
+	}
+	if mounts(ns) != fmt.Sprint(want) {
+		t.Errorf("mounts:\n%v\nwant:\n%v", mounts(ns), want)
+	}
+
+	var buf bytes.Buffer
+	if err = ns.WriteNS(&buf); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NSFromClnt(testConnect(t, local), nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = NewNS(other, &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if mounts(other) != mounts(ns) {
+		t.Errorf("replayed mounts:\n%v\nwant:\n%v", mounts(other), mounts(ns))
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chan9
+
+/*  Namespace files.
+    NewNS reads a namespace description in the format of Plan 9's
+    /lib/namespace (see namespace(6)) and applies it to a Namespace.
+    One command per line:
+
+	mount [-abcC] addr old [spec]
+	bind [-abcC] new old
+	unmount [new] old
+	cd dir
+	clear
+	. file
+
+    The addresses are dialed with Dial, so their networks can be
+    any registered with RegisterNetwork. Words can be quoted with
+    single quotes ('' stands for a quote inside them), and # starts
+    a comment. $name is replaced by vars[name]; as in Plan 9, lines
+    using a variable that is not set are skipped.
+*/
+
+import (
+	"bufio"
+	"code.google.com/p/go9p/p"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+)
+
+// Reads the namespace file from r and applies it to ns. Stops at the
+// first command that fails, returning an Error that gives the name of
+// the file (if r has a Name method, like File and os.File) and the
+// line number.
+func NewNS(ns *Namespace, r io.Reader, vars map[string]string) error {
+	name := "namespace"
+	if f, ok := r.(interface{ Name() string }); ok {
+		name = f.Name()
+	}
+
+	return ns.newns(name, r, vars, 0)
+}
+
+func (ns *Namespace) newns(name string, r io.Reader, vars map[string]string, depth int) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		args, ok := expand(tokenize(scanner.Text()), vars)
+		if !ok || len(args) == 0 {
+			continue
+		}
+
+		err := ns.nsop(args, vars, depth)
+		if err != nil {
+			return nsError(name, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nsError(name, line, err)
+	}
+
+	return nil
+}
+
+// Runs a command of a namespace file.
+func (ns *Namespace) nsop(args []string, vars map[string]string, depth int) error {
+	cmd := args[0]
+	args = args[1:]
+	flags := uint32(p.MREPL)
+	if cmd == "mount" || cmd == "bind" {
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			for _, c := range args[0][1:] {
+				switch c {
+				case 'a':
+					flags = flags&^p.MORDER | p.MAFTER
+				case 'b':
+					flags = flags&^p.MORDER | p.MBEFORE
+				case 'c':
+					flags |= p.MCREATE
+				case 'C':
+					flags |= p.MCACHE
+				default:
+					return &p.Error{fmt.Sprintf("bad %s flag %q", cmd, c), p.EINVAL}
+				}
+			}
+			args = args[1:]
+		}
+	}
+
+	usage := &p.Error{"usage: " + nsusage[cmd], p.EINVAL}
+	switch cmd {
+	case "mount":
+		if len(args) != 2 && len(args) != 3 {
+			return usage
+		}
+		spec := ""
+		if len(args) == 3 {
+			spec = args[2]
+		}
+
+		c, err := Dial(args[0])
+		if err != nil {
+			return err
+		}
+		err = ns.Mount(c, nil, args[1], flags, spec)
+		if err != nil {
+			c.Clunk(err)
+		}
+		return err
+
+	case "bind":
+		if len(args) != 2 {
+			return usage
+		}
+		return ns.Bind(args[0], args[1], flags)
+
+	case "unmount":
+		switch len(args) {
+		case 1:
+			return ns.Umount("", args[0])
+		case 2:
+			return ns.Umount(args[0], args[1])
+		}
+		return usage
+
+	case "cd":
+		if len(args) != 1 {
+			return usage
+		}
+		return ns.Cd(args[0])
+
+	case "clear":
+		if len(args) != 0 {
+			return usage
+		}
+		return ns.clear()
+
+	case ".":
+		if len(args) != 1 {
+			return usage
+		}
+		if depth >= 16 {
+			return &p.Error{"includes nested too deep", p.EINVAL}
+		}
+
+		file, err := ns.FOpen(ParseName(args[0]), p.OREAD)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return ns.newns(args[0], file, vars, depth+1)
+	}
+
+	return &p.Error{"unknown command " + cmd, p.EINVAL}
+}
+
+var nsusage = map[string]string{
+	"mount":   "mount [-abcC] addr old [spec]",
+	"bind":    "bind [-abcC] new old",
+	"unmount": "unmount [new] old",
+	"cd":      "cd dir",
+	"clear":   "clear",
+	".":       ". file",
+}
+
+// Returns err with the file name and line number prepended.
+func nsError(name string, line int, err error) error {
+	msg := err.Error()
+	errno := p.EINVAL
+	var perr *p.Error
+	if errors.As(err, &perr) {
+		errno = perr.Errornum
+		if perr == err {
+			msg = perr.Err
+		}
+	} else if en, ok := err.(syscall.Errno); ok {
+		errno = en
+	}
+
+	return &p.Error{fmt.Sprintf("%s:%d: %s", name, line, msg), errno}
+}
+
+// Splits a line into words, like Plan 9's tokenize: words are
+// separated by blanks, and can be quoted with single quotes (”
+// inside a quoted word stands for a quote). A # outside quotes
+// starts a comment.
+func tokenize(s string) []string {
+	var args []string
+	var word strings.Builder
+
+	inword := false
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted:
+			if c != '\'' {
+				word.WriteByte(c)
+			} else if i+1 < len(s) && s[i+1] == '\'' {
+				word.WriteByte(c)
+				i++
+			} else {
+				quoted = false
+			}
+			continue
+		case c == '\'':
+			quoted = true
+			inword = true
+			continue
+		case c == '#' && !inword:
+			i = len(s)
+		case c != ' ' && c != '\t' && c != '\r':
+			word.WriteByte(c)
+			inword = true
+			continue
+		}
+
+		if inword {
+			args = append(args, word.String())
+			word.Reset()
+			inword = false
+		}
+	}
+	if inword {
+		args = append(args, word.String())
+	}
+
+	return args
+}
+
+// Replaces the $names in args by their values. Returns false if
+// a variable is not set.
+func expand(args []string, vars map[string]string) ([]string, bool) {
+	for i, arg := range args {
+		var s strings.Builder
+		for {
+			n := strings.IndexByte(arg, '$')
+			if n < 0 {
+				break
+			}
+			s.WriteString(arg[:n])
+			arg = arg[n+1:]
+
+			n = 0
+			for n < len(arg) && isVarChar(arg[n]) {
+				n++
+			}
+			val, ok := vars[arg[:n]]
+			if n == 0 || !ok {
+				return nil, false
+			}
+			s.WriteString(val)
+			arg = arg[n:]
+		}
+		s.WriteString(arg)
+		args[i] = s.String()
+	}
+
+	return args, true
+}
+
+func isVarChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Throws away all mounts and binds, like rfork(RFCNAMEG): the namespace
+// starts over from the root of the device of Root.
+func (ns *Namespace) clear() error {
+	old, err := ns.Fork(false)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	ns.Root, old.Root = old.Root, ns.Root
+	ns.Cwd, old.Cwd = old.Cwd, ns.Cwd
+	ns.Mnt, old.Mnt = old.Mnt, ns.Mnt
+	ns.Unlock()
+
+	// the clients of the fids the caller still has are kept
+	old.Close()
+	return nil
+}
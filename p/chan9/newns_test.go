@@ -0,0 +1,53 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNewNS(t *testing.T) {
+	s := testSrv(t, "a", "1", "d/", "", "e/", "", "e/x", "2", "ns", "bind /d/e/x /d/a\n")
+	ns := testNS(t, "d/", "", "e/", "", "e/y", "3")
+	vars := map[string]string{"addr": testListen(t, s)}
+	nsfile := `# a comment
+mount -a $addr /d
+bind -b /e '/d'
+bind $unset /nowhere
+cd /d
+. ns
+`
+	err := NewNS(ns, strings.NewReader(nsfile), vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) string {
+		file, err := ns.FOpen(ParseName(name), p.OREAD)
+		if err != nil {
+			return err.Error()
+		}
+		defer file.Close()
+		buf, _ := io.ReadAll(file)
+		return string(buf)
+	}
+	if s := read("/d/y") + read("/d/e/x") + read("a"); s != "322" {
+		t.Errorf("read %q from the new namespace", s)
+	}
+
+	err = NewNS(ns, strings.NewReader("unmount /d\nbind /nowhere /d\n"), nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "namespace:2: ") || !errors.Is(err, p.ENOENT) {
+		t.Errorf("bad bind: %v", err)
+	}
+	if s := read("/d/y"); s == "3" {
+		t.Error("unmount left /e on /d")
+	}
+
+	if err = NewNS(ns, strings.NewReader("clear\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := read("/e/x"); s == "2" {
+		t.Error("clear left the mount")
+	}
+}
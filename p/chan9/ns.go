@@ -15,8 +15,22 @@ import (
 	"sync"
 )
 
-// The top-level namespace keeps track
-// of the mounted p9 clients and the user's fid-s.
+/* The top-level namespace keeps track
+ * of the mounted p9 clients and the user's fid-s.
+ *
+ * A Namespace can be used by many goroutines at once. Its lock guards
+ * Root and Cwd, which Cd and a bind on the root replace: walks take a
+ * reference to them (see Fid.incref), so the fids replaced are only
+ * clunked once the walks started from them are done. The Mnttab has
+ * a lock of its own, and the fids of its unions are counted the same
+ * way, so that a walk going through a union while it's unmounted
+ * finishes on the fids it started with; the members unmounted are
+ * skipped by the walks and reads that reach them afterwards.
+ * Root and Cwd should only be used directly while nothing replaces
+ * them, and the "clear" of NewNS, which replaces Mnt, should not run
+ * with other calls. The locks are taken in the order Namespace,
+ * Mnttab, then the one of the unions.
+ */
 type Namespace struct {
 	sync.Mutex
 	//Cwd      []string
@@ -27,67 +41,229 @@ type Namespace struct {
 			   //    server to accept 9p messages.
 	fidpool    *pool
 	err        error
+	mountlk    sync.Mutex // counts the clients in and out, see Mount
 }
 
 var Enofile error = &p.Error{"file not found", p.ENOENT}
 var Ebaduse error = &p.Error{"bad use of fid", p.EINVAL}
+var Ebadseek error = &p.Error{"bad seek", p.EINVAL}
+var Eloop error = &p.Error{"too many levels of symbolic links", p.ELOOP}
+var Emount error = &p.Error{"file is a mount point", p.EBUSY}
+
+// The number of symbolic links a walk follows before giving up with Eloop.
+const MAXSYMLINKS = 40
 
 /* Initializes a namespace object from a client.
  * It calls Mount to do the initial attachment,
- * which respects Clnt.Subpath.
+ * which respects Clnt.Subpath. An empty aname stands for Clnt.Aname.
+ * The namespace takes over the caller's reference to the client,
+ * which is dropped by Namespace.Close.
  */
 func NSFromClnt(c *Clnt, afd *Fid, flags uint32, aname string) (*Namespace, error) {
+	if aname == "" {
+		aname = c.Aname
+	}
 	fid, err := c.Attach(afd, c.User, aname)
 	if err != nil {
 		return nil, err
 	}
+	if len(c.Subpath) > 0 {
+		var qids []p.Qid
+		qids, err = fid.Walk(fid, c.Subpath)
+		if err == nil && len(qids) != len(c.Subpath) {
+			err = &p.Error{"subpath not found on client", p.ENOENT}
+		}
+		if err != nil {
+			fid.Clunk()
+			return nil, err
+		}
+		fid.Path = fid.Path[len(fid.Path)-1:] // .. stops here
+		fid.name = nil
+	}
+
+	c.Lock()
+	c.nsref++
+	c.Unlock()
 
 	ns := new(Namespace)
 	//ns.User = c.User // p.OsUsers.Uid2User(os.Geteuid())
 	ns.fidpool = c.fidpool // newPool(p.NOFID)
 	ns.Mnt = NewMnttab(c.Dev) // Puts Dev in the Mnttab,
 	ns.Root = fid // so it doesn't flip when we mount.
+	ns.Root.ref = 1
 	ns.Cwd, err = ns.Walk(ns.Root, make([]string,0))
 	if err != nil {
+		fid.Clunk()
+		c.Lock()
+		c.nsref--
+		c.Unlock()
 		return nil, err
 	}
+	ns.Cwd.ref = 1
 
 	return ns, nil
 }
 
+/* Changes the current directory. The old one is clunked once the
+ * walks started from it are done.
+ */
 func (ns *Namespace) Cd(dir string) error {
 	e := ParseName(dir)
 	fid, err := ns.FWalk(e)
 	if err != nil {
 		return err
 	}
-	ns.Cwd.Clunk()
-	ns.Cwd = fid
+	fid.ref = 1
+
+	ns.Lock()
+	old := ns.Cwd
+	if old != nil {
+		ns.Cwd = fid
+	}
+	ns.Unlock()
+	if old == nil { // closed
+		fid.Clunk()
+		return Ebaduse
+	}
+
+	old.decref()
 	return nil
 }
 
-/* Clone a namespace object, uses copy-on-write semantics.
-   TODO: currently incorrectly implemented
+/* Returns the fid names starting with ref are walked from, Root
+ * or Cwd, with a reference taken (see Fid.incref).
  */
-func (ons *Namespace) clone() (*Namespace, error) {
-	ns := new(Namespace)
+func (ns *Namespace) dir(ref rune) (*Fid, error) {
+	var fid *Fid
+
+	ns.Lock()
+	defer ns.Unlock()
+	switch ref {
+	case '/':
+		fid = ns.Root
+	case '.':
+		fid = ns.Cwd
+	default:
+		return nil, Enofile
+	}
+	if fid == nil {
+		return nil, Ebaduse
+	}
+
+	unionlk.Lock()
+	if fid.ref == 0 { // set by the caller, the namespace holds it
+		fid.ref = 1
+	}
+	fid.ref++
+	unionlk.Unlock()
+	return fid, nil
+}
+
+/* Sets the most fids the namespace, with the ones forked from it,
+ * has at once; 0 means as many as 9P allows. Past that, walks wait
+ * for fids to be clunked; the ones given a context give up once it
+ * is done, returning ctx.Err().
+ */
+func (ns *Namespace) SetMaxFids(n int) {
+	ns.fidpool.setMax(n)
+}
+
+/* Returns a copy of the namespace, like rfork(2) does for a process.
+ * If shareMounts is true (RFNAMEG), the copy starts with the mounts
+ * of ns, and the mount table is copied (with fids of its own) the first
+ * time either namespace changes it. Otherwise (RFCNAMEG), the copy
+ * starts with no mounts, at the root of the device of ns.Root.
+ * Either way, the copy gets its own Root and Cwd and references to the
+ * clients, and binds and mounts made in one namespace are not seen in
+ * the other.
+ */
+func (ons *Namespace) Fork(shareMounts bool) (*Namespace, error) {
+	var err error
 
+	ns := new(Namespace)
 	ons.Lock()
-	ns.Root = ons.Root
-	//ns.Cwd = make([]string, len(ons.Cwd))
-	//copy(ns.Cwd, ons.Cwd)
-        ns.fidpool = newPool(p.NOFID) // should walk(0) all fids
-	ons.Unlock()
+	defer ons.Unlock()
+
+	ns.fidpool = ons.fidpool
+	ns.Root, err = ons.Root.Clone(shareMounts)
+	if err != nil {
+		return nil, err
+	}
+	if shareMounts {
+		ns.Cwd, err = ons.Cwd.Clone(true)
+	} else {
+		ns.Cwd, err = ns.Root.Clone(false)
+	}
+	if err != nil {
+		ns.Root.Clunk()
+		return nil, err
+	}
+	ns.Root.ref = 1
+	ns.Cwd.ref = 1
 
-	clnts.Lock() // should manage clnts more effectively
-	clnts.Unlock()
+	if shareMounts {
+		ns.Mnt = ons.Mnt.fork()
+	} else {
+		ns.Mnt = NewMnttab(ons.Mnt.Root)
+	}
+	for c := range ns.clnts() {
+		c.Lock()
+		c.ref++
+		c.nsref++
+		c.Unlock()
+	}
 
 	return ns, nil
 }
 
-func (ns *Namespace) Close() {
-	// Not implemented
-	return
+/* Closes the namespace, clunking Root, Cwd and the fids of the mount
+ * table (unless it's still shared with a fork), and dropping its
+ * references to the clients. The clients no longer referenced are
+ * removed. The namespace can't be used after the call.
+ * If a client used by no other namespace still has fids walked, they
+ * were not clunked by the caller: they are left alone, and reported
+ * in the Error returned (see DbgTrackFids).
+ */
+func (ns *Namespace) Close() error {
+	ns.Lock()
+	defer ns.Unlock()
+	if ns.Root == nil {
+		return Ebaduse
+	}
+
+	cs := ns.clnts()
+	ns.Root.decref()
+	ns.Cwd.decref()
+	ns.Mnt.release()
+	ns.Root = nil
+	ns.Cwd = nil
+
+	var inuse []string
+	closed := &p.Error{"namespace closed", p.EINVAL}
+	for c := range cs {
+		c.Lock()
+		c.nsref--
+		if c.nsref == 0 {
+			inuse = append(inuse, c.unclunked()...)
+		}
+		c.Unlock()
+		c.edecref(closed)
+	}
+
+	return unclunkedError(inuse)
+}
+
+// Returns the clients of the fids held by the namespace.
+// Called with the namespace's lock held.
+func (ns *Namespace) clnts() map[*Clnt]bool {
+	cs := make(map[*Clnt]bool)
+	cs[ns.Root.Clnt] = true
+	cs[ns.Cwd.Clnt] = true
+	for _, fid := range ns.Mnt.fids() {
+		cs[fid.Clnt] = true
+	}
+
+	return cs
 }
 
 const NOREMAP uint16 = 1<<15 // or-ed into Type field to ensure it's not the parent of a mnt
@@ -99,6 +275,7 @@ type Fid struct {
 	Clnt   *Clnt // Client the fid belongs to
 	Cname	[]string // server!/subpath/path != Plan9
 	Path    []FileID // list of id-s ~ Plan9 Cname
+	name    []string // path in the namespace it was reached by, see Fd2Path
 	Iounit uint32
 	FileID
 	/*Type uint16   // Channel type (index of function call table) -- FYI
@@ -111,6 +288,11 @@ type Fid struct {
 	Fid    uint32 // Fid number
 	p.User        // The user the fid belongs to
 	walked bool   // true if the fid points to a walked file on the server
+	opened bool   // true if the fid was opened (in Mode)
+	xattr  bool   // true if the fid was prepared by Xattrwalk or Xattrcreate
+	mounted bool  // true if the fid is the root of a Namespace.Mount
+	alloc  []uintptr // stack of the FidAlloc, with DbgTrackFids
+	ref    int    // references to a fid shared by goroutines, see incref
 	// options for representing union dir-s
 	prev   *Fid
 	next   *Fid
@@ -123,13 +305,23 @@ type Fid struct {
 type File struct {
 	Fid    *Fid
 	Offset uint64
+	Unique bool            // if set, Readdir lists each name of a union once
+	name   string          // name the file was opened by
+	dirs   []*p.Dir        // directory entries read, but not returned yet
+	seen   map[string]bool // names listed from a union, if Unique
 }
 
 type pool struct {
 	sync.Mutex
-	need  int
-	nchan chan uint32
-	maxid uint32
+	maxid uint32    // ids are below maxid
+	max   int       // most ids handed out at once, see setMax
+	wait  chan bool // closed when an id is put back, if getId waits
 	imap  []byte
-}
 
+	// usage, shown on the stats pages
+	inuse int    // ids handed out
+	peak  int    // most ids handed out at once
+	gets  uint64 // ids handed out so far
+	waits uint64 // calls to getId that waited for an id
+	fails uint64 // calls to getId that got none
+}
@@ -0,0 +1,246 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// If the walk to the current directory fails, NSFromClnt clunks the
+// root and leaves the client as it found it.
+func TestNSFromClntError(t *testing.T) {
+	clunked := make(chan uint32, 1)
+	clnt, _ := testFakeClnt(t, func(tc, rc *p.Fcall) bool {
+		switch tc.Type {
+		case p.Tattach:
+			p.PackRattach(rc, &p.Qid{Type: p.QTDIR})
+		case p.Twalk:
+			p.PackRerror(rc, "no", uint32(p.EPERM), false)
+		case p.Tclunk:
+			clunked <- tc.Fid
+			p.PackRclunk(rc)
+		default:
+			p.PackRerror(rc, "unexpected", uint32(p.EINVAL), false)
+		}
+		return true
+	})
+	if _, err := NSFromClnt(clnt, nil, 0, ""); err == nil {
+		t.Fatal("NSFromClnt succeeded")
+	}
+	select {
+	case <-clunked:
+	default:
+		t.Errorf("root not clunked")
+	}
+	clnt.Lock()
+	nsref := clnt.nsref
+	clnt.Unlock()
+	if nsref != 0 {
+		t.Errorf("client used by %d namespaces", nsref)
+	}
+	if err := clnt.Clunk(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFork(t *testing.T) {
+	s := testSrv(t, "a", "1", "d/", "", "e/", "", "e/x", "2")
+	ns, err := NSFromClnt(testConnect(t, s), nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := testConnect(t, s)
+	if err = ns.Mount(mnt, nil, "/d", p.MREPL, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	exists := func(ns *Namespace, name string) bool {
+		fid, err := ns.FWalk(ParseName(name))
+		if err != nil {
+			return false
+		}
+		fid.Clunk()
+		return true
+	}
+	refs := func() int {
+		mnt.Lock()
+		defer mnt.Unlock()
+		return mnt.ref
+	}
+
+	ref := refs()
+	child, err := ns.Fork(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(child, "/d/a") || refs() != ref+1 {
+		t.Errorf("forked namespace: /d/a %v, %d refs to the mount (%d before)",
+			exists(child, "/d/a"), refs(), ref)
+	}
+	ref = refs()
+
+	if err = child.Bind("/e", "/d", p.MREPL); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(child, "/d/x") || exists(child, "/d/a") {
+		t.Error("bind not seen in the forked namespace")
+	}
+	if !exists(ns, "/d/a") || exists(ns, "/d/x") {
+		t.Error("bind in the forked namespace seen in the parent")
+	}
+	if refs() != ref {
+		t.Errorf("%d refs to the mount after the bind, want %d", refs(), ref)
+	}
+
+	if err = ns.Bind("/e", "/d", p.MAFTER); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(ns, "/d/x") || exists(child, "/d/a") {
+		t.Error("bind in the parent seen in the forked namespace")
+	}
+
+	clean, err := ns.Fork(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(clean, "/a") || exists(clean, "/d/a") || exists(clean, "/d/x") {
+		t.Error("mounts seen in a clean namespace")
+	}
+}
+
+func TestNSClose(t *testing.T) {
+	s := testSrv(t, "a", "1", "d/", "")
+	root, mnt := testConnect(t, s), testConnect(t, s)
+	ns, err := NSFromClnt(root, nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.Mount(mnt, nil, "/d", p.MREPL, ""); err != nil {
+		t.Fatal(err)
+	}
+	connected := func(c *Clnt) bool {
+		clnts.Lock()
+		defer clnts.Unlock()
+		return clnts.c[c.Dev] == c
+	}
+
+	child, err := ns.Fork(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = child.Close(); err != nil {
+		t.Errorf("close of a fork: %v", err)
+	}
+	if !connected(root) || !connected(mnt) {
+		t.Error("client shared with the parent removed")
+	}
+
+	fid, err := ns.FWalk(ParseName("/d/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.Close(); !errors.Is(err, p.EBUSY) {
+		t.Errorf("close with a fid in use: %v", err)
+	}
+	if connected(root) || !connected(mnt) {
+		t.Errorf("after close: root connected %v, mount connected %v",
+			connected(root), connected(mnt))
+	}
+	fid.Clunk()
+}
+
+// Walks, reads and changes directory in a namespace from several
+// goroutines while others bind, mount and unmount on it. Meant to
+// be run with -race.
+func TestConcurrentNS(t *testing.T) {
+	ns := testNS(t, "a", "1", "d/", "", "d/x", "2", "e/", "", "e/y", "3", "n/", "")
+	mnt := testSrv(t, "m/", "", "m/z", "4")
+	if err := ns.Mount(testConnect(t, mnt), nil, "/n", p.MREPL, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	fail := func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+	stop := make(chan bool)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				// always there, whatever is mounted on /d and /n
+				fid, err := ns.FWalk(ParseName("/d/x"))
+				if err != nil {
+					fail(fmt.Errorf("walk to /d/x: %v", err))
+					return
+				}
+				fid.Clunk()
+				if _, err = ns.FStat(ParseName("/a")); err != nil {
+					fail(fmt.Errorf("stat of /a: %v", err))
+					return
+				}
+
+				// there or not
+				for _, name := range []string{"/d/y", "/n/m/z", "/d/m/z", "/d/../n"} {
+					if fid, err := ns.FWalk(ParseName(name)); err == nil {
+						fid.Clunk()
+					}
+				}
+				if file, err := ns.FOpen(ParseName("/d"), p.OREAD); err == nil {
+					file.Readdir(0)
+					file.Close()
+				}
+				if i == 0 {
+					dir := []string{"/d", "/e", "/"}[n%3]
+					if err := ns.Cd(dir); err != nil {
+						fail(fmt.Errorf("cd %s: %v", dir, err))
+						return
+					}
+					if fid, err := ns.FWalk(ParseName("..")); err == nil {
+						fid.Clunk()
+					}
+				}
+			}
+		}(i)
+	}
+
+	for n := 0; n < 50; n++ {
+		if err := ns.Bind("/e", "/d", p.MAFTER); err != nil {
+			t.Error(err)
+		}
+		if err := ns.Bind("/n", "/d", p.MBEFORE); err != nil {
+			t.Error(err)
+		}
+		if err := ns.Umount("", "/d"); err != nil {
+			t.Error(err)
+		}
+		if err := ns.Umount("", "/n"); err != nil {
+			t.Error(err)
+		}
+		if err := ns.Mount(testConnect(t, mnt), nil, "/n", p.MREPL, ""); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	for _, err := range errs {
+		t.Error(err)
+	}
+
+	if err := ns.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -12,38 +12,64 @@ type Elemlist struct {
         Mustbedir bool
 }
 
+/* Appends the names add, walked to the FileIDs padd, to the
+ * Cname from and the Path pfrom. As in Plan 9's lexical names,
+ * a ".." takes off the last element, but never the first one
+ * (the root of the server, or of the namespace).
+ */
 func PathJoin(from, add []string, pfrom, padd []FileID) ([]string,[]FileID) {
-	var ndotdot int
+	out := make([]string, len(from), len(from)+len(add))
+	copy(out, from)
+	pout := make([]FileID, len(pfrom), len(pfrom)+len(padd))
+	copy(pout, pfrom)
 
-	for ndotdot=0; ndotdot < len(add); ndotdot++ {
-		if add[ndotdot] != ".." {
-			break
+	for i, name := range add {
+		if name != ".." {
+			out = append(out, name)
+			if i < len(padd) {
+				pout = append(pout, padd[i])
+			}
+			continue
+		}
+		if len(out) > 1 {
+			out = out[:len(out)-1]
+		}
+		if len(pout) > 1 {
+			pout = pout[:len(pout)-1]
 		}
 	}
 
-	nkeep := len(from)-ndotdot
-	if nkeep < 0 { // This means bad input
-		nkeep = 0
-	}
-	l := nkeep+len(add)-ndotdot
-	out := make([]string, l)
-	copy(out[:nkeep], from)
-	copy(out[nkeep:], add[ndotdot:])
+	return out, pout
+}
 
-	l = len(padd)
-	if ndotdot > l { // This means bad input
-		ndotdot = l
+// Appends the names add to the namespace path name, lexically,
+// like PathJoin.
+func nameJoin(name, add []string) []string {
+	out := make([]string, len(name), len(name)+len(add))
+	copy(out, name)
+	for _, elem := range add {
+		if elem != ".." {
+			out = append(out, elem)
+		} else if len(out) > 0 {
+			out = out[:len(out)-1]
+		}
 	}
-	pkeep := len(pfrom)-ndotdot
-	if pkeep < 0 { // Also means bad input.
-		pkeep = 0
+
+	return out
+}
+
+/* Returns the path in the namespace the fid was reached by: the
+ * names walked from ns.Root, with the ".." taken off lexically (see
+ * "Lexical File Names in Plan 9"), and the symbolic links followed
+ * replaced by their targets. It's the path a walk from ns.Root gets
+ * the same file by.
+ */
+func (ns *Namespace) Fd2Path(fid *Fid) (string, error) {
+	if fid == nil {
+		return "", Ebaduse
 	}
-	l = pkeep+l-ndotdot
-	pout := make([]FileID, l)
-	copy(pout[:pkeep], pfrom)
-	copy(pout[pkeep:], padd[ndotdot:])
 
-	return out, pout
+	return "/" + strings.Join(fid.name, "/"), nil
 }
 
 /*
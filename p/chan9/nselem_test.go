@@ -63,8 +63,10 @@ func Test_update_cname(t *testing.T) {
 			s("start", "ha", "2", "c"),
 			q(f1, f2, f1), q(f4, f3, f4), q(f1, f2, f3, f4))
 	c += testwalk(s("..", "r"), s("bling", "..", "c"),
-			s("..", "r", "bling", "..", "c"),
-			q(f4, f2), q(f1, f4, f3), q(f4, f2, f1, f4, f3))
+		s("..", "r", "c"),
+		q(f4, f2), q(f1, f4, f3), q(f4, f2, f3))
+	c += testwalk(s("srv!"), s("..", "..", "a"), s("srv!", "a"),
+		q(f1), q(f1, f1, f2), q(f1, f2))
 	if c > 0 {
 		t.Errorf("Failed %d tests!", c)
 		return
@@ -6,28 +6,38 @@ package chan9
 
 import (
 	"code.google.com/p/go9p/p"
+	"context"
 	"syscall"
 )
 
 // Opens the file associated with the fid. Returns nil if
 // the operation is successful.
 func (fid *Fid) Open(mode uint8) error {
+	return fid.OpenContext(context.Background(), mode)
+}
+
+// Like Open, but the open is flushed and ctx.Err() returned if the
+// context is done before the server answers.
+func (fid *Fid) OpenContext(ctx context.Context, mode uint8) error {
 	if fid == nil {
 		return Ebaduse
 	}
 	if fid.next != nil || fid.prev != nil {
 		fn := func(f *Fid) error {
-			return f.Open(mode)
+			return f.OpenContext(ctx, mode)
 		}
 		return fid.MUntil(fn)
 	}
+	if fid.Clnt.Dotl {
+		return fid.lopen(ctx, p.Omode2Lflags(mode))
+	}
 	tc := fid.Clnt.NewFcall()
 	err := p.PackTopen(tc, fid.Fid, mode)
 	if err != nil {
 		return err
 	}
 
-	rc, err := fid.Clnt.Rpc(tc)
+	rc, err := fid.Clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return err
 	}
@@ -35,12 +45,14 @@ func (fid *Fid) Open(mode uint8) error {
 		return &p.Error{rc.Error, syscall.Errno(rc.Errornum)}
 	}
 
+	fid.cacheValidate(rc.Qid)
 	fid.Qid = rc.Qid
 	fid.Iounit = rc.Iounit
 	if fid.Iounit == 0 || fid.Iounit > fid.Clnt.Msize-p.IOHDRSZ {
 		fid.Iounit = fid.Clnt.Msize - p.IOHDRSZ
 	}
 	fid.Mode = mode
+	fid.opened = true
 	return nil
 }
 
@@ -52,15 +64,20 @@ func (fid *Fid) Create(name string, perm uint32, mode uint8, ext string) error {
 	}
 	if fid.prev != nil || fid.next != nil { // union
 		f := fid
-		for ; f.next != nil; f=f.next {
-			if f.MayCreate {
-				break
+		for !f.MayCreate {
+			next := f.mnext()
+			if f != fid {
+				f.decref()
 			}
-		}
-		if !f.MayCreate {
-			return &p.Error{"No writable directory in union", p.ENOENT}
+			if next == nil {
+				return &p.Error{"No writable directory in union", p.ENOENT}
+			}
+			f = next
 		}
 		nf, err := f.Clone(false)
+		if f != fid {
+			f.decref()
+		}
 		if err != nil {
 			return err
 		}
@@ -71,8 +88,12 @@ func (fid *Fid) Create(name string, perm uint32, mode uint8, ext string) error {
 		}
 		fid.Clunk()
 		*fid = *nf
+		fid.Clnt.track(fid)
 		return nil
 	}
+	if fid.Clnt.Dotl {
+		return fid.lcreate(name, perm, mode, ext)
+	}
 	tc := fid.Clnt.NewFcall()
 	err := p.PackTcreate(tc, fid.Fid, name, perm, mode, ext, fid.Clnt.Dotu)
 	if err != nil {
@@ -93,9 +114,56 @@ func (fid *Fid) Create(name string, perm uint32, mode uint8, ext string) error {
 		fid.Iounit = fid.Clnt.Msize - p.IOHDRSZ
 	}
 	fid.Mode = mode
+	fid.opened = true
 	return nil
 }
 
+// 9P2000.L replacement for Fid.Create. Directories and symbolic
+// links are created with Tmkdir and Tsymlink and then walked to.
+func (fid *Fid) lcreate(name string, perm uint32, mode uint8, ext string) error {
+	gid := p.NOUID
+	if g := fid.Clnt.User.Groups(); len(g) > 0 {
+		gid = uint32(g[0].Id())
+	}
+
+	lmode := perm & 0777
+	if perm&p.DMSETUID != 0 {
+		lmode |= syscall.S_ISUID
+	}
+	if perm&p.DMSETGID != 0 {
+		lmode |= syscall.S_ISGID
+	}
+
+	var err error
+	switch {
+	case perm&p.DMDIR != 0:
+		_, err = fid.Mkdir(name, lmode, gid)
+	case perm&p.DMSYMLINK != 0:
+		_, err = fid.Symlink(name, ext, gid)
+	case perm&(p.DMNAMEDPIPE|p.DMSOCKET|p.DMDEVICE|p.DMLINK) != 0:
+		return &p.Error{"special file creation not supported", p.ENOSYS}
+	default:
+		return fid.Lcreate(name, p.Omode2Lflags(mode)|p.LOCREATE, lmode, gid)
+	}
+	if err != nil {
+		return err
+	}
+
+	wqid, err := fid.Walk(fid, []string{name})
+	if err != nil {
+		return err
+	}
+	if len(wqid) != 1 {
+		return Enofile
+	}
+	if perm&p.DMSYMLINK != 0 {
+		fid.Mode = mode
+		return nil
+	}
+
+	return fid.Lopen(p.Omode2Lflags(mode))
+}
+
 // Creates and opens a named file.
 // Returns the file if the operation is successful, or an Error.
 func (ns *Namespace) FCreate(e Elemlist, perm uint32, mode uint8) (*File, error) {
@@ -106,6 +174,7 @@ func (ns *Namespace) FCreate(e Elemlist, perm uint32, mode uint8) (*File, error)
 	if e.Mustbedir {
 		perm = perm | p.DMDIR
 	}
+	fname := e.String()
 	name := e.Elems[n]
 	e.Elems = e.Elems[:n]
 
@@ -120,21 +189,26 @@ func (ns *Namespace) FCreate(e Elemlist, perm uint32, mode uint8) (*File, error)
 		return nil, err
 	}
 
-	return &File{fid, 0}, nil
+	return &File{Fid: fid, name: fname}, nil
 }
 
 // Opens a named file. Returns the opened file, or an Error.
 func (ns *Namespace) FOpen(path Elemlist, mode uint8) (*File, error) {
-	fid, err := ns.FWalk(path)
+	return ns.FOpenContext(context.Background(), path, mode)
+}
+
+// Like FOpen, but gives up and returns ctx.Err() once the context is done.
+func (ns *Namespace) FOpenContext(ctx context.Context, path Elemlist, mode uint8) (*File, error) {
+	fid, err := ns.FWalkContext(ctx, path)
 	if err != nil {
 		return nil, err
 	}
 
-	err = fid.Open(mode)
+	err = fid.OpenContext(ctx, mode)
 	if err != nil {
 		fid.Clunk()
 		return nil, err
 	}
 
-	return &File{fid, 0}, nil
+	return &File{Fid: fid, name: path.String()}, nil
 }
@@ -0,0 +1,288 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chan9
+
+/*  Pipelined bulk I/O.
+    Instead of waiting a round trip for every Tread or Twrite,
+    File.WriteTo, File.ReadFrom, File.ReadFull and File.WriteFull
+    keep up to Clnt.Window iounit-sized requests in flight and
+    consume the answers in the order the requests were sent. Reads
+    are only pipelined up to the length of the file.
+*/
+
+import (
+	"code.google.com/p/go9p/p"
+	"context"
+	"io"
+)
+
+// Number of requests kept in flight for bulk I/O, if Clnt.Window is 0.
+var DefaultWindow = 8
+
+// Requests in flight, oldest first.
+type pipeline struct {
+	clnt *Clnt
+	reqs []*Req
+}
+
+// Sends tc without waiting for the answer.
+func (pl *pipeline) send(tc *p.Fcall) error {
+	r := pl.clnt.ReqAlloc()
+	r.Tc = tc
+	r.Done = make(chan *Req, 1)
+	err := pl.clnt.Rpcnb(r)
+	if err != nil {
+		pl.clnt.ReqFree(r)
+		return err
+	}
+
+	pl.reqs = append(pl.reqs, r)
+	return nil
+}
+
+// Waits for the answer to the oldest request. Returns the request
+// sent (freed by the caller), and the answer or an Error.
+func (pl *pipeline) recv() (*Req, *p.Fcall, error) {
+	r := pl.reqs[0]
+	pl.reqs = pl.reqs[1:]
+	<-r.Done
+	return r, r.Rc, r.Err
+}
+
+// Waits for and throws away the answers to all requests in flight.
+func (pl *pipeline) drain() {
+	for len(pl.reqs) > 0 {
+		r, _, _ := pl.recv()
+		pl.clnt.ReqFree(r)
+	}
+}
+
+// Returns the number of requests to keep in flight on the fid.
+// Writes to append-only files are not pipelined, the server
+// could apply them out of order.
+func (fid *Fid) window() int {
+	if fid.Qid.Type&p.QTAPPEND != 0 {
+		return 1
+	}
+	if fid.Clnt.Window > 0 {
+		return fid.Clnt.Window
+	}
+
+	return DefaultWindow
+}
+
+// Reads from the fid starting from offset and passes the data to fn in
+// order. Stops at the end of the file, after max bytes (if max >= 0),
+// or when fn returns an error. Returns the number of bytes passed to fn.
+// Only the reads of a file with a length (as Stat gives it), up to that
+// length, are pipelined: reading a stream, like a pipe or a console,
+// consumes the data, which the answers thrown away after a short read
+// would lose. A short read throws away the answers to the requests sent
+// after it, and reading resumes right after the data returned. The
+// reads of a cached fid go through Mcache, one after the other.
+func (fid *Fid) readPipe(offset uint64, max int64, fn func([]byte) error) (int64, error) {
+	if fid.cached() {
+		return fid.readEach(offset, max, fn)
+	}
+
+	window, end := 1, uint64(0)
+	if fid.Qid.Type&p.QTAPPEND == 0 {
+		if d, err := fid.stat(context.Background()); err == nil && d.Length > 0 {
+			window, end = fid.window(), d.Length
+		}
+	}
+
+	pl := &pipeline{clnt: fid.Clnt}
+	defer pl.drain()
+
+	var done int64
+	next := offset
+	for {
+		for (len(pl.reqs) == 0 || len(pl.reqs) < window && next < end) && (max < 0 || int64(next-offset) < max) {
+			count := fid.Iounit
+			if max >= 0 && max-int64(next-offset) < int64(count) {
+				count = uint32(max - int64(next-offset))
+			}
+
+			tc := fid.Clnt.NewFcall()
+			err := p.PackTread(tc, fid.Fid, next, count)
+			if err == nil {
+				err = pl.send(tc)
+			}
+			if err != nil {
+				return done, err
+			}
+			next += uint64(count)
+		}
+		if len(pl.reqs) == 0 {
+			return done, nil
+		}
+
+		r, rc, err := pl.recv()
+		count := r.Tc.Count
+		fid.Clnt.ReqFree(r)
+		if err != nil {
+			return done, err
+		}
+
+		if len(rc.Data) > 0 {
+			err = fn(rc.Data)
+			if err != nil {
+				return done, err
+			}
+			done += int64(len(rc.Data))
+		}
+
+		if uint32(len(rc.Data)) < count {
+			pl.drain()
+			if len(rc.Data) == 0 {
+				return done, nil
+			}
+			next = offset + uint64(done)
+		}
+	}
+}
+
+// Like readPipe, with one read at a time, through ReadContext.
+func (fid *Fid) readEach(offset uint64, max int64, fn func([]byte) error) (int64, error) {
+	var done int64
+	for max < 0 || done < max {
+		count := fid.Iounit
+		if max >= 0 && max-done < int64(count) {
+			count = uint32(max - done)
+		}
+
+		b, err := fid.ReadContext(context.Background(), offset+uint64(done), count)
+		if err != nil || len(b) == 0 {
+			return done, err
+		}
+
+		err = fn(b)
+		if err != nil {
+			return done, err
+		}
+		done += int64(len(b))
+	}
+
+	return done, nil
+}
+
+// Writes the data produced by fn to the fid starting from offset.
+// fn fills the buffer passed to it and returns the number of bytes
+// put there, and io.EOF after the last. Stops at the first error, or
+// at a short write (io.ErrShortWrite); the requests in flight by then
+// may still have written data past the point of failure. Returns the
+// number of bytes written.
+func (fid *Fid) writePipe(offset uint64, fn func([]byte) (int, error)) (int64, error) {
+	fid.cacheForget()
+	defer fid.cacheForget() // the pages read while writing
+	pl := &pipeline{clnt: fid.Clnt}
+	defer pl.drain()
+
+	var done int64
+	var ferr error
+	buf := make([]byte, fid.Iounit)
+	next := offset
+	eof := false
+	for {
+		for !eof && len(pl.reqs) < fid.window() {
+			n, err := fn(buf)
+			if n > 0 {
+				tc := fid.Clnt.NewFcall()
+				err := p.PackTwrite(tc, fid.Fid, next, uint32(n), buf[0:n])
+				if err == nil {
+					err = pl.send(tc)
+				}
+				if err != nil {
+					return done, err
+				}
+				next += uint64(n)
+			}
+
+			if err != nil {
+				eof = true
+				if err != io.EOF {
+					ferr = err
+				}
+			}
+		}
+		if len(pl.reqs) == 0 {
+			return done, ferr
+		}
+
+		r, rc, err := pl.recv()
+		count := r.Tc.Count
+		fid.Clnt.ReqFree(r)
+		if err != nil {
+			return done, err
+		}
+
+		done += int64(rc.Count)
+		if rc.Count < count {
+			return done, io.ErrShortWrite
+		}
+	}
+}
+
+// Reads exactly len(buf) bytes from the File starting from offset, like
+// Readn, but with up to Clnt.Window Treads in flight. Returns the number
+// of bytes read (could be less than len(buf) if end-of-file is reached),
+// or an Error.
+func (file *File) ReadFull(buf []byte, offset uint64) (int, error) {
+	n := 0
+	_, err := file.Fid.readPipe(offset, int64(len(buf)), func(b []byte) error {
+		n += copy(buf[n:], b)
+		return nil
+	})
+
+	return n, err
+}
+
+// Writes exactly len(buf) bytes starting from offset, like Writen, but
+// with up to Clnt.Window Twrites in flight. Returns the number of bytes
+// written. If Error is returned the number of bytes can be less than
+// len(buf).
+func (file *File) WriteFull(buf []byte, offset uint64) (int, error) {
+	n, err := file.Fid.writePipe(offset, func(b []byte) (int, error) {
+		m := copy(b, buf)
+		buf = buf[m:]
+		if len(buf) == 0 {
+			return m, io.EOF
+		}
+
+		return m, nil
+	})
+
+	return int(n), err
+}
+
+// Writes the contents of the File, from its offset to the end, to w.
+// Implements io.WriterTo, so io.Copy from a File is pipelined.
+func (file *File) WriteTo(w io.Writer) (int64, error) {
+	n, err := file.Fid.readPipe(file.Offset, -1, func(b []byte) error {
+		_, err := w.Write(b)
+		return err
+	})
+	file.Offset += uint64(n)
+
+	return n, err
+}
+
+// Writes the data read from r until io.EOF to the File, starting from
+// its offset. Implements io.ReaderFrom, so io.Copy to a File is
+// pipelined.
+func (file *File) ReadFrom(r io.Reader) (int64, error) {
+	n, err := file.Fid.writePipe(file.Offset, func(b []byte) (int, error) {
+		m, err := io.ReadFull(r, b)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+
+		return m, err
+	})
+	file.Offset += uint64(n)
+
+	return n, err
+}
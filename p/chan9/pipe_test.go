@@ -0,0 +1,101 @@
+package chan9
+
+import (
+	"bytes"
+	"code.google.com/p/go9p/p"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	ns := testNS(t, "a", "")
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	file, err := ns.FOpen(ParseName("/a"), p.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.Fid.Clnt.Window = 4
+	if n, err := file.ReadFrom(bytes.NewReader(data)); n != int64(len(data)) || err != nil {
+		t.Fatalf("copy to file: %d %v", n, err)
+	}
+
+	file.Seek(0, io.SeekStart)
+	var out bytes.Buffer
+	if n, err := io.Copy(&out, file); n != int64(len(data)) || err != nil {
+		t.Fatalf("copy from file: %d %v", n, err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("data read differs from data written")
+	}
+
+	buf := make([]byte, 50000)
+	if n, err := file.ReadFull(buf, 60000); n != 40000 || err != nil {
+		t.Errorf("short read: %d %v", n, err)
+	}
+	if !bytes.Equal(buf[:40000], data[60000:]) {
+		t.Errorf("data read at offset differs")
+	}
+
+	if n, err := file.WriteFull(data[:20000], 95000); n != 20000 || err != nil {
+		t.Errorf("write at offset: %d %v", n, err)
+	}
+	if d, err := file.Fid.Stat(); err != nil || d.Length != 115000 {
+		t.Errorf("length after write: %v %v", d, err)
+	}
+}
+
+// A stream, whose reads consume the data whatever their offset and
+// which has no length, isn't read ahead: no data is thrown away.
+func TestPipelineStream(t *testing.T) {
+	var want []byte
+	for i := 0; i < 10; i++ {
+		want = append(want, fmt.Sprintf("line %d\n", i)...)
+	}
+	stream := want
+	clnt, _ := testFakeClnt(t, func(tc, rc *p.Fcall) bool {
+		qid := p.Qid{Path: 1}
+		switch tc.Type {
+		case p.Tattach:
+			p.PackRattach(rc, &qid)
+		case p.Topen:
+			p.PackRopen(rc, &qid, 0)
+		case p.Tstat:
+			p.PackRstat(rc, &p.Dir{Qid: qid, Mode: 0444, Name: "cons"}, false)
+		case p.Tread:
+			n := len(stream)
+			if n > 7 {
+				n = 7
+			}
+			p.PackRread(rc, stream[:n])
+			stream = stream[n:]
+		default:
+			p.PackRclunk(rc)
+		}
+		return true
+	})
+	defer clnt.Clunk(nil)
+	clnt.Window = 4
+	fid, err := clnt.Attach(nil, clnt.User, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fid.Open(p.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	file := &File{Fid: fid}
+	defer file.Close()
+
+	var out bytes.Buffer
+	if n, err := io.Copy(&out, file); n != int64(len(want)) || err != nil {
+		t.Errorf("copy from stream: %d %v", n, err)
+	}
+	if out.String() != string(want) {
+		t.Errorf("read %q, expected %q", out.String(), want)
+	}
+}
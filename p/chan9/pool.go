@@ -5,8 +5,14 @@
 package chan9
 
 import "code.google.com/p/go9p/p"
+import "context"
 import "fmt"
-import "os"
+
+// Most fids a namespace (with the ones forked from it) has at once, and
+// most requests a client has outstanding, unless changed by
+// Namespace.SetMaxFids and Clnt.SetMaxReqs.
+var DefaultMaxFids = 1 << 16
+var DefaultMaxReqs = 1 << 12
 
 var m2id = [...]uint8{
 	0, 1, 0, 2, 0, 1, 0, 3,
@@ -43,19 +49,68 @@ var m2id = [...]uint8{
 	0, 1, 0, 2, 0, 1, 0, 0,
 }
 
-func newPool(maxid uint32) *pool {
+func newPool(maxid uint32, max int) *pool {
 	p := new(pool)
 	p.maxid = maxid
-	p.nchan = make(chan uint32)
+	p.setMax(max)
 
 	return p
 }
 
-func (p *pool) getId() uint32 {
-	var n uint32 = 0
-	var ret uint32
+// Sets the most ids handed out at once. 0 (or less) means
+// as many as there are ids below maxid.
+func (p *pool) setMax(max int) {
+	p.Lock()
+	if max <= 0 || uint64(max) > uint64(p.maxid) {
+		max = int(p.maxid)
+	}
+	p.max = max
+	if p.wait != nil { // some may fit now
+		close(p.wait)
+		p.wait = nil
+	}
+	p.Unlock()
+}
+
+/* Returns the lowest id not in use. If max ids are in use, waits
+ * for one to be put back, or until ctx is done and returns ctx.Err()
+ * then. If over is set, max is ignored, so it only waits once all
+ * the ids below maxid are in use.
+ */
+func (p *pool) getId(ctx context.Context, over bool) (uint32, error) {
+	waited := false
 
 	p.Lock()
+	for {
+		limit := p.max
+		if over {
+			limit = int(p.maxid)
+		}
+		if p.inuse < limit {
+			break
+		}
+		if p.wait == nil {
+			p.wait = make(chan bool)
+		}
+		wait := p.wait
+		if !waited {
+			waited = true
+			p.waits++
+		}
+		p.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			p.Lock()
+			p.fails++
+			p.Unlock()
+			return 0, ctx.Err()
+		}
+		p.Lock()
+	}
+
+	// with fewer than maxid ids in use, the lowest free one is below maxid
+	var n uint32
 	for n = 0; n < uint32(len(p.imap)); n++ {
 		if p.imap[n] != 0xFF {
 			break
@@ -73,33 +128,39 @@ func (p *pool) getId() uint32 {
 		p.imap = b
 	}
 
-	if n >= uint32(len(p.imap)) {
-		p.need++
-		p.Unlock()
-		ret = <-p.nchan
-	} else {
-		ret = uint32(m2id[p.imap[n]])
-		p.imap[n] |= 1 << ret
-		ret += n * 8
-		p.Unlock()
+	ret := uint32(m2id[p.imap[n]])
+	p.imap[n] |= 1 << ret
+	ret += n * 8
+	p.inuse++
+	if p.inuse > p.peak {
+		p.peak = p.inuse
 	}
+	p.gets++
+	p.Unlock()
 
-	return ret
+	return ret, nil
 }
 
+// Puts an id back. Ids not handed out, like NOFID, are ignored.
 func (pl *pool) putId(id uint32) {
-	if id == p.NOFID {
-		fmt.Fprintf(os.Stderr, "Error! Tried to free unopened file.\n")
-		return
-	}
 	pl.Lock()
-	if pl.need > 0 {
-		pl.nchan <- id
-		pl.need--
-		pl.Unlock()
+	defer pl.Unlock()
+	if id == p.NOFID || id/8 >= uint32(len(pl.imap)) || pl.imap[id/8]&(1<<(id%8)) == 0 {
 		return
 	}
 
 	pl.imap[id/8] &= ^(1 << (id % 8))
-	pl.Unlock()
+	pl.inuse--
+	if pl.wait != nil {
+		close(pl.wait)
+		pl.wait = nil
+	}
+}
+
+// Describes the usage of the pool, for the stats pages.
+func (p *pool) stats() string {
+	p.Lock()
+	defer p.Unlock()
+	return fmt.Sprintf("%d in use (at most %d so far, limit %d), %d handed out, %d waited for, %d given up",
+		p.inuse, p.peak, p.max, p.gets, p.waits, p.fails)
 }
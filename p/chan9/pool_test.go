@@ -0,0 +1,121 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxFids(t *testing.T) {
+	ns := testNS(t, "a", "x")
+	defer ns.Close()
+	ns.fidpool.Lock()
+	inuse := ns.fidpool.inuse
+	ns.fidpool.Unlock()
+	ns.SetMaxFids(inuse + 1)
+
+	a, err := ns.FWalk(ParseName("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := ns.FWalkContext(ctx, ParseName("/a")); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// waits for a to be clunked
+	done := make(chan error)
+	go func() {
+		fid, err := ns.FWalk(ParseName("/a"))
+		if err == nil {
+			fid.Clunk()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("walk past the limit returned %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	a.Clunk()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	_, page := testGet(fmt.Sprintf("/go9p/clnt/%d", ns.Root.Clnt.Dev))
+	want := fmt.Sprintf("%d in use (at most %d so far, limit %d)", inuse, inuse+1, inuse+1)
+	if !strings.Contains(page, want) || !strings.Contains(page, "2 waited for, 1 given up") {
+		t.Errorf("fid usage not shown:\n%s", page)
+	}
+}
+
+func TestMaxReqs(t *testing.T) {
+	clnt, _ := testFakeClnt(t, func(tc, rc *p.Fcall) bool {
+		switch tc.Type {
+		case p.Tread: // hang
+			return false
+		case p.Tflush:
+			p.PackRflush(rc)
+		case p.Tremove:
+			p.PackRremove(rc)
+		default:
+			p.PackRclunk(rc)
+		}
+		return true
+	})
+	defer clnt.Clunk(nil)
+	clnt.SetMaxReqs(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		tc := clnt.NewFcall()
+		p.PackTread(tc, 1, 0, 100)
+		_, err := clnt.RpcContext(ctx, tc)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tctx, tcancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer tcancel()
+	tc := clnt.NewFcall()
+	p.PackTremove(tc, 1)
+	if _, err := clnt.RpcContext(tctx, tc); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	tc = clnt.NewFcall()
+	p.PackTclunk(tc, 1) // never waits
+	if _, err := clnt.Rpc(tc); err != nil {
+		t.Error(err)
+	}
+
+	// waits for the read to be flushed
+	removed := make(chan error)
+	go func() {
+		tc := clnt.NewFcall()
+		p.PackTremove(tc, 1)
+		_, err := clnt.Rpc(tc)
+		removed <- err
+	}()
+	select {
+	case err := <-removed:
+		t.Fatalf("request past the limit returned %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if err := <-removed; err != nil {
+		t.Error(err)
+	}
+
+	_, page := testGet(fmt.Sprintf("/go9p/clnt/%d", clnt.Dev))
+	if !strings.Contains(page, "limit 1), 4 handed out, 2 waited for, 1 given up") {
+		t.Errorf("tag usage not shown:\n%s", page)
+	}
+}
@@ -4,6 +4,7 @@
 
 package chan9
 
+import "context"
 import "io"
 import "code.google.com/p/go9p/p"
 import "syscall"
@@ -12,17 +13,31 @@ import "syscall"
 // Returns a slice with the data read, if the operation was successful, or an
 // Error.
 func (fid *Fid) Read(offset uint64, count uint32) ([]byte, error) {
+	return fid.ReadContext(context.Background(), offset, count)
+}
+
+// Like Read, but the read is flushed and ctx.Err() returned if the
+// context is done before the server answers.
+func (fid *Fid) ReadContext(ctx context.Context, offset uint64, count uint32) ([]byte, error) {
 	if count > fid.Iounit {
 		count = fid.Iounit
 	}
+	if fid.cached() {
+		return Mcache.read(ctx, fid, offset, count)
+	}
+
+	return fid.read(ctx, offset, count)
+}
 
+// Reads from the server, bypassing the cache.
+func (fid *Fid) read(ctx context.Context, offset uint64, count uint32) ([]byte, error) {
 	tc := fid.Clnt.NewFcall()
 	err := p.PackTread(tc, fid.Fid, offset, count)
 	if err != nil {
 		return nil, err
 	}
 
-	rc, err := fid.Clnt.Rpc(tc)
+	rc, err := fid.Clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
@@ -52,7 +67,7 @@ func (file *File) ReadAt(buf []byte, offset int64) (int, error) {
 		return 0, err
 	}
 
-	if len(b) == 0 {
+	if len(b) == 0 && len(buf) > 0 {
 		return 0, io.EOF
 	}
 
@@ -83,38 +98,99 @@ func (file *File) Readn(buf []byte, offset uint64) (int, error) {
 	return ret, nil
 }
 
-/* TODO: make seek rewind dir-s
-func (file *File) Seek(off int) error {
-	if file.Fid.prev != nil {
-		file.MReset()
+// Sets the offset for the next Read or Write to offset, interpreted
+// according to whence: io.SeekStart means relative to the start of
+// the file, io.SeekCurrent relative to the current offset and
+// io.SeekEnd relative to the end (the length is found by Stat).
+// Returns the new offset, or an Error. Directories can only be
+// rewound to offset 0; a union directory starts over with its
+// first member.
+func (file *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(file.Offset)
+	case io.SeekEnd:
+		d, err := file.Fid.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(d.Length)
+	default:
+		return 0, Ebadseek
+	}
+	if offset < 0 {
+		return 0, Ebadseek
+	}
+
+	if file.Fid.Qid.Type&p.QTDIR != 0 {
+		if offset != 0 {
+			return 0, Ebadseek
+		}
+
+		file.dirs = nil
+		file.seen = nil
+		if file.Fid.prev != nil {
+			mode := file.Fid.Mode
+			fid, err := file.Fid.MReset()
+			if err != nil {
+				return 0, err
+			}
+			file.Fid = fid
+			err = fid.Open(mode)
+			if err != nil {
+				return 0, err
+			}
+		}
 	}
-} */
+
+	file.Offset = uint64(offset)
+	return offset, nil
+}
 
 // Reads the content of the directory associated with the File.
 // Returns an array of maximum num entries (if num is 0, returns
 // all entries from the directory). If the operation fails, returns
 // an Error.
+// The members of a union are read one after the other. If
+// file.Unique is set, a name found in several members is only
+// listed from the first, which is the one Namespace.Walk finds.
 func (file *File) Readdir(num int) ([]*p.Dir, error) {
+	dirs := file.dirs
+	file.dirs = nil
+	if dirs == nil {
+		dirs = make([]*p.Dir, 0, 32)
+	}
+
 	buf := make([]byte, file.Fid.Clnt.Msize-p.IOHDRSZ)
-	dirs := make([]*p.Dir, 32)
-	pos := 0
-	for {
-		n, err := file.Read(buf)
+	for num == 0 || len(dirs) < num {
+		var n int
+		var err error
+		if file.Fid.Clnt.Dotl {
+			n, err = file.lreaddir(buf)
+		} else {
+			n, err = file.Read(buf)
+		}
 		if err != nil && err != io.EOF {
+			file.dirs = dirs
 			return nil, err
 		}
 
 		if n == 0 {
-			if file.Fid.next == nil {
+			next := file.Fid.mnext()
+			if next == nil {
 				break
 			}
-			fid, err := file.Fid.next.Clone(true)
+			fid, err := next.Clone(true)
+			next.decref()
 			if err != nil {
+				file.dirs = dirs
 				return nil, err
 			}
 			err = fid.Open(p.OREAD)
 			if err != nil {
 				fid.Clunk()
+				file.dirs = dirs
 				return nil, err
 			}
 			file.Fid.Clunk()
@@ -135,18 +211,23 @@ func (file *File) Readdir(num int) ([]*p.Dir, error) {
 			}
 
 			b = b[d.Size+2 : len(b)]
-			if pos >= len(dirs) {
-				s := make([]*p.Dir, len(dirs)+32)
-				copy(s, dirs)
-				dirs = s
-			}
-
-			dirs[pos] = d
-			pos++
-			if num != 0 && pos >= num {
-				break
+			if file.Unique && (file.Fid.next != nil || file.Fid.prev != nil) {
+				if file.seen == nil {
+					file.seen = make(map[string]bool)
+				}
+				if file.seen[d.Name] {
+					continue
+				}
+				file.seen[d.Name] = true
 			}
+			dirs = append(dirs, d)
 		}
 	}
-	return dirs[0:pos], nil
+
+	if num != 0 && len(dirs) > num {
+		file.dirs = dirs[num:]
+		dirs = dirs[0:num]
+	}
+
+	return dirs, nil
 }
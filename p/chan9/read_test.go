@@ -0,0 +1,97 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFileSeek(t *testing.T) {
+	ns := testNS(t, "a", "hello", "d/", "", "d/b", "", "d/c", "")
+
+	file, err := ns.FOpen(ParseName("/a"), p.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if file.Name() != "/a" {
+		t.Errorf("bad name %q", file.Name())
+	}
+	if off, err := file.Seek(-1, io.SeekEnd); off != 4 || err != nil {
+		t.Errorf("seek from end: %d %v", off, err)
+	}
+	if off, err := file.Seek(-3, io.SeekCurrent); off != 1 || err != nil {
+		t.Errorf("seek from current: %d %v", off, err)
+	}
+	if buf, err := io.ReadAll(file); string(buf) != "ello" || err != nil {
+		t.Errorf("read after seek: %q %v", buf, err)
+	}
+
+	dir, err := ns.FOpen(ParseName("/d"), p.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	for i := 0; i < 2; i++ {
+		if ents, err := dir.ReadDir(1); len(ents) != 1 || err != nil {
+			t.Errorf("readdir %d: %v %v", i, ents, err)
+		}
+	}
+	if ents, err := dir.ReadDir(1); len(ents) != 0 || err != io.EOF {
+		t.Errorf("readdir at end: %v %v", ents, err)
+	}
+	if _, err = dir.Seek(1, io.SeekStart); err != Ebadseek {
+		t.Errorf("seek in directory: %v", err)
+	}
+	if _, err = dir.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if ents, err := dir.ReadDir(-1); len(ents) != 2 || err != nil {
+		t.Errorf("readdir after rewind: %v %v", ents, err)
+	}
+}
+
+func TestUnionReaddir(t *testing.T) {
+	ns := testNS(t, "d/", "", "d/a", "1", "d/x", "1", "e/", "", "e/b", "2", "e/x", "22",
+		"f/", "", "f/x", "333", "f/y", "3")
+	if err := ns.Bind("/e", "/d", p.MAFTER); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Bind("/f", "/d", p.MAFTER); err != nil {
+		t.Fatal(err)
+	}
+	file, err := ns.FOpen(ParseName("/d"), p.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	list := func() (names []string) {
+		for {
+			dirs, err := file.Readdir(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dirs) == 0 {
+				return
+			}
+			for _, d := range dirs {
+				names = append(names, fmt.Sprintf("%s=%d", d.Name, d.Length))
+			}
+		}
+	}
+	if names := list(); len(names) != 6 {
+		t.Errorf("listing: %v", names)
+	}
+
+	file.Unique = true
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	want := "a=1 x=1 b=1 y=1"
+	if names := strings.Join(list(), " "); names != want {
+		t.Errorf("unique listing: %q, want %q", names, want)
+	}
+}
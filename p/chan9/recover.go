@@ -0,0 +1,379 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chan9
+
+/*  Connection recovery.
+    If Clnt.Reconnect is set, a client that was created by Dial (or
+    DialOpts) survives the loss of its connection: the address is redialed,
+    Tversion, Tauth and Tattach are redone and every fid walked on
+    the server is walked again along its Cname (and reopened in its
+    Mode, if it was open). Pending requests that can safely be repeated
+    are resent, the others fail. Fids that can't be recovered return
+    Estale from then on, and can only be clunked.
+*/
+
+import (
+	"code.google.com/p/go9p/p"
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+var Estale error = &p.Error{"stale fid", p.ESTALE}
+
+// Time to wait between redial attempts (multiplied by the attempt number).
+var ReconnectDelay = 500 * time.Millisecond
+
+// Remember a fid, so it can be recovered.
+func (clnt *Clnt) track(fid *Fid) {
+	clnt.Lock()
+	clnt.fids[fid.Fid] = fid
+	clnt.Unlock()
+}
+
+// Forget a fid. Returns true if the fid was stale.
+func (clnt *Clnt) untrack(fid *Fid) bool {
+	clnt.Lock()
+	delete(clnt.fids, fid.Fid)
+	stale := clnt.stale[fid.Fid]
+	delete(clnt.stale, fid.Fid)
+	clnt.Unlock()
+	return stale
+}
+
+// Called with the lock held. Returns true if the request uses a
+// stale fid.
+func (clnt *Clnt) isStale(tc *p.Fcall) bool {
+	if len(clnt.stale) == 0 {
+		return false
+	}
+
+	switch tc.Type {
+	case p.Tversion, p.Tauth, p.Tattach, p.Tflush:
+		return false
+	case p.Tlink, p.Trename, p.Trenameat:
+		if clnt.stale[tc.Fid2] {
+			return true
+		}
+	}
+
+	return clnt.stale[tc.Fid]
+}
+
+// Returns true if the request can be sent again after a reconnect
+// without changing its effect.
+func idempotent(tc *p.Fcall) bool {
+	switch tc.Type {
+	case p.Twalk, p.Tread, p.Tstat, p.Tclunk,
+		p.Tgetattr, p.Treaddir, p.Treadlink, p.Tstatfs:
+		return true
+	case p.Topen:
+		return tc.Mode&(p.OTRUNC|p.ORCLOSE) == 0
+	case p.Tlopen:
+		return tc.Lflags&p.LOTRUNC == 0
+	}
+
+	return false
+}
+
+// Called by recv when reading from conn failed. Returns true if recv
+// should quit without tearing down the client, because a recovery was
+// started, conn was replaced already or the client is torn down.
+func (clnt *Clnt) tryRecover(conn net.Conn, cause error) bool {
+	clnt.Lock()
+	if clnt.conn != conn || clnt.err != nil {
+		clnt.Unlock()
+		return true
+	}
+
+	if clnt.Reconnect <= 0 || clnt.dial == nil || clnt.recovering != nil {
+		clnt.Unlock()
+		return false
+	}
+
+	// The requests not taken by send yet are sent again by recover
+	// once the connection is back, not by send on the new one.
+	clnt.recovering = make(chan bool)
+	pending := clnt.reqs
+	clnt.reqs = make(map[uint16]*Req)
+	for _, r := range pending {
+		r.lost = true
+	}
+	clnt.Unlock()
+
+	conn.Close()
+	go clnt.recover(pending, cause)
+	return true
+}
+
+func (clnt *Clnt) recover(pending map[uint16]*Req, cause error) {
+	err := clnt.redial()
+	if err == nil {
+		err = clnt.reattach()
+	}
+
+	clnt.Lock()
+	done := clnt.recovering
+	clnt.recovering = nil
+	clnt.Unlock()
+	close(done)
+
+	lost := &p.Error{"connection lost: " + cause.Error(), p.EIO}
+	for _, r := range pending {
+		e := error(lost)
+		if err == nil && idempotent(r.Tc) {
+			<-r.written // by send, on the old connection or not at all
+			e = clnt.Rpcnb(r)
+		}
+
+		if e != nil {
+			r.Err = e
+			if r.Done != nil {
+				r.Done <- r
+			}
+		}
+	}
+
+	if err != nil {
+		rm(clnt, &p.Error{lost.Err + ", recovery failed: " + err.Error(), p.EIO})
+	}
+}
+
+// Sends a request while the client is recovering.
+func (clnt *Clnt) recoverRpc(tc *p.Fcall) (*p.Fcall, error) {
+	r := clnt.ReqAlloc()
+	r.Tc = tc
+	r.Done = make(chan *Req, 1)
+	r.recover = true
+	err := clnt.Rpcnb(r)
+	if err != nil {
+		clnt.ReqFree(r)
+		return nil, err
+	}
+
+	<-r.Done
+	rc, err := r.Rc, r.Err
+	clnt.ReqFree(r)
+	return rc, err
+}
+
+// Redials the address and renegotiates the version. The dialect
+// spoken has to stay the same.
+func (clnt *Clnt) redial() error {
+	var err error
+	var c net.Conn
+
+	for i := 0; i < clnt.Reconnect; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * ReconnectDelay)
+		}
+
+		c, err = clnt.dial()
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	clnt.Lock()
+	if clnt.err != nil {
+		clnt.Unlock()
+		c.Close()
+		return clnt.err
+	}
+	clnt.conn = c
+	clnt.Unlock()
+	go recv(clnt)
+
+	tc := clnt.NewFcall()
+	err = p.PackTversion(tc, clnt.Msize, clnt.ver)
+	if err != nil {
+		return err
+	}
+
+	rc, err := clnt.recoverRpc(tc)
+	if err != nil {
+		return err
+	}
+
+	ver := p.VERSION
+	if clnt.Dotl {
+		ver = p.VERSIONL
+	} else if clnt.Dotu {
+		ver = p.VERSIONU
+	}
+	if rc.Version != ver {
+		return &p.Error{"server changed version to " + rc.Version, p.EIO}
+	}
+
+	if rc.Msize < clnt.Msize {
+		clnt.Msize = rc.Msize
+	}
+
+	return nil
+}
+
+// Attaches again and recovers all fids walked on the server.
+func (clnt *Clnt) reattach() error {
+	afno := uint32(p.NOFID)
+	if clnt.Reauth != nil {
+		// Not clunked with Fid.Clunk, it would wait for the recovery.
+		afid, err := clnt.fidAlloc(context.Background(), true)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if afid.walked {
+				clnt.recoverClunk(afid.Fid)
+			}
+			clnt.untrack(afid)
+			clnt.fidpool.putId(afid.Fid)
+			clnt.decref()
+		}()
+
+		tc := clnt.NewFcall()
+		err = p.PackTauth(tc, afid.Fid, clnt.User.Name(), clnt.aname, uint32(clnt.User.Id()), clnt.Dotu)
+		if err != nil {
+			return err
+		}
+
+		rc, err := clnt.recoverRpc(tc)
+		if err != nil {
+			return err
+		}
+
+		afid.Qid = rc.Qid
+		afid.walked = true
+		afid.setIounit(0)
+		clnt.Lock()
+		clnt.rauth = afid.Fid
+		clnt.Unlock()
+		err = clnt.Reauth(afid)
+		clnt.Lock()
+		clnt.rauth = p.NOFID
+		clnt.Unlock()
+		if err != nil {
+			return err
+		}
+		afno = afid.Fid
+	}
+
+	root, err := clnt.fidpool.getId(context.Background(), true)
+	if err != nil {
+		return err
+	}
+	defer clnt.fidpool.putId(root)
+	tc := clnt.NewFcall()
+	err = p.PackTattach(tc, root, afno, clnt.User.Name(), clnt.aname, uint32(clnt.User.Id()), clnt.Dotu)
+	if err != nil {
+		return err
+	}
+
+	rc, err := clnt.recoverRpc(tc)
+	if err != nil {
+		return err
+	}
+	rootqid := rc.Qid
+
+	clnt.Lock()
+	fids := make([]*Fid, 0, len(clnt.fids))
+	for _, fid := range clnt.fids {
+		if fid.walked && !clnt.stale[fid.Fid] && fid.Fid != afno {
+			fids = append(fids, fid)
+		}
+	}
+	clnt.Unlock()
+
+	for _, fid := range fids {
+		if !clnt.recoverFid(fid, root, rootqid) {
+			clnt.Lock()
+			clnt.stale[fid.Fid] = true
+			clnt.Unlock()
+		}
+	}
+
+	tc = clnt.NewFcall()
+	err = p.PackTclunk(tc, root)
+	if err == nil {
+		_, err = clnt.recoverRpc(tc)
+	}
+
+	return err
+}
+
+// Walks the fid from the root fid along its Cname and reopens it.
+// Returns false if the fid no longer refers to the same file.
+func (clnt *Clnt) recoverFid(fid *Fid, root uint32, rootqid p.Qid) bool {
+	if fid.xattr || fid.Qid.Type&p.QTAUTH != 0 {
+		return false
+	}
+
+	// Mount roots start with the server's name, see Namespace.Mount.
+	wnames := fid.Cname
+	if len(wnames) > 0 && strings.HasSuffix(wnames[0], "!") {
+		wnames = wnames[1:]
+	}
+
+	from := root
+	qid := rootqid
+	for first := true; first || len(wnames) > 0; first = false {
+		n := len(wnames)
+		if n > 16 {
+			n = 16
+		}
+
+		tc := clnt.NewFcall()
+		if p.PackTwalk(tc, from, fid.Fid, wnames[:n]) != nil {
+			return false
+		}
+		rc, err := clnt.recoverRpc(tc)
+		if err != nil || len(rc.Wqid) != n {
+			if err == nil && from == fid.Fid {
+				clnt.recoverClunk(fid.Fid)
+			}
+			return false
+		}
+		if n > 0 {
+			qid = rc.Wqid[n-1]
+		}
+
+		from = fid.Fid
+		wnames = wnames[n:]
+	}
+
+	if qid.Path != fid.Qid.Path || qid.Type != fid.Qid.Type {
+		clnt.recoverClunk(fid.Fid)
+		return false
+	}
+
+	if !fid.opened {
+		return true
+	}
+
+	tc := clnt.NewFcall()
+	if clnt.Dotl {
+		p.PackTlopen(tc, fid.Fid, p.Omode2Lflags(fid.Mode)&^p.LOTRUNC)
+	} else {
+		p.PackTopen(tc, fid.Fid, fid.Mode&^(p.OTRUNC|p.ORCLOSE))
+	}
+	rc, err := clnt.recoverRpc(tc)
+	if err != nil {
+		clnt.recoverClunk(fid.Fid)
+		return false
+	}
+
+	fid.setIounit(rc.Iounit)
+	return true
+}
+
+func (clnt *Clnt) recoverClunk(fidno uint32) {
+	tc := clnt.NewFcall()
+	if p.PackTclunk(tc, fidno) == nil {
+		clnt.recoverRpc(tc)
+	}
+}
@@ -0,0 +1,185 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A file server with the files "a" and "b" in its root. The connections
+// are passed on conns; after the first connection "b" is gone.
+func recoverServer(t *testing.T, l net.Listener, conns chan net.Conn) {
+	for gen := 0; ; gen++ {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conns <- c
+		gone := gen > 0
+		go fakeServer(t, c, func(tc, rc *p.Fcall) bool {
+			switch tc.Type {
+			case p.Tattach:
+				p.PackRattach(rc, &p.Qid{p.QTDIR, 0, 1})
+			case p.Twalk:
+				wqids := make([]p.Qid, 0)
+				for _, name := range tc.Wname {
+					if name != "a" && (name != "b" || gone) {
+						break
+					}
+					wqids = append(wqids, p.Qid{0, 0, uint64(name[0])})
+				}
+				if len(tc.Wname) > 0 && len(wqids) == 0 {
+					p.PackRerror(rc, "file not found", uint32(p.ENOENT), true)
+				} else {
+					p.PackRwalk(rc, wqids)
+				}
+			case p.Topen:
+				p.PackRopen(rc, &p.Qid{0, 0, 'a'}, 0)
+			case p.Tread:
+				p.PackRread(rc, []byte("data"))
+			default:
+				p.PackRclunk(rc)
+			}
+			return true
+		})
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conns := make(chan net.Conn, 2)
+	go recoverServer(t, l, conns)
+
+	clnt, err := Dial("tcp!" + strings.Replace(l.Addr().String(), ":", "!", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clnt.Clunk(nil)
+	clnt.Reconnect = 2
+	root, err := clnt.Attach(nil, clnt.User, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := root.WalkOne("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Open(p.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	b, err := root.WalkOne("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	(<-conns).Close()
+	buf, err := a.Read(0, 10)
+	if err != nil || string(buf) != "data" {
+		t.Errorf("read after reconnect: %q %v", buf, err)
+	}
+	if _, err = b.Read(0, 10); err != Estale {
+		t.Errorf("expected stale fid, got %v", err)
+	}
+	if err = b.Clunk(); err != nil {
+		t.Errorf("clunk of stale fid: %v", err)
+	}
+}
+
+// A connection whose writes hang once stuck is closed, and fail some
+// time after the connection is closed, as a write to a socket with
+// full buffers can.
+type testStuckConn struct {
+	net.Conn
+	stuck  chan bool
+	closed chan bool
+	once   sync.Once
+}
+
+func (c *testStuckConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.stuck:
+		<-c.closed
+		time.Sleep(50 * time.Millisecond)
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	return c.Conn.Write(b)
+}
+
+func (c *testStuckConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// The requests queued when the connection is lost are sent once, on
+// the new connection, by the recovery.
+func TestReconnectQueued(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conns := make(chan net.Conn, 2)
+	go recoverServer(t, l, conns)
+
+	stuck := &testStuckConn{stuck: make(chan bool), closed: make(chan bool)}
+	RegisterNetwork("stuck", func(ctx context.Context, addr string) (net.Conn, error) {
+		c, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+		if err != nil || stuck.Conn != nil {
+			return c, err
+		}
+		stuck.Conn = c
+		return stuck, nil
+	})
+	clnt, err := Dial("stuck!" + strings.Replace(l.Addr().String(), ":", "!", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clnt.Clunk(nil)
+	clnt.Reconnect = 2
+	root, err := clnt.Attach(nil, clnt.User, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Clunk()
+	a, err := root.WalkOne("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Clunk()
+	if err = a.Open(p.OREAD); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first read hangs in send, the others wait for it
+	close(stuck.stuck)
+	done := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			buf, err := a.Read(0, 10)
+			if err == nil && string(buf) != "data" {
+				err = fmt.Errorf("read %q", buf)
+			}
+			done <- err
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	(<-conns).Close()
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("read after reconnect: %v", err)
+		}
+	}
+}
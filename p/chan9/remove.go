@@ -5,39 +5,44 @@
 package chan9
 
 import "code.google.com/p/go9p/p"
-import "syscall"
 
 // Removes the file associated with the Fid. Returns nil if the
-// operation is successful.
+// operation is successful. A union (a directory with files mounted
+// on it) is not removed, Emount is returned.
 func (fid *Fid) Remove() error {
+	if fid.next != nil || fid.prev != nil {
+		fid.Clunk()
+		return Emount
+	}
 	tc := fid.Clnt.NewFcall()
 	err := p.PackTremove(tc, fid.Fid)
 	if err != nil {
+		fid.Clunk()
 		return err
 	}
 
-	rc, err := fid.Clnt.Rpc(tc)
-	fid.Clnt.fidpool.putId(fid.Fid)
-	fid.Fid = p.NOFID
-
-	if rc.Type == p.Rerror {
-		return &p.Error{rc.Error, syscall.Errno(rc.Errornum)}
-	}
-
+	// The fid is clunked, even if the remove fails.
+	fid.cacheForget()
+	_, err = fid.Clnt.Rpc(tc)
+	fid.Clnt.untrack(fid)
+	fid.release()
 	return err
 }
 
 // Removes the named file. Returns nil if the operation is successful.
+// In a union, the file removed is the one found first. A mount point
+// (see LsMounts) is not removed, Emount is returned, and a symbolic
+// link is removed rather than its target.
 func (ns *Namespace) FRemove(path Elemlist) error {
 	var err error
-	fid, err := ns.FWalk(path)
+	fid, err := ns.FWalkTo(path)
 	if err != nil {
 		return err
 	}
-	// TODO: check for open mounts and return an error.
-	// ns.Mnt.remove(fid)
+	if len(ns.Mnt.Union(fid.FileID)) > 0 {
+		fid.Clunk()
+		return Emount
+	}
 
-	err = fid.Remove()
-	fid.Clnt.decref()
-	return err
+	return fid.Remove()
 }
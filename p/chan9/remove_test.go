@@ -0,0 +1,56 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"testing"
+)
+
+func TestUnionRemove(t *testing.T) {
+	ns := testNS(t, "d/", "", "e/", "", "e/x", "1", "f/", "", "f/x", "22", "f/y", "3")
+	if err := ns.Bind("/e", "/d", p.MAFTER); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Bind("/f", "/d", p.MAFTER); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, err := ns.FStat(ParseName("/d/x")); err != nil || d.Length != 1 {
+		t.Errorf("stat of /d/x: %v %v", d, err)
+	}
+	if d, err := ns.FStat(ParseName("/d")); err != nil || d.Mode&p.DMDIR == 0 {
+		t.Errorf("stat of the union: %v %v", d, err)
+	}
+
+	if err := ns.FRemove(ParseName("/d/y")); err != nil {
+		t.Errorf("remove of /d/y: %v", err)
+	}
+	if _, err := ns.FStat(ParseName("/f/y")); err == nil {
+		t.Error("/f/y left after the remove of /d/y")
+	}
+	if err := ns.FRemove(ParseName("/d/x")); err != nil {
+		t.Errorf("remove of /d/x: %v", err)
+	}
+	if d, err := ns.FStat(ParseName("/d/x")); err != nil || d.Length != 2 {
+		t.Errorf("stat of /d/x after its remove: %v %v", d, err)
+	}
+
+	if err := ns.FRemove(ParseName("/d")); err != Emount {
+		t.Errorf("remove of a mount point: %v", err)
+	}
+	fid, err := ns.FWalk(ParseName("/d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fid.Remove(); err != Emount {
+		t.Errorf("remove of a union: %v", err)
+	}
+
+	parents, children, err := ns.LsMounts("/d")
+	if err != nil || len(parents) != 0 || len(children) != 2 {
+		t.Errorf("LsMounts(/d): %v %v %v", parents, children, err)
+	}
+	parents, children, err = ns.LsMounts("/e")
+	if err != nil || len(parents) != 1 || len(children) != 0 {
+		t.Errorf("LsMounts(/e): %v %v %v", parents, children, err)
+	}
+}
@@ -5,17 +5,38 @@
 package chan9
 
 import "code.google.com/p/go9p/p"
+import "context"
 import "syscall"
 
 // Returns the metadata for the file associated with the Fid, or an Error.
+// For a union, that of the first member still there (see MFirst).
 func (fid *Fid) Stat() (*p.Dir, error) {
+	return fid.StatContext(context.Background())
+}
+
+// Like Stat, but the stat is flushed and ctx.Err() returned if the
+// context is done before the server answers.
+func (fid *Fid) StatContext(ctx context.Context) (*p.Dir, error) {
+	var d *p.Dir
+
+	err := fid.MFirst(func(f *Fid) (err error) {
+		d, err = f.stat(ctx)
+		return
+	})
+	return d, err
+}
+
+func (fid *Fid) stat(ctx context.Context) (*p.Dir, error) {
+	if fid.Clnt.Dotl {
+		return fid.lstat(ctx)
+	}
 	tc := fid.Clnt.NewFcall()
 	err := p.PackTstat(tc, fid.Fid)
 	if err != nil {
 		return nil, err
 	}
 
-	rc, err := fid.Clnt.Rpc(tc)
+	rc, err := fid.Clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
@@ -23,6 +44,7 @@ func (fid *Fid) Stat() (*p.Dir, error) {
 		return nil, &p.Error{rc.Error, syscall.Errno(rc.Errornum)}
 	}
 
+	fid.cacheValidate(rc.Dir.Qid)
 	return &rc.Dir, nil
 }
 
@@ -39,7 +61,27 @@ func (ns *Namespace) FStat(path Elemlist) (*p.Dir, error) {
 }
 
 // Modifies the data of the file associated with the Fid, or an Error.
+// For a union, that of the first member still there (see MFirst): if
+// it refuses the change, the members it shadows are left alone.
+// A new name is put in the Cname of fid, not of the member renamed.
 func (fid *Fid) Wstat(dir *p.Dir) error {
+	err := fid.MFirst(func(f *Fid) error {
+		return f.wstat(dir)
+	})
+	if err == nil && dir.Name != "" && len(fid.Cname) > 0 {
+		cname := append([]string(nil), fid.Cname...) // may be shared
+		cname[len(cname)-1] = dir.Name
+		fid.Cname = cname
+	}
+
+	return err
+}
+
+func (fid *Fid) wstat(dir *p.Dir) error {
+	fid.cacheForget()
+	if fid.Clnt.Dotl {
+		return fid.lwstat(dir)
+	}
 	tc := fid.Clnt.NewFcall()
 	err := p.PackTwstat(tc, fid.Fid, dir, fid.Clnt.Dotu)
 	if err != nil {
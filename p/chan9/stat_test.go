@@ -0,0 +1,41 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"testing"
+)
+
+// A wstat refused by the first member of a union doesn't change the
+// members it shadows.
+func TestUnionWstat(t *testing.T) {
+	ns := testNS(t, "d/", "ro", "e/", "")
+	defer ns.Close()
+	if err := ns.Bind("/e", "/d", p.MAFTER); err != nil {
+		t.Fatal(err)
+	}
+	mode := func(name string) uint32 {
+		d, err := ns.FStat(ParseName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Mode & 0777
+	}
+
+	fid, err := ns.FWalk(ParseName("/d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Clunk()
+	var d p.Dir
+	d.Null()
+	d.Mode = p.DMDIR | 0755
+	if err := fid.Wstat(&d); err == nil {
+		t.Errorf("wstat of a read-only directory succeeded")
+	}
+	if m := mode("/d"); m != 0555 {
+		t.Errorf("mode of /d %o, expected 0555", m)
+	}
+	if m := mode("/e"); m != 0555 {
+		t.Errorf("shadowed /e changed, mode %o", m)
+	}
+}
@@ -3,14 +3,49 @@ package chan9
 import (
 	"code.google.com/p/go9p/p"
 	"fmt"
+	"html"
 	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func (clnt *Clnt) ServeHTTP(c http.ResponseWriter, r *http.Request) {
 	io.WriteString(c, fmt.Sprintf("<html><body><h1>Client %s</h1>", clnt.Id))
 	defer io.WriteString(c, "</body></html>")
 
+	// pools
+	clnt.Lock()
+	fidpool := clnt.fidpool
+	clnt.Unlock()
+	io.WriteString(c, "<h2>Pools</h2>")
+	io.WriteString(c, fmt.Sprintf("fids (shared by the namespace): %s<br>", fidpool.stats()))
+	io.WriteString(c, fmt.Sprintf("tags (requests outstanding): %s<br>", clnt.tagpool.stats()))
+
+	// fids, with where they were allocated if DbgTrackFids is set.
+	// The names are copied under the lock and the page written out
+	// after, as the reader may be slow and the stacks take a while
+	// to resolve (Fid and alloc don't change once allocated).
+	type fidinfo struct {
+		fid   *Fid
+		cname string
+	}
+	clnt.Lock()
+	fids := make([]fidinfo, 0, len(clnt.fids))
+	for _, fid := range clnt.fids {
+		fids = append(fids, fidinfo{fid, strings.Join(fid.Cname, "/")})
+	}
+	clnt.Unlock()
+	sort.Slice(fids, func(i, j int) bool { return fids[i].fid.Fid < fids[j].fid.Fid })
+	io.WriteString(c, fmt.Sprintf("<h2>%d fids in use</h2>", len(fids)))
+	for _, f := range fids {
+		io.WriteString(c, fmt.Sprintf("<br>%d %s", f.fid.Fid, html.EscapeString(f.cname)))
+		if stk := f.fid.allocStack(); stk != "" {
+			io.WriteString(c, "<pre>"+html.EscapeString(stk)+"</pre>")
+		}
+	}
+
 	// fcalls
 	if clnt.Debuglevel&DbgLogFcalls != 0 {
 		fs := clnt.Log.Filter(clnt, DbgLogFcalls)
@@ -24,33 +59,70 @@ func (clnt *Clnt) ServeHTTP(c http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Serves the list of the clients at /go9p/clnt, and the page of each
+// at /go9p/clnt/dev, dev being its Dev.
 func (clnts *ClntList) ServeHTTP(c http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/go9p/clnt"), "/")
+	if name != "" {
+		dev, err := strconv.ParseUint(name, 10, 32)
+		clnts.Lock()
+		clnt := clnts.stats[uint32(dev)]
+		clnts.Unlock()
+		if err != nil || clnt == nil {
+			http.NotFound(c, r)
+			return
+		}
+
+		clnt.ServeHTTP(c, r)
+		return
+	}
+
 	io.WriteString(c, fmt.Sprintf("<html><body>"))
 	defer io.WriteString(c, "</body></html>")
 
+	type clntinfo struct {
+		dev uint32
+		id  string
+	}
 	clnts.Lock()
-	if len(clnts.c) == 0 {
-		io.WriteString(c, "no clients")
+	cl := make([]clntinfo, 0, len(clnts.stats))
+	for dev, clnt := range clnts.stats {
+		cl = append(cl, clntinfo{dev, clnt.Id})
 	}
+	clnts.Unlock()
 
-	for dev, clnt := range clnts.c {
-		io.WriteString(c, fmt.Sprintf("<a href='/go9p/clnt/%s'>%s(%d)</a><br>", clnt.Id, clnt.Id,dev))
+	if len(cl) == 0 {
+		io.WriteString(c, "no clients")
+	}
+	sort.Slice(cl, func(i, j int) bool { return cl[i].dev < cl[j].dev })
+	for _, ci := range cl {
+		id := html.EscapeString(ci.id)
+		io.WriteString(c, fmt.Sprintf("<a href='/go9p/clnt/%d'>%s(%d)</a><br>", ci.dev, id, ci.dev))
 	}
-	clnts.Unlock()
 }
 
+// The pages are keyed by Dev, unique to each client, and served by
+// the handler of the ClntList, so a client can come and go any
+// number of times under the same Id.
 func (clnt *Clnt) statsRegister() {
-	http.Handle("/go9p/clnt/"+clnt.Id, clnt)
+	clnts.Lock()
+	clnts.stats[clnt.Dev] = clnt
+	clnts.Unlock()
 }
 
 func (clnt *Clnt) statsUnregister() {
-	http.HandleFunc("/go9p/clnt/"+clnt.Id, http.NotFound)
+	clnts.Lock()
+	delete(clnts.stats, clnt.Dev)
+	clnts.Unlock()
 }
 
 func (c *ClntList) statsRegister() {
 	http.Handle("/go9p/clnt", c)
+	http.Handle("/go9p/clnt/", c)
 }
 
 func (c *ClntList) statsUnregister() {
-	http.HandleFunc("/go9p/clnt", http.NotFound)
+	c.Lock()
+	c.stats = make(map[uint32]*Clnt)
+	c.Unlock()
 }
@@ -0,0 +1,174 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the status and body of the page at path of the stats
+// server.
+func testGet(path string) (int, string) {
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestFidLeaks(t *testing.T) {
+	clnt := testConnect(t, testSrv(t, "a", "x"))
+	clnt.Debuglevel = DbgTrackFids
+	ns, err := NSFromClnt(clnt, nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.FWalk(ParseName("/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	page := fmt.Sprintf("/go9p/clnt/%d", clnt.Dev)
+	if _, list := testGet("/go9p/clnt"); !strings.Contains(list, "'"+page+"'") {
+		t.Errorf("client not listed:\n%s", list)
+	}
+	if _, body := testGet(page); !strings.Contains(body, "TestFidLeaks") {
+		t.Errorf("leak not shown:\n%s", body)
+	}
+	err = ns.Close()
+	if err == nil || !strings.Contains(err.Error(), "1 fids not clunked") || !strings.Contains(err.Error(), "TestFidLeaks") {
+		t.Errorf("leak not reported: %v", err)
+	}
+
+	clnt = testConnect(t, testSrv(t, "a", "x"))
+	clnt.Debuglevel = DbgTrackFids
+	root, err := clnt.Attach(nil, clnt.User, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = clnt.Clunk(nil)
+	if err == nil || !strings.Contains(err.Error(), "TestFidLeaks") {
+		t.Errorf("leak not reported: %v", err)
+	}
+	root.Clunk()
+
+	// an attach refused leaves no fid behind
+	clnt, _ = testFakeClnt(t, func(tc, rc *p.Fcall) bool {
+		p.PackRerror(rc, "no", uint32(p.EPERM), false)
+		return true
+	})
+	if _, err := clnt.Attach(nil, clnt.User, ""); err == nil {
+		t.Errorf("attach succeeded")
+	}
+	page = fmt.Sprintf("/go9p/clnt/%d", clnt.Dev)
+	if code, _ := testGet(page); code != http.StatusOK {
+		t.Errorf("%s: %d", page, code)
+	}
+	if err := clnt.Clunk(nil); err != nil {
+		t.Error(err)
+	}
+	if code, _ := testGet(page); code != http.StatusNotFound {
+		t.Errorf("%s of a client gone: %d", page, code)
+	}
+}
+
+// Clients of the same address come and go without their stats pages
+// getting in each other's way.
+func TestSameAddr(t *testing.T) {
+	addr := testListen(t, testSrv(t, "a", "hello"))
+	for i := 0; i < 2; i++ {
+		var nss []*Namespace
+		for j := 0; j < 2; j++ {
+			clnt, err := Dial(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns, err := NSFromClnt(clnt, nil, 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			nss = append(nss, ns)
+		}
+		if nss[0].Root.Clnt.Id != nss[1].Root.Clnt.Id {
+			t.Errorf("ids %q and %q", nss[0].Root.Clnt.Id, nss[1].Root.Clnt.Id)
+		}
+		for _, ns := range nss {
+			if err := ns.Close(); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+// A ResponseWriter that tells of each write on waiting, and makes it
+// wait for release.
+type testStalledWriter struct {
+	*httptest.ResponseRecorder
+	waiting, release chan bool
+}
+
+func (w testStalledWriter) Write(b []byte) (int, error) {
+	w.waiting <- true
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
+
+func (w testStalledWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// A reader of the page that doesn't keep up holds up no fid.
+func TestStatsStalled(t *testing.T) {
+	clnt := testConnect(t, testSrv(t, "a", "x"))
+	clnt.Debuglevel = DbgTrackFids
+	root, err := clnt.Attach(nil, clnt.User, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := testStalledWriter{httptest.NewRecorder(), make(chan bool), make(chan bool)}
+	served := make(chan bool)
+	go func() {
+		clnt.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		close(served)
+	}()
+	// let the title and the pools out, and stall on the fids
+	for i := 0; i < 4; i++ {
+		<-w.waiting
+		w.release <- true
+	}
+	<-w.waiting
+
+	done := make(chan error)
+	go func() {
+		fid := clnt.FidAlloc()
+		if _, err := root.Walk(fid, []string{"a"}); err != nil {
+			done <- err
+			return
+		}
+		done <- fid.Clunk()
+	}()
+	select {
+	case err = <-done:
+		done = nil
+	case <-time.After(5 * time.Second):
+		t.Error("walk held up by the stats page")
+	}
+
+	close(w.release)
+	go func() {
+		for range w.waiting {
+		}
+	}()
+	<-served
+	close(w.waiting)
+	if done != nil {
+		err = <-done
+	}
+	if err != nil {
+		t.Error(err)
+	}
+	root.Clunk()
+	clnt.Clunk(nil)
+}
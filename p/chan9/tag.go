@@ -0,0 +1,315 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chan9
+
+/*  Asynchronous requests.
+    A Tag sends requests on the fids of a namespace without waiting
+    for the answers. Every request, once answered, is passed as a Req
+    on the channel given to TagAlloc, and has to be freed with
+    Tag.ReqFree. Requests that take a single message are sent right
+    away, and the fid is updated when the answer arrives (a Tgetattr
+    sent by Stat on 9P2000.L gets the Dir filled in Rc.Dir). Walks,
+    which may cross mount points, and the requests that need more
+    than one message (opening and creating in a union directory, and
+    create and wstat on 9P2000.L) are run by the synchronous methods
+    in goroutines of their own; the Req passed on for them describes
+    the request in Tc, but has no Rc.
+*/
+
+import (
+	"code.google.com/p/go9p/p"
+	"sync"
+)
+
+type Tag struct {
+	sync.Mutex
+	ns       *Namespace
+	reqchan  chan *Req
+	respchan chan *Req
+	pending  int  // requests not answered yet
+	freed    bool // TagFree was called
+}
+
+// Creates a Tag that passes the answered requests on reqchan.
+func (ns *Namespace) TagAlloc(reqchan chan *Req) *Tag {
+	tag := new(Tag)
+	tag.ns = ns
+	tag.reqchan = reqchan
+	tag.respchan = make(chan *Req, 16)
+	go tag.reqproc()
+
+	return tag
+}
+
+// Stops the Tag. No more requests can be sent with it, and the
+// answers to the ones still pending are thrown away, clunking the
+// new fids of the walks. Freeing a Tag again does nothing.
+func (ns *Namespace) TagFree(tag *Tag) {
+	tag.Lock()
+	again := tag.freed
+	tag.freed = true
+	idle := tag.pending == 0
+	tag.Unlock()
+	if idle && !again {
+		close(tag.respchan)
+	}
+}
+
+// Frees a Req passed on by the Tag.
+func (tag *Tag) ReqFree(r *Req) {
+	r.Clnt.ReqFree(r)
+}
+
+// Returns the fid the request was sent on. For a Tag.Walk that
+// succeeded, it is the new fid.
+func (r *Req) Fid() *Fid {
+	return r.fid
+}
+
+func (tag *Tag) reqAlloc(fid *Fid) *Req {
+	r := fid.Clnt.ReqAlloc()
+	r.Tc = fid.Clnt.NewFcall()
+	r.Done = tag.respchan
+	r.fid = fid
+
+	return r
+}
+
+// Counts a request about to be sent. Returns false if the Tag
+// was freed.
+func (tag *Tag) start() bool {
+	tag.Lock()
+	defer tag.Unlock()
+	if tag.freed {
+		return false
+	}
+
+	tag.pending++
+	return true
+}
+
+// Sends a request, or frees it and returns an Error.
+func (tag *Tag) send(r *Req, err error) error {
+	if err == nil && !tag.start() {
+		err = Ebaduse
+	}
+	if err != nil {
+		r.Clnt.ReqFree(r)
+		return err
+	}
+
+	err = r.Clnt.Rpcnb(r)
+	if err != nil {
+		tag.Lock()
+		tag.pending--
+		tag.Unlock()
+		r.Clnt.ReqFree(r)
+	}
+
+	return err
+}
+
+// Runs the synchronous request fn in a goroutine, and passes r on
+// when it's done. Such requests are told apart by their nil Done.
+func (tag *Tag) run(r *Req, fn func() error) error {
+	if !tag.start() {
+		r.Clnt.ReqFree(r)
+		return Ebaduse
+	}
+
+	r.Done = nil
+	go func() {
+		r.Err = fn()
+		tag.respchan <- r
+	}()
+
+	return nil
+}
+
+func (tag *Tag) reqproc() {
+	for r := range tag.respchan {
+		if r.Done != nil {
+			tag.answer(r)
+		}
+
+		tag.Lock()
+		tag.pending--
+		freed := tag.freed
+		idle := tag.pending == 0
+		tag.Unlock()
+
+		if !freed {
+			tag.reqchan <- r
+			continue
+		}
+
+		if r.Tc.Type == p.Twalk && r.Err == nil {
+			r.fid.Clunk() // the new fid, no one else has it
+		}
+		r.Clnt.ReqFree(r)
+		if idle {
+			return
+		}
+	}
+}
+
+// Updates the fid of an answered request.
+func (tag *Tag) answer(r *Req) {
+	fid := r.fid
+	rc := r.Rc
+	switch r.Tc.Type {
+	case p.Topen, p.Tlopen, p.Tcreate:
+		if r.Err != nil {
+			fid.Mode = 0
+			break
+		}
+
+		fid.cacheValidate(rc.Qid)
+		fid.Qid = rc.Qid
+		fid.setIounit(rc.Iounit)
+		fid.opened = true
+
+	case p.Tstat:
+		if r.Err == nil {
+			fid.cacheValidate(rc.Dir.Qid)
+		}
+
+	case p.Tgetattr:
+		if r.Err == nil {
+			fid.cacheValidate(rc.Attr.Qid)
+			rc.Dir = *Attr2Dir(&rc.Attr, fid.basename())
+		}
+
+	case p.Tclunk, p.Tremove:
+		fid.Clnt.untrack(fid)
+		fid.release()
+	}
+}
+
+// Walks from fid, through the namespace (see Namespace.Walk). The new
+// fid is returned by Fid of the Req passed on.
+func (tag *Tag) Walk(fid *Fid, wnames []string) error {
+	req := tag.reqAlloc(fid)
+	req.Tc.Type = p.Twalk
+	req.Tc.Fid = fid.Fid
+	req.Tc.Newfid = p.NOFID
+	req.Tc.Wname = wnames
+
+	return tag.run(req, func() error {
+		newfid, err := tag.ns.Walk(fid, wnames)
+		if err == nil {
+			req.fid = newfid
+		}
+
+		return err
+	})
+}
+
+func (tag *Tag) Open(fid *Fid, mode uint8) error {
+	req := tag.reqAlloc(fid)
+	if fid.next != nil || fid.prev != nil {
+		p.PackTopen(req.Tc, fid.Fid, mode)
+		return tag.run(req, func() error {
+			return fid.Open(mode)
+		})
+	}
+
+	var err error
+	if fid.Clnt.Dotl {
+		err = p.PackTlopen(req.Tc, fid.Fid, p.Omode2Lflags(mode))
+	} else {
+		err = p.PackTopen(req.Tc, fid.Fid, mode)
+	}
+
+	fid.Mode = mode
+	return tag.send(req, err)
+}
+
+func (tag *Tag) Create(fid *Fid, name string, perm uint32, mode uint8, ext string) error {
+	req := tag.reqAlloc(fid)
+	err := p.PackTcreate(req.Tc, fid.Fid, name, perm, mode, ext, fid.Clnt.Dotu)
+	if err == nil && (fid.next != nil || fid.prev != nil || fid.Clnt.Dotl) {
+		return tag.run(req, func() error {
+			return fid.Create(name, perm, mode, ext)
+		})
+	}
+
+	fid.Mode = mode
+	return tag.send(req, err)
+}
+
+func (tag *Tag) Read(fid *Fid, offset uint64, count uint32) error {
+	if count > fid.Iounit {
+		count = fid.Iounit
+	}
+
+	req := tag.reqAlloc(fid)
+	err := p.PackTread(req.Tc, fid.Fid, offset, count)
+	return tag.send(req, err)
+}
+
+func (tag *Tag) Write(fid *Fid, data []byte, offset uint64) error {
+	if uint32(len(data)) > fid.Iounit {
+		data = data[0:fid.Iounit]
+	}
+
+	req := tag.reqAlloc(fid)
+	err := p.PackTwrite(req.Tc, fid.Fid, offset, uint32(len(data)), data)
+	fid.cacheForget()
+	return tag.send(req, err)
+}
+
+// Clunks the fid. It can't be used after the call, whatever the
+// answer.
+func (tag *Tag) Clunk(fid *Fid) error {
+	req := tag.reqAlloc(fid)
+	err := p.PackTclunk(req.Tc, fid.Fid)
+	fid.Clnt.Lock()
+	stale := fid.Clnt.stale[fid.Fid]
+	fid.Clnt.Unlock()
+	if err == nil && (stale || !fid.walked) {
+		return tag.run(req, fid.Clunk)
+	}
+
+	return tag.send(req, err)
+}
+
+// Removes the file of the fid. The fid is clunked, whatever
+// the answer. A union is not removed (see Fid.Remove), and is
+// answered with Emount.
+func (tag *Tag) Remove(fid *Fid) error {
+	req := tag.reqAlloc(fid)
+	err := p.PackTremove(req.Tc, fid.Fid)
+	if err == nil && (fid.next != nil || fid.prev != nil) {
+		return tag.run(req, fid.Remove)
+	}
+
+	return tag.send(req, err)
+}
+
+func (tag *Tag) Stat(fid *Fid) error {
+	var err error
+
+	req := tag.reqAlloc(fid)
+	if fid.Clnt.Dotl {
+		err = p.PackTgetattr(req.Tc, fid.Fid, p.GETATTR_BASIC)
+	} else {
+		err = p.PackTstat(req.Tc, fid.Fid)
+	}
+
+	return tag.send(req, err)
+}
+
+func (tag *Tag) Wstat(fid *Fid, dir *p.Dir) error {
+	req := tag.reqAlloc(fid)
+	err := p.PackTwstat(req.Tc, fid.Fid, dir, fid.Clnt.Dotu)
+	if err == nil && fid.Clnt.Dotl {
+		return tag.run(req, func() error {
+			return fid.Wstat(dir)
+		})
+	}
+
+	return tag.send(req, err)
+}
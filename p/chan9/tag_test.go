@@ -0,0 +1,150 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"testing"
+	"time"
+)
+
+func TestTag(t *testing.T) {
+	ns := testNS(t, "d/", "", "d/b", "hello")
+	rchan := make(chan *Req)
+	tag := ns.TagAlloc(rchan)
+	defer ns.TagFree(tag)
+	wait := func() *Req {
+		r := <-rchan
+		if r.Err != nil {
+			t.Fatalf("%v: %v", r.Tc, r.Err)
+		}
+		return r
+	}
+
+	if err := tag.Walk(ns.Root, []string{"d", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	r := wait()
+	fid := r.Fid()
+	tag.ReqFree(r)
+
+	if err := tag.Open(fid, p.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	tag.ReqFree(wait())
+	tag.Read(fid, 0, 3)
+	tag.Read(fid, 3, 10)
+	tag.Stat(fid)
+
+	var data [2]string
+	for i := 0; i < 3; i++ {
+		r := wait()
+		switch r.Tc.Type {
+		case p.Tread:
+			data[r.Tc.Offset/3] = string(r.Rc.Data)
+		case p.Tstat:
+			if r.Rc.Dir.Name != "b" || r.Rc.Dir.Length != 5 {
+				t.Errorf("bad stat %v", &r.Rc.Dir)
+			}
+		}
+		tag.ReqFree(r)
+	}
+	if data[0]+data[1] != "hello" {
+		t.Errorf("read %q", data)
+	}
+
+	tag.Clunk(fid)
+	tag.ReqFree(wait())
+	if fid.Fid != p.NOFID {
+		t.Errorf("fid not released after clunk")
+	}
+}
+
+// The fid of a walk answered after TagFree is clunked.
+func TestTagFreeWalk(t *testing.T) {
+	walking := make(chan uint32)
+	answer := make(chan bool)
+	clunked := make(chan uint32, 1)
+	clnt, _ := testFakeClnt(t, func(tc, rc *p.Fcall) bool {
+		switch tc.Type {
+		case p.Tattach:
+			p.PackRattach(rc, &p.Qid{Type: p.QTDIR})
+		case p.Twalk:
+			if len(tc.Wname) > 0 {
+				walking <- tc.Newfid
+				<-answer
+			}
+			p.PackRwalk(rc, make([]p.Qid, len(tc.Wname)))
+		case p.Tclunk:
+			select {
+			case clunked <- tc.Fid:
+			default:
+			}
+			p.PackRclunk(rc)
+		default:
+			p.PackRclunk(rc)
+		}
+		return true
+	})
+	ns, err := NSFromClnt(clnt, nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+
+	tag := ns.TagAlloc(make(chan *Req))
+	if err := tag.Walk(ns.Root, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	newfid := <-walking
+	ns.TagFree(tag)
+	answer <- true
+	select {
+	case fid := <-clunked:
+		if fid != newfid {
+			t.Errorf("clunked fid %d, expected %d", fid, newfid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("fid of the walk not clunked")
+	}
+}
+
+func TestTagFreeTwice(t *testing.T) {
+	ns := testNS(t, "a", "x")
+	defer ns.Close()
+	tag := ns.TagAlloc(make(chan *Req))
+	ns.TagFree(tag)
+	ns.TagFree(tag)
+	if err := tag.Stat(ns.Root); err != Ebaduse {
+		t.Errorf("stat on a freed tag: %v", err)
+	}
+}
+
+// As Fid.Remove, Tag.Remove leaves a union alone.
+func TestTagRemoveUnion(t *testing.T) {
+	ns := testNS(t, "d/", "", "e/", "")
+	defer ns.Close()
+	if err := ns.Bind("/e", "/d", p.MAFTER); err != nil {
+		t.Fatal(err)
+	}
+	fid, err := ns.FWalk(ParseName("/d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rchan := make(chan *Req)
+	tag := ns.TagAlloc(rchan)
+	defer ns.TagFree(tag)
+	if err := tag.Remove(fid); err != nil {
+		t.Fatal(err)
+	}
+	r := <-rchan
+	if r.Err != Emount {
+		t.Errorf("remove of a union: %v", r.Err)
+	}
+	tag.ReqFree(r)
+	if fid.Fid != p.NOFID {
+		t.Errorf("fid not released after remove")
+	}
+	if _, err := ns.FStat(ParseName("/d")); err != nil {
+		t.Errorf("union removed: %v", err)
+	}
+}
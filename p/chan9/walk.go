@@ -6,6 +6,8 @@ package chan9
 
 import (
 	"code.google.com/p/go9p/p"
+	"context"
+	"strings"
 	"syscall"
 )
 
@@ -20,6 +22,12 @@ import (
     fid.Walk doesn't traverse mnt-points, ns.Walk does.
  */
 func (fid *Fid) Walk(newfid *Fid, wnames []string) ([]p.Qid, error) {
+	return fid.WalkContext(context.Background(), newfid, wnames)
+}
+
+// Like Walk, but the walk is flushed and ctx.Err() returned if the
+// context is done before the server answers.
+func (fid *Fid) WalkContext(ctx context.Context, newfid *Fid, wnames []string) ([]p.Qid, error) {
 	if fid == nil {
 		return nil, Ebaduse
 	}
@@ -30,7 +38,7 @@ func (fid *Fid) Walk(newfid *Fid, wnames []string) ([]p.Qid, error) {
 		return nil, err
 	}
 
-	rc, err := fid.Clnt.Rpc(tc)
+	rc, err := fid.Clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
@@ -49,8 +57,10 @@ func (fid *Fid) Walk(newfid *Fid, wnames []string) ([]p.Qid, error) {
 		newfid.Type = fid.Type&^NOREMAP
 		newfid.Dev = fid.Dev
 		newfid.Qid = qid
+		newfid.MayCache = fid.MayCache
 		newfid.Cname, newfid.Path = PathJoin(fid.Cname, wnames,
 				fid.Path, fileid_list(newfid.Type,newfid.Dev,rc.Wqid))
+		newfid.name = nameJoin(fid.name, wnames)
 		newfid.walked = true
 	}
 
@@ -72,43 +82,94 @@ func fileid_list(Type uint16, Dev uint32, qids []p.Qid) []FileID {
       false -> set prev, next = nil in returned fid
  */
 func (fid *Fid) Clone(mntsem bool) (*Fid, error) {
+	return fid.clone(context.Background(), mntsem)
+}
+
+func (fid *Fid) clone(ctx context.Context, mntsem bool) (*Fid, error) {
 	var wnames = []string{}
 
 	if fid == nil {
 		return nil, Ebaduse
 	}
-	newfid := fid.Clnt.FidAlloc()
+	newfid, err := fid.Clnt.FidAllocContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := fid.Walk(newfid, wnames)
+	_, err = fid.WalkContext(ctx, newfid, wnames)
 	if err != nil {
 		newfid.Clunk()
 		return nil, err
 	}
 	if mntsem {
-		newfid.prev = fid.prev
-		newfid.next = fid.next
+		newfid.munion(fid)
 	}
 
 	return newfid, nil
 }
 
+// Makes fid a member of the union f is in, at the place of f.
+func (fid *Fid) munion(f *Fid) {
+	unionlk.Lock()
+	fid.prev = f.prev
+	fid.next = f.next
+	if fid.next != nil {
+		fid.next.ref++
+	}
+	unionlk.Unlock()
+}
+
+/* Returns the member of the union after fid, with a reference
+   taken (see Fid.incref), or nil if there's none. The members
+   unmounted since fid was walked to are skipped.
+ */
+func (fid *Fid) mnext() *Fid {
+	unionlk.Lock()
+	defer unionlk.Unlock()
+	for f := fid.next; f != nil; f = f.next {
+		if f.incref() {
+			return f
+		}
+	}
+	return nil
+}
+
 func (ns *Namespace) WalkDotDot(fid *Fid) (*Fid, error) {
+	return ns.walkDotDot(context.Background(), fid)
+}
+
+/* Walks to the parent of fid in the namespace, which is lexically
+   the directory fid was found in, across mounts and unions: if that
+   directory is a mount point, the result is what a walk to it gives.
+   Otherwise it's the parent on the server, after stepping back out
+   of the mount fid may be the root of. ".." of the root is the root.
+ */
+func (ns *Namespace) walkDotDot(ctx context.Context, fid *Fid) (*Fid, error) {
+	var nfid *Fid
+	var err error
+
 	if fid == nil {
 		return nil, Ebaduse
 	}
 	l := len(fid.Path)
 	if l < 2 {
-		return fid.Clone(true)
+		return fid.clone(ctx, true)
 	}
-	pfid := ns.Mnt.CheckParent(fid.Path[l-1], fid.FileID)
-	if pfid == nil {
-		return fid.WalkOne("..")
+
+	if c := ns.Mnt.mount(fid.Path[l-2]); c != nil {
+		nfid, err = c.clone(ctx, true)
+		c.decref()
+	} else if pfid := ns.Mnt.parent(fid.Path[l-1], fid.FileID); pfid != nil {
+		nfid, err = pfid.walkOne(ctx, "..")
+		pfid.decref()
+	} else {
+		nfid, err = fid.walkOne(ctx, "..")
 	}
-	nfid, err := pfid.WalkOne("..")
 	if err != nil {
 		return nil, err
 	}
-	nfid.Path = append(nfid.Path[:0], fid.Path[:len(fid.Path)-1]...)
+	nfid.Path = append([]FileID(nil), fid.Path[:l-1]...)
+	nfid.name = nameJoin(fid.name, []string{".."})
 	return nfid, nil
 }
 
@@ -116,24 +177,47 @@ func (ns *Namespace) WalkDotDot(fid *Fid) (*Fid, error) {
     traverse a mount-point, if one exists.
  */
 func (ns *Namespace) WalkOne(fid *Fid, wname string) (*Fid, error) {
+	return ns.walkOne(context.Background(), fid, wname)
+}
+
+func (ns *Namespace) walkOne(ctx context.Context, fid *Fid, wname string) (*Fid, error) {
 	if wname == ".." {
-		return ns.WalkDotDot(fid)
+		return ns.walkDotDot(ctx, fid)
+	}
+	nfid, err := fid.walkOne(ctx, wname)
+	if err != nil {
+		return nil, err
 	}
-	return fid.WalkOne(wname)
+	// found in a member of a union: the path is still that of fid
+	nfid.Path = append(fid.Path[:len(fid.Path):len(fid.Path)], nfid.FileID)
+	nfid.name = nameJoin(fid.name, []string{wname})
+	return nfid, nil
 }
 func (fid *Fid) WalkOne(wname string) (*Fid, error) {
+	return fid.walkOne(context.Background(), wname)
+}
+
+func (fid *Fid) walkOne(ctx context.Context, wname string) (*Fid, error) {
 	var wnames = []string { wname }
 
 	if fid == nil {
 		return nil, Ebaduse
 	}
-	newfid := fid.Clnt.FidAlloc()
+	newfid, err := fid.Clnt.FidAllocContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	wqid, err := fid.Walk(newfid, wnames)
+	wqid, err := fid.WalkContext(ctx, newfid, wnames)
 	if err != nil || len(wqid) != 1 {
-		if fid.next != nil { // Unionized.
+		if ctx.Err() != nil {
+			goto error
+		}
+		if next := fid.mnext(); next != nil { // Unionized.
 			newfid.Clunk()
-			return fid.next.WalkOne(wname)
+			nfid, err := next.walkOne(ctx, wname)
+			next.decref()
+			return nfid, err
 		}
 		if err == nil {
 			err = Enofile
@@ -171,18 +255,73 @@ func (f *Fid) MStep() (*Fid, error) {
  */
 func (f *Fid) MReset() (*Fid, error) {
 	var fid *Fid
-	
+
 	if f == nil {
 		return nil, Ebaduse
 	}
-	for fid=f; fid.prev!=nil; fid=fid.prev {
+	unionlk.Lock()
+	for fid = f; fid.prev != nil && fid.prev.ref > 0; fid = fid.prev {
+	}
+	if fid != f {
+		fid.ref++
+	}
+	unionlk.Unlock()
+	nfid, err := fid.Clone(true)
+	if fid != f {
+		fid.decref()
 	}
-	fid, err := fid.Clone(true)
 	if err != nil {
 		return nil, err
 	}
 	f.Clunk()
-	return fid, nil
+	return nfid, nil
+}
+
+// Whether err says the file does not exist. A server not speaking
+// 9P2000.u only says so in the error string, that of Plan 9 or
+// of go9p's srv.
+func gone(err error) bool {
+	perr, ok := err.(*p.Error)
+	if !ok {
+		return false
+	}
+	if perr.Errornum != 0 {
+		return perr.Errornum == p.ENOENT
+	}
+	return strings.Contains(perr.Err, "does not exist") || strings.Contains(perr.Err, "not found")
+}
+
+/* Call fn on the union elements, from fid on, while it fails with
+   ENOENT (the element is gone) - and return the last error. Any other
+   error is the answer of the element Namespace.Walk finds, and is
+   returned, so that the ones it shadows are left alone.
+   Unlike MUntil, fid is left alone, so fn must not modify it.
+ */
+func (fid *Fid) MFirst(fn func(*Fid)error) error {
+	var err error
+
+	if fid == nil {
+		return Ebaduse
+	}
+	f := fid
+	for {
+		err = fn(f)
+		if !gone(err) {
+			break
+		}
+		next := f.mnext()
+		if f != fid {
+			f.decref()
+		}
+		if next == nil {
+			return err
+		}
+		f = next
+	}
+	if f != fid {
+		f.decref()
+	}
+	return err
 }
 
 /* Repeatedly call fn on all union elements
@@ -199,25 +338,38 @@ func (fid *Fid) MUntil(fn func(*Fid)error) error {
 	if fid.next != nil || fid.prev != nil {
 		var err error
 		var fd *Fid
-		var f *Fid
-		for f=fid; f != nil; f=f.next {
+
+		f := fid
+		for {
 			fd, err = f.Clone(false)
 			if err != nil {
-				return err
+				break
 			}
-			err = fn(fd)
-			if err == nil {
+			if err = fn(fd); err == nil {
 				break
 			}
 			fd.Clunk()
+			next := f.mnext()
+			if f != fid {
+				f.decref()
+			}
+			if next == nil {
+				return err
+			}
+			f = next
+		}
+		if err == nil {
+			fd.munion(f)
+		}
+		if f != fid {
+			f.decref()
 		}
 		if err != nil {
 			return err
 		}
-		fd.prev = f.prev
-		fd.next = f.next
 		fid.Clunk()
 		*fid = *fd
+		fid.Clnt.track(fid)
 		return nil
 	}
 	return fn(fid)
@@ -225,29 +377,73 @@ func (fid *Fid) MUntil(fn func(*Fid)error) error {
 
 
 /*  Wrapper for fid.Walk to deal with possibility of walking > 16 steps,
-    and of running into a mount-point along the way.
+    and of running into a mount-point or a symbolic link along the way.
+    Symbolic links (9P2000.u and 9P2000.L) are followed, see FWalkNoFollow.
     Official Song: `Walk', Foo Fighters
  */
 func (ns *Namespace) Walk(fid *Fid, wnames []string) (*Fid, error) {
+	return ns.WalkContext(context.Background(), fid, wnames)
+}
+
+// Like Walk, but gives up and returns ctx.Err() once the context is done.
+func (ns *Namespace) WalkContext(ctx context.Context, fid *Fid, wnames []string) (*Fid, error) {
+	return ns.walk(ctx, fid, wnames, true, 0)
+}
+
+/* Does the work of Walk. A symbolic link last in wnames is only
+   followed if follow is set; links counts those followed so far.
+ */
+func (ns *Namespace) walk(ctx context.Context, fid *Fid, wnames []string, follow bool, links int) (*Fid, error) {
 	var err error = nil
 	var wqid []p.Qid
 	var i int
+	var last *Fid // walked by the previous block
+	var held *Fid // of the mount table, walked from
 
 	if fid == nil {
 		return nil, Ebaduse
 	}
 	if len(wnames)>0 && wnames[0] == ".." {
-		fid, err = ns.WalkDotDot(fid)
+		fid, err = ns.walkDotDot(ctx, fid)
 		if err != nil {
 			return nil, err
 		}
-		rfid, err := ns.Walk(fid, wnames[1:])
+		rfid, err := ns.walk(ctx, fid, wnames[1:], follow, links)
 		fid.Clunk()
 		return rfid, err
 	}
+	for i = 1; i < len(wnames); i++ {
+		if wnames[i] == ".." { // walk up to it, the server can't go back out of a mount
+			fid, err = ns.walk(ctx, fid, wnames[:i], true, links)
+			if err != nil {
+				return nil, err
+			}
+			rfid, err := ns.walk(ctx, fid, wnames[i:], follow, links)
+			fid.Clunk()
+			return rfid, err
+		}
+	}
+
+	// moves on to a fid of the mount table, with a reference taken
+	hold := func(f *Fid) {
+		if held != nil {
+			held.decref()
+		}
+		held = f
+		fid = f
+	}
+	defer func() {
+		if held != nil {
+			held.decref()
+		}
+	}()
 
-	newfid := fid.Clnt.FidAlloc()
-	path := fid.Path
+	newfid, err := fid.Clnt.FidAllocContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	path := fid.Path[:len(fid.Path):len(fid.Path)] // appended to, not shared
+	name := fid.name
 
 	for { // step in blocks of 16 path elems
 		n := len(wnames)
@@ -257,41 +453,68 @@ func (ns *Namespace) Walk(fid *Fid, wnames []string) (*Fid, error) {
 
 		Type := fid.Type&^NOREMAP
 		Dev := fid.Dev
-		wqid, err = fid.Walk(newfid, wnames[0:n])
+		wqid, err = fid.WalkContext(ctx, newfid, wnames[0:n])
 		if err != nil || (n > 0 && len(wqid) == 0) {
-			if fid.next != nil { // Unionized.
+			if ctx.Err() != nil {
+				goto error
+			}
+			if next := fid.mnext(); next != nil { // Unionized.
 				newfid.Clunk()
-				fid = fid.next
-				newfid = fid.Clnt.FidAlloc()
+				hold(next)
+				newfid, err = fid.Clnt.FidAllocContext(ctx)
+				if err != nil {
+					goto error
+				}
 				continue
 			}
 			goto error
 		}
 		// Check for hitting mount-points and recurse.
 		if len(wnames) == 0 { // copy union semantics from self
-			newfid.next = fid.next
-			newfid.prev = fid.prev
+			newfid.munion(fid)
 		}
+		link := false
 		for i = 0; i < len(wqid); i++ {
 			// ¿move the following to 'WalkUnion'?
 			// and protect against changing Children[wqid[i]]
 			// to call from partial walks, e.g. mkdir
 			// - replace unions with a channel to manage state?
 			// - replace fid with an int to prevent fid tampering?
-			c := ns.Mnt.CheckMount(FileID{fid.Type,fid.Dev,wqid[i]})
+			c := ns.Mnt.mount(FileID{Type, Dev, wqid[i]})
 			if c == nil {
-				// TODO: Check for symlinks and dial 'em!
+				if wqid[i].Type&p.QTSYMLINK != 0 && (follow || i+1 < len(wnames)) {
+					link = true
+					break
+				}
 				continue
 			}
-			fid = c
+			hold(c)
 			newfid.Clunk() // the fid churn is to satisfy incref/decref
-			newfid = fid.Clnt.FidAlloc()
+			newfid, err = fid.Clnt.FidAllocContext(ctx)
+			if err != nil {
+				goto error
+			}
 			break
 		}
+		if link {
+			dir := append(path[:len(path):len(path)], fileid_list(Type, Dev, wqid[:i])...)
+			dname := append(name[:len(name):len(name)], wnames[:i]...)
+			rfid, err := ns.followLink(ctx, fid, wnames[:i+1], wnames[i+1:], dir, dname, follow, links)
+			newfid.Clunk()
+			if last != nil {
+				last.Clunk()
+			}
+			return rfid, err
+		}
 		if i < len(wqid) { // replaced by a mount point
 			n = i+1
 			path = append(path, fileid_list(Type, Dev, wqid[:n])...)
+			name = append(name[:len(name):len(name)], wnames[:n]...)
 			wnames = wnames[n:]
+			if last != nil {
+				last.Clunk()
+				last = nil
+			}
 			continue // ensures we clone the client fid.
 		}
 
@@ -301,67 +524,174 @@ func (ns *Namespace) Walk(fid *Fid, wnames []string) (*Fid, error) {
 		}
 
 		path = append(path, fileid_list(Type, Dev, wqid[:n])...)
+		name = append(name[:len(name):len(name)], wnames[:n]...)
 		wnames = wnames[n:]
-		fid = newfid
 		if len(wnames) == 0 {
 			break
 		}
+		// walk on from a new fid, keeping this one for the
+		// links met in the next block
+		if last != nil {
+			last.Clunk()
+		}
+		last = newfid
+		fid = newfid
+		newfid, err = fid.Clnt.FidAllocContext(ctx)
+		if err != nil {
+			goto error
+		}
 	}
 
+	if last != nil {
+		last.Clunk()
+	}
 	newfid.Path = path
+	newfid.name = name
 	return newfid, nil
 
 error:
-	newfid.Clunk()
+	if newfid != nil {
+		newfid.Clunk()
+	}
+	if last != nil {
+		last.Clunk()
+	}
 	return nil, err
 }
 
+/* Follows the symbolic link reached by walking lnames from fid, then
+   walks rest from its target. A relative target is walked from the
+   directory of the link (whose Path and name in the namespace are
+   dir and dname), an absolute one from ns.Root.
+ */
+func (ns *Namespace) followLink(ctx context.Context, fid *Fid, lnames, rest []string, dir []FileID, dname []string, follow bool, links int) (*Fid, error) {
+	if links >= MAXSYMLINKS {
+		return nil, Eloop
+	}
+
+	lfid, err := fid.Clnt.FidAllocContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wqid, err := fid.WalkContext(ctx, lfid, lnames)
+	if err == nil && len(wqid) != len(lnames) {
+		err = Enofile
+	}
+	if err != nil {
+		lfid.Clunk()
+		return nil, err
+	}
+	target, err := lfid.readlink(ctx)
+	lfid.Clunk()
+	if err != nil {
+		return nil, err
+	}
+
+	e := ParseName(target)
+	wnames := append(e.Elems[:len(e.Elems):len(e.Elems)], rest...)
+	if e.Ref == '/' {
+		root, err := ns.dir('/')
+		if err != nil {
+			return nil, err
+		}
+		rfid, err := ns.walk(ctx, root, wnames, follow, links+1)
+		root.decref()
+		return rfid, err
+	}
+
+	dfid, err := fid.Clnt.FidAllocContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wqid, err = fid.WalkContext(ctx, dfid, lnames[:len(lnames)-1])
+	if err == nil && len(wqid) != len(lnames)-1 {
+		err = Enofile
+	}
+	if err != nil {
+		dfid.Clunk()
+		return nil, err
+	}
+	dfid.Path = dir
+	dfid.name = dname
+	rfid, err := ns.walk(ctx, dfid, wnames, follow, links+1)
+	dfid.Clunk()
+	return rfid, err
+}
+
+// Returns the target of a symbolic link, from its stat for 9P2000.u.
+func (fid *Fid) readlink(ctx context.Context) (string, error) {
+	if fid.Clnt.Dotl {
+		return fid.Readlink()
+	}
+
+	d, err := fid.StatContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	if d.Mode&p.DMSYMLINK == 0 || d.Ext == "" {
+		return "", &p.Error{"bad symbolic link", p.EINVAL}
+	}
+
+	return d.Ext, nil
+}
+
 /* Walks to a named file, using the same algo. as Walk, but translating
  * Elemlist.  Returns a Fid associated with the file, or an Error.
  * tlast controls whether the last element is traversed if it's a mount-point.
  */
 func (ns *Namespace) FWalk(e Elemlist) (*Fid, error) {
-	var fid *Fid
-	switch e.Ref {
-	case '/':
-		fid = ns.Root
-	case '.':
-		fid = ns.Cwd
-	default:
-		return nil, Enofile
+	return ns.FWalkContext(context.Background(), e)
+}
+
+// Like FWalk, but gives up and returns ctx.Err() once the context is done.
+func (ns *Namespace) FWalkContext(ctx context.Context, e Elemlist) (*Fid, error) {
+	fid, err := ns.dir(e.Ref)
+	if err != nil {
+		return nil, err
 	}
+	defer fid.decref()
 
-	return ns.Walk(fid, e.Elems)
+	return ns.WalkContext(ctx, fid, e.Elems)
+}
+
+/* Walks to a named file like FWalk, but does not follow the last
+ * element if it's a symbolic link (as lstat does).
+ */
+func (ns *Namespace) FWalkNoFollow(e Elemlist) (*Fid, error) {
+	fid, err := ns.dir(e.Ref)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.decref()
+
+	return ns.walk(context.Background(), fid, e.Elems, false, 0)
 }
 
 /* Walks to a named file, but does not traverse the last element
  * if it's a mount-point.
  */
 func (ns *Namespace) FWalkTo(e Elemlist) (*Fid, error) {
-	var err error
-	var fid *Fid
-	switch e.Ref {
-	case '/':
-		fid = ns.Root
-	case '.':
-		fid = ns.Cwd
-	default:
-		return nil, Enofile
+	dir, err := ns.dir(e.Ref)
+	if err != nil {
+		return nil, err
 	}
+	defer dir.decref()
 
 	l := len(e.Elems)
 	switch l {
 	case 0:
-		return fid.Clone(false)
+		return dir.Clone(false)
 	case 1:
-		return ns.WalkOne(fid, e.Elems[0])
+		return ns.WalkOne(dir, e.Elems[0])
 	}
 
-	fid, err = ns.Walk(fid, e.Elems[:l-1])
+	fid, err := ns.Walk(dir, e.Elems[:l-1])
 	if err != nil {
 		return nil, err
 	}
-	return ns.WalkOne(fid, e.Elems[l-1])
+	nfid, err := ns.WalkOne(fid, e.Elems[l-1])
+	fid.Clunk()
+	return nfid, err
 }
 
 // Starting from the file associated with fid, walks all wnames in
@@ -371,4 +701,3 @@ func (ns *Namespace) FWalkTo(e Elemlist) (*Fid, error) {
 //func (ns *Namespace) Walk(fid *Fid, newfid *Fid, wnames []string) ([]p.Qid, error) {
 //	return fid.Walk(newfid, wnames)
 //}
-
@@ -0,0 +1,223 @@
+package chan9
+
+import (
+	"code.google.com/p/go9p/p"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSymlink(t *testing.T) {
+	ns := testNS(t, "d/", "", "d/a", "1", "d/up@", "../d/a", "l@", "d",
+		"abs@", "/m/x", "loop@", "loop", "m/", "")
+	mnt := testConnect(t, testSrv(t, "x", "2", "back@", "../l/a"))
+	if err := ns.Mount(mnt, nil, "/m", p.MREPL, ""); err != nil {
+		t.Fatal(err)
+	}
+	nfids := func() int {
+		c := ns.Root.Clnt
+		c.Lock()
+		defer c.Unlock()
+		return len(c.fids)
+	}
+	read := func(name string) string {
+		file, err := ns.FOpen(ParseName(name), p.OREAD)
+		if err != nil {
+			return err.Error()
+		}
+		defer file.Close()
+		buf, _ := io.ReadAll(file)
+		return string(buf)
+	}
+
+	n := nfids()
+	for _, tc := range []struct{ name, data string }{
+		{"/l/a", "1"},
+		{"/d/up", "1"},
+		{"/abs", "2"},
+		{"/m/back", "1"},
+	} {
+		if s := read(tc.name); s != tc.data {
+			t.Errorf("read %s: %q, want %q", tc.name, s, tc.data)
+		}
+	}
+	if nfids() != n {
+		t.Errorf("%d fids after following links, %d before", nfids(), n)
+	}
+
+	if _, err := ns.FWalk(ParseName("/loop/a")); !errors.Is(err, p.ELOOP) {
+		t.Errorf("walk through a loop: %v", err)
+	}
+
+	fid, err := ns.FWalkNoFollow(ParseName("/l"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fid.Qid.Type&p.QTSYMLINK == 0 {
+		t.Errorf("FWalkNoFollow followed the link: qid %v", fid.Qid)
+	}
+	fid.Clunk()
+	fid, err = ns.FWalk(ParseName("/l"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fid.Qid.Type&p.QTDIR == 0 {
+		t.Errorf("FWalk did not follow the link: qid %v", fid.Qid)
+	}
+	fid.Clunk()
+}
+
+// Walks the namespaces left by random binds and mounts, checking that the paths
+// given by Fd2Path walk back to the same file and that ".." is the
+// directory the file was found in.
+func TestDotDot(t *testing.T) {
+	dirs := []string{"/a", "/a/b", "/a/b/c", "/b", "/b/x", "/n/m", "/n/m/k", "/n/q"}
+	flags := []uint32{p.MREPL, p.MBEFORE, p.MAFTER}
+	mnt := testSrv(t, "m/", "", "m/k/", "", "q/", "")
+	rnd := rand.New(rand.NewSource(1))
+	noremap := func(id FileID) FileID {
+		id.Type &^= NOREMAP
+		return id
+	}
+
+	for trial := 0; trial < 20; trial++ {
+		ns := testNS(t, "a/", "", "a/b/", "", "a/b/c/", "", "b/", "", "b/x/", "", "n/", "")
+		if err := ns.Mount(testConnect(t, mnt), nil, "/n", p.MREPL, ""); err != nil {
+			t.Fatal(err)
+		}
+		var binds []string
+		for i := 0; i < 4; i++ {
+			src, dst := dirs[rnd.Intn(len(dirs))], dirs[rnd.Intn(len(dirs))]
+			flag := flags[rnd.Intn(len(flags))]
+			if rnd.Intn(4) == 0 {
+				if ns.Mount(testConnect(t, mnt), nil, dst, flag, "") == nil {
+					binds = append(binds, fmt.Sprintf("mount %s %d", dst, flag))
+				}
+			} else if ns.Bind(src, dst, flag) == nil {
+				binds = append(binds, fmt.Sprintf("bind %s %s %d", src, dst, flag))
+			}
+		}
+
+		check := func(path string) []string {
+			fid, err := ns.FWalk(ParseName(path))
+			if err != nil {
+				t.Fatalf("%v: walk to %s: %v", binds, path, err)
+			}
+			defer fid.Clunk()
+			if name, err := ns.Fd2Path(fid); name != path {
+				t.Errorf("%v: Fd2Path(%s) = %s %v", binds, path, name, err)
+			}
+
+			dir := path[:strings.LastIndex(path, "/")]
+			if dir == "" {
+				dir = "/"
+			}
+			dfid, err := ns.FWalk(ParseName(dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dfid.Clunk()
+			up, err := ns.Walk(fid, []string{".."})
+			if err != nil {
+				t.Fatalf("%v: walk to %s/..: %v", binds, path, err)
+			}
+			defer up.Clunk()
+			if name, _ := ns.Fd2Path(up); name != dir || noremap(up.FileID) != noremap(dfid.FileID) {
+				t.Errorf("%v: %s/.. is %s %v, want %s %v", binds, path, name, up.FileID, dir, dfid.FileID)
+			}
+			if dir != "/" {
+				elems := strings.Split(path[1:], "/")
+				elems = append(elems, "..", elems[len(elems)-1])
+				again, err := ns.Walk(ns.Root, elems)
+				if err != nil {
+					t.Fatalf("%v: walk to %v: %v", binds, elems, err)
+				}
+				if name, _ := ns.Fd2Path(again); name != path || again.FileID != fid.FileID {
+					t.Errorf("%v: %v is %s %v, want %s %v", binds, elems, name, again.FileID, path, fid.FileID)
+				}
+				again.Clunk()
+			}
+
+			file, err := ns.FOpen(ParseName(path), p.OREAD)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			file.Unique = true
+			ds, err := file.Readdir(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var subdirs []string
+			for _, d := range ds {
+				if d.Mode&p.DMDIR != 0 {
+					subdirs = append(subdirs, d.Name)
+				}
+			}
+			return subdirs
+		}
+
+		var walk func(path string, depth int)
+		walk = func(path string, depth int) {
+			subdirs := check(path)
+			if depth == 3 {
+				return
+			}
+			for _, name := range subdirs {
+				walk(strings.TrimSuffix(path, "/")+"/"+name, depth+1)
+			}
+		}
+		walk("/", 0)
+
+		if err := ns.Close(); err != nil {
+			t.Errorf("%v: close: %v", binds, err)
+		}
+	}
+}
+
+// MFirst goes on past a member gone, also when the server says so
+// only with an error string.
+func TestMFirstGone(t *testing.T) {
+	ns := testNS(t, "d/", "", "e/", "", "f/", "")
+	defer ns.Close()
+	if err := ns.Bind("/e", "/d", p.MAFTER); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Bind("/f", "/d", p.MAFTER); err != nil {
+		t.Fatal(err)
+	}
+	fid, err := ns.FWalk(ParseName("/d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Clunk()
+
+	for _, gone := range []error{
+		&p.Error{"file not found", p.ENOENT},
+		&p.Error{"file does not exist", 0},
+		&p.Error{"file not found", 0},
+	} {
+		n := 0
+		err := fid.MFirst(func(f *Fid) error {
+			if n++; n < 3 {
+				return gone
+			}
+			return nil
+		})
+		if err != nil || n != 3 {
+			t.Errorf("%v: %d members tried, %v", gone, n, err)
+		}
+	}
+
+	n := 0
+	err = fid.MFirst(func(f *Fid) error {
+		n++
+		return &p.Error{"permission denied", 0}
+	})
+	if err == nil || n != 1 {
+		t.Errorf("%d members tried after a refusal, %v", n, err)
+	}
+}
@@ -5,11 +5,18 @@
 package chan9
 
 import "code.google.com/p/go9p/p"
+import "context"
 import "syscall"
 
 // Write up to len(data) bytes starting from offset. Returns the
 // number of bytes written, or an Error.
 func (fid *Fid) Write(data []byte, offset uint64) (int, error) {
+	return fid.WriteContext(context.Background(), data, offset)
+}
+
+// Like Write, but the write is flushed and ctx.Err() returned if the
+// context is done before the server answers.
+func (fid *Fid) WriteContext(ctx context.Context, data []byte, offset uint64) (int, error) {
 	if uint32(len(data)) > fid.Iounit {
 		data = data[0:fid.Iounit]
 	}
@@ -20,7 +27,8 @@ func (fid *Fid) Write(data []byte, offset uint64) (int, error) {
 		return 0, err
 	}
 
-	rc, err := fid.Clnt.Rpc(tc)
+	fid.cacheForget()
+	rc, err := fid.Clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return 0, err
 	}
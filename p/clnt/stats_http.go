@@ -7,6 +7,8 @@ import (
 	"net/http"
 )
 
+// The page shows no fids: this client doesn't keep track of them (see
+// DbgTrackFids in chan9).
 func (clnt *Clnt) ServeHTTP(c http.ResponseWriter, r *http.Request) {
 	io.WriteString(c, fmt.Sprintf("<html><body><h1>Client %s</h1>", clnt.Id))
 	defer io.WriteString(c, "</body></html>")
@@ -85,6 +85,27 @@ func (d *Dir) String() string {
 	return ret
 }
 
+func (a *Attr) String() string {
+	return fmt.Sprintf("valid %x q %v m %o uid %d gid %d nlink %d rdev %d l %d blksize %d blocks %d at %d mt %d ct %d",
+		a.Valid, &a.Qid, a.Mode, a.Uid, a.Gid, a.Nlink, a.Rdev, a.Size, a.Blksize, a.Blocks,
+		a.AtimeSec, a.MtimeSec, a.CtimeSec)
+}
+
+func (a *SetAttr) String() string {
+	return fmt.Sprintf("valid %x m %o uid %d gid %d l %d at %d mt %d",
+		a.Valid, a.Mode, a.Uid, a.Gid, a.Size, a.AtimeSec, a.MtimeSec)
+}
+
+func (st *Statfs) String() string {
+	return fmt.Sprintf("type %x bsize %d blocks %d bfree %d bavail %d files %d ffree %d fsid %x namelen %d",
+		st.Type, st.Bsize, st.Blocks, st.Bfree, st.Bavail, st.Files, st.Ffree, st.Fsid, st.Namelen)
+}
+
+func (lk *Flock) String() string {
+	return fmt.Sprintf("type %d flags %x start %d length %d proc_id %d client_id '%s'",
+		lk.Type, lk.Flags, lk.Start, lk.Length, lk.ProcId, lk.ClientId)
+}
+
 func (fc *Fcall) String() string {
 	ret := ""
 
@@ -155,6 +176,92 @@ func (fc *Fcall) String() string {
 		ret = fmt.Sprintf("Rremove tag %d", fc.Tag)
 	case Rwstat:
 		ret = fmt.Sprintf("Rwstat tag %d", fc.Tag)
+
+	/* 9P2000.L */
+	case Rlerror:
+		ret = fmt.Sprintf("Rlerror tag %d ecode %d", fc.Tag, fc.Errornum)
+	case Tstatfs:
+		ret = fmt.Sprintf("Tstatfs tag %d fid %d", fc.Tag, fc.Fid)
+	case Rstatfs:
+		ret = fmt.Sprintf("Rstatfs tag %d st (%v)", fc.Tag, &fc.Statfs)
+	case Tlopen:
+		ret = fmt.Sprintf("Tlopen tag %d fid %d flags %x", fc.Tag, fc.Fid, fc.Lflags)
+	case Rlopen:
+		ret = fmt.Sprintf("Rlopen tag %d qid %v iounit %d", fc.Tag, &fc.Qid, fc.Iounit)
+	case Tlcreate:
+		ret = fmt.Sprintf("Tlcreate tag %d fid %d name '%s' flags %x mode %o gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Lflags, fc.Lmode, fc.Lgid)
+	case Rlcreate:
+		ret = fmt.Sprintf("Rlcreate tag %d qid %v iounit %d", fc.Tag, &fc.Qid, fc.Iounit)
+	case Tsymlink:
+		ret = fmt.Sprintf("Tsymlink tag %d fid %d name '%s' target '%s' gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Target, fc.Lgid)
+	case Rsymlink:
+		ret = fmt.Sprintf("Rsymlink tag %d qid %v", fc.Tag, &fc.Qid)
+	case Tmknod:
+		ret = fmt.Sprintf("Tmknod tag %d dfid %d name '%s' mode %o major %d minor %d gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Lmode, fc.Major, fc.Minor, fc.Lgid)
+	case Rmknod:
+		ret = fmt.Sprintf("Rmknod tag %d qid %v", fc.Tag, &fc.Qid)
+	case Trename:
+		ret = fmt.Sprintf("Trename tag %d fid %d dfid %d name '%s'", fc.Tag, fc.Fid, fc.Fid2, fc.Name)
+	case Rrename:
+		ret = fmt.Sprintf("Rrename tag %d", fc.Tag)
+	case Treadlink:
+		ret = fmt.Sprintf("Treadlink tag %d fid %d", fc.Tag, fc.Fid)
+	case Rreadlink:
+		ret = fmt.Sprintf("Rreadlink tag %d target '%s'", fc.Tag, fc.Target)
+	case Tgetattr:
+		ret = fmt.Sprintf("Tgetattr tag %d fid %d mask %x", fc.Tag, fc.Fid, fc.Mask)
+	case Rgetattr:
+		ret = fmt.Sprintf("Rgetattr tag %d attr (%v)", fc.Tag, &fc.Attr)
+	case Tsetattr:
+		ret = fmt.Sprintf("Tsetattr tag %d fid %d attr (%v)", fc.Tag, fc.Fid, &fc.SetAttr)
+	case Rsetattr:
+		ret = fmt.Sprintf("Rsetattr tag %d", fc.Tag)
+	case Txattrwalk:
+		ret = fmt.Sprintf("Txattrwalk tag %d fid %d newfid %d name '%s'", fc.Tag, fc.Fid, fc.Newfid, fc.Name)
+	case Rxattrwalk:
+		ret = fmt.Sprintf("Rxattrwalk tag %d size %d", fc.Tag, fc.Xsize)
+	case Txattrcreate:
+		ret = fmt.Sprintf("Txattrcreate tag %d fid %d name '%s' size %d flags %x",
+			fc.Tag, fc.Fid, fc.Name, fc.Xsize, fc.Lflags)
+	case Rxattrcreate:
+		ret = fmt.Sprintf("Rxattrcreate tag %d", fc.Tag)
+	case Treaddir:
+		ret = fmt.Sprintf("Treaddir tag %d fid %d offset %d count %d", fc.Tag, fc.Fid, fc.Offset, fc.Count)
+	case Rreaddir:
+		ret = fmt.Sprintf("Rreaddir tag %d count %d", fc.Tag, fc.Count)
+	case Tfsync:
+		ret = fmt.Sprintf("Tfsync tag %d fid %d datasync %d", fc.Tag, fc.Fid, fc.Datasync)
+	case Rfsync:
+		ret = fmt.Sprintf("Rfsync tag %d", fc.Tag)
+	case Tlock:
+		ret = fmt.Sprintf("Tlock tag %d fid %d lock (%v)", fc.Tag, fc.Fid, &fc.Flock)
+	case Rlock:
+		ret = fmt.Sprintf("Rlock tag %d status %d", fc.Tag, fc.Status)
+	case Tgetlock:
+		ret = fmt.Sprintf("Tgetlock tag %d fid %d lock (%v)", fc.Tag, fc.Fid, &fc.Flock)
+	case Rgetlock:
+		ret = fmt.Sprintf("Rgetlock tag %d lock (%v)", fc.Tag, &fc.Flock)
+	case Tlink:
+		ret = fmt.Sprintf("Tlink tag %d dfid %d fid %d name '%s'", fc.Tag, fc.Fid, fc.Fid2, fc.Name)
+	case Rlink:
+		ret = fmt.Sprintf("Rlink tag %d", fc.Tag)
+	case Tmkdir:
+		ret = fmt.Sprintf("Tmkdir tag %d dfid %d name '%s' mode %o gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Lmode, fc.Lgid)
+	case Rmkdir:
+		ret = fmt.Sprintf("Rmkdir tag %d qid %v", fc.Tag, &fc.Qid)
+	case Trenameat:
+		ret = fmt.Sprintf("Trenameat tag %d olddirfid %d oldname '%s' newdirfid %d newname '%s'",
+			fc.Tag, fc.Fid, fc.Name, fc.Fid2, fc.Newname)
+	case Rrenameat:
+		ret = fmt.Sprintf("Rrenameat tag %d", fc.Tag)
+	case Tunlinkat:
+		ret = fmt.Sprintf("Tunlinkat tag %d dirfid %d name '%s' flags %x", fc.Tag, fc.Fid, fc.Name, fc.Lflags)
+	case Runlinkat:
+		ret = fmt.Sprintf("Runlinkat tag %d", fc.Tag)
 	}
 
 	return ret
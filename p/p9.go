@@ -46,6 +46,57 @@ const (
 	Tlast
 )
 
+// 9P2000.L message types
+const (
+	Tlerror      = 6
+	Rlerror      = 7
+	Tstatfs      = 8
+	Rstatfs      = 9
+	Tlopen       = 12
+	Rlopen       = 13
+	Tlcreate     = 14
+	Rlcreate     = 15
+	Tsymlink     = 16
+	Rsymlink     = 17
+	Tmknod       = 18
+	Rmknod       = 19
+	Trename      = 20
+	Rrename      = 21
+	Treadlink    = 22
+	Rreadlink    = 23
+	Tgetattr     = 24
+	Rgetattr     = 25
+	Tsetattr     = 26
+	Rsetattr     = 27
+	Txattrwalk   = 30
+	Rxattrwalk   = 31
+	Txattrcreate = 32
+	Rxattrcreate = 33
+	Treaddir     = 40
+	Rreaddir     = 41
+	Tfsync       = 50
+	Rfsync       = 51
+	Tlock        = 52
+	Rlock        = 53
+	Tgetlock     = 54
+	Rgetlock     = 55
+	Tlink        = 70
+	Rlink        = 71
+	Tmkdir       = 72
+	Rmkdir       = 73
+	Trenameat    = 74
+	Rrenameat    = 75
+	Tunlinkat    = 76
+	Runlinkat    = 77
+)
+
+// Protocol versions
+const (
+	VERSION  = "9P2000"
+	VERSIONU = "9P2000.u"
+	VERSIONL = "9P2000.L"
+)
+
 const (
 	MSIZE   = 8192 + IOHDRSZ // default message size (8192+IOHdrSz)
 	IOHDRSZ = 24             // the non-data size of the Twrite messages
@@ -74,6 +125,76 @@ const (
 	//OEXCL   = 0x1000 // or'ed in, exclusive use (create only)
 )
 
+// Flags for the flags field in Tlopen and Tlcreate messages (9P2000.L).
+// These are the Linux open(2) values.
+const (
+	LOREAD      uint32 = 00000000
+	LOWRITE     uint32 = 00000001
+	LORDWR      uint32 = 00000002
+	LOACCMODE   uint32 = 00000003
+	LOCREATE    uint32 = 00000100
+	LOEXCL      uint32 = 00000200
+	LONOCTTY    uint32 = 00000400
+	LOTRUNC     uint32 = 00001000
+	LOAPPEND    uint32 = 00002000
+	LONONBLOCK  uint32 = 00004000
+	LODIRECTORY uint32 = 00200000
+	LONOFOLLOW  uint32 = 00400000
+	LOCLOEXEC   uint32 = 02000000
+	LOSYNC      uint32 = 04000000
+)
+
+// Bits for the request_mask and valid fields in Tgetattr and Rgetattr (9P2000.L)
+const (
+	GETATTR_MODE         uint64 = 0x00000001
+	GETATTR_NLINK        uint64 = 0x00000002
+	GETATTR_UID          uint64 = 0x00000004
+	GETATTR_GID          uint64 = 0x00000008
+	GETATTR_RDEV         uint64 = 0x00000010
+	GETATTR_ATIME        uint64 = 0x00000020
+	GETATTR_MTIME        uint64 = 0x00000040
+	GETATTR_CTIME        uint64 = 0x00000080
+	GETATTR_INO          uint64 = 0x00000100
+	GETATTR_SIZE         uint64 = 0x00000200
+	GETATTR_BLOCKS       uint64 = 0x00000400
+	GETATTR_BTIME        uint64 = 0x00000800
+	GETATTR_GEN          uint64 = 0x00001000
+	GETATTR_DATA_VERSION uint64 = 0x00002000
+	GETATTR_BASIC        uint64 = 0x000007ff // mask for fields up to BLOCKS
+	GETATTR_ALL          uint64 = 0x00003fff // mask for all fields
+)
+
+// Bits for the valid field in Tsetattr (9P2000.L)
+const (
+	SETATTR_MODE      uint32 = 0x00000001
+	SETATTR_UID       uint32 = 0x00000002
+	SETATTR_GID       uint32 = 0x00000004
+	SETATTR_SIZE      uint32 = 0x00000008
+	SETATTR_ATIME     uint32 = 0x00000010
+	SETATTR_MTIME     uint32 = 0x00000020
+	SETATTR_CTIME     uint32 = 0x00000040
+	SETATTR_ATIME_SET uint32 = 0x00000080
+	SETATTR_MTIME_SET uint32 = 0x00000100
+)
+
+// Lock types, flags and status values used by Tlock and Tgetlock (9P2000.L)
+const (
+	LOCK_TYPE_RDLCK uint8 = 0
+	LOCK_TYPE_WRLCK uint8 = 1
+	LOCK_TYPE_UNLCK uint8 = 2
+
+	LOCK_FLAGS_BLOCK   uint32 = 1
+	LOCK_FLAGS_RECLAIM uint32 = 2
+
+	LOCK_SUCCESS uint8 = 0
+	LOCK_BLOCKED uint8 = 1
+	LOCK_ERROR   uint8 = 2
+	LOCK_GRACE   uint8 = 3
+)
+
+// Flag for the flags field in Tunlinkat (9P2000.L)
+const AT_REMOVEDIR uint32 = 0x200
+
 // Qid types
 const (
 	QTDIR     = 0x80 // directories
@@ -123,6 +244,12 @@ const (
 	ENOENT     = syscall.ENOENT
 	ENOSYS     = syscall.ENOSYS
 	EPERM      = syscall.EPERM
+	ENOTSUP    = syscall.ENOTSUP
+	ESTALE     = syscall.ESTALE
+	EBUSY      = syscall.EBUSY
+	ELOOP      = syscall.ELOOP
+	EMFILE     = syscall.EMFILE
+	EAGAIN     = syscall.EAGAIN
 )
 
 // Error represents a 9P2000 (and 9P2000.u) error
@@ -160,6 +287,83 @@ type Dir struct {
 	Muidnum uint32 // ID of the last user that modified the file
 }
 
+// Sets all fields of the Dir to the values that leave the file
+// unchanged when the Dir is sent with Twstat.
+func (d *Dir) Null() {
+	*d = Dir{Type: ^uint16(0), Dev: ^uint32(0),
+		Qid:  Qid{^uint8(0), ^uint32(0), ^uint64(0)},
+		Mode: ^uint32(0), Atime: ^uint32(0), Mtime: ^uint32(0),
+		Length: ^uint64(0), Uidnum: NOUID, Gidnum: NOUID, Muidnum: NOUID}
+}
+
+// Attr describes a file in 9P2000.L (used by Rgetattr)
+type Attr struct {
+	Valid       uint64 // bitmask of GETATTR_* values filled in
+	Qid                // file's Qid
+	Mode        uint32 // Linux protection bits and file type
+	Uid         uint32 // owner ID
+	Gid         uint32 // group ID
+	Nlink       uint64 // number of hard links
+	Rdev        uint64 // device ID (if special file)
+	Size        uint64 // file length in bytes
+	Blksize     uint64 // block size for file system I/O
+	Blocks      uint64 // number of 512B blocks allocated
+	AtimeSec    uint64 // last access time
+	AtimeNsec   uint64
+	MtimeSec    uint64 // last modified time
+	MtimeNsec   uint64
+	CtimeSec    uint64 // last status change time
+	CtimeNsec   uint64
+	BtimeSec    uint64 // creation time (reserved)
+	BtimeNsec   uint64
+	Gen         uint64 // inode generation (reserved)
+	DataVersion uint64 // data version (reserved)
+}
+
+// SetAttr describes the changes requested by a Tsetattr message (9P2000.L)
+type SetAttr struct {
+	Valid     uint32 // bitmask of SETATTR_* values to change
+	Mode      uint32 // Linux protection bits
+	Uid       uint32 // owner ID
+	Gid       uint32 // group ID
+	Size      uint64 // file length in bytes
+	AtimeSec  uint64 // last access time
+	AtimeNsec uint64
+	MtimeSec  uint64 // last modified time
+	MtimeNsec uint64
+}
+
+// Statfs describes a file system (9P2000.L, used by Rstatfs)
+type Statfs struct {
+	Type    uint32 // type of file system
+	Bsize   uint32 // optimal transfer block size
+	Blocks  uint64 // total data blocks in file system
+	Bfree   uint64 // free blocks in fs
+	Bavail  uint64 // free blocks avail to non-superuser
+	Files   uint64 // total file nodes in file system
+	Ffree   uint64 // free file nodes in fs
+	Fsid    uint64 // file system id
+	Namelen uint32 // maximum length of filenames
+}
+
+// Flock describes a POSIX record lock (9P2000.L, used by Tlock, Tgetlock, Rgetlock)
+type Flock struct {
+	Type     uint8  // LOCK_TYPE_* value
+	Flags    uint32 // LOCK_FLAGS_* bits (Tlock only)
+	Start    uint64 // starting offset for lock
+	Length   uint64 // number of bytes to lock (0 means to end of file)
+	ProcId   uint32 // process id of the lock owner
+	ClientId string // client name of the lock owner
+}
+
+// Dirent is a directory entry returned by Rreaddir (9P2000.L)
+type Dirent struct {
+	Qid           // file's Qid
+	Offset uint64 // offset of the next entry
+	Type   uint8  // Linux dirent type
+	Name   string // file name
+}
+
 // Fcall represents a 9P2000 message
 type Fcall struct {
 	Size    uint32   // size of the message
@@ -191,6 +395,24 @@ type Fcall struct {
 	Ext      string // special file description, 9P2000.u only (used by Tcreate)
 	Unamenum uint32 // user ID, 9P2000.u only (used by Tauth, Tattach)
 
+	/* 9P2000.L extensions */
+	Fid2     uint32  // second fid (used by Tlink, Trename, Trenameat)
+	Lflags   uint32  // Linux flags (used by Tlopen, Tlcreate, Txattrcreate, Tunlinkat)
+	Lmode    uint32  // Linux file mode (used by Tlcreate, Tmknod, Tmkdir)
+	Lgid     uint32  // group ID of a new file (used by Tlcreate, Tsymlink, Tmknod, Tmkdir)
+	Newname  string  // new file name (used by Trenameat)
+	Target   string  // symbolic link target (used by Tsymlink, Rreadlink)
+	Major    uint32  // major device number (used by Tmknod)
+	Minor    uint32  // minor device number (used by Tmknod)
+	Mask     uint64  // attributes requested (used by Tgetattr)
+	Datasync uint32  // only flush data, not metadata (used by Tfsync)
+	Xsize    uint64  // extended attribute size (used by Rxattrwalk, Txattrcreate)
+	Status   uint8   // lock status (used by Rlock)
+	Attr     Attr    // file attributes (used by Rgetattr)
+	SetAttr  SetAttr // attribute changes (used by Tsetattr)
+	Statfs   Statfs  // file system description (used by Rstatfs)
+	Flock    Flock   // lock description (used by Tlock, Tgetlock, Rgetlock)
+
 	Pkt []uint8 // raw packet data
 	Buf []uint8 // buffer to put the raw data in
 }
@@ -293,6 +515,65 @@ var minFcusize = [...]uint32{
 	0,  /* Rbtrunc */
 }
 
+// minimum size of a 9P2000.L message for a type (only for the .L types)
+var minFclsize = [...]uint32{
+	Tlerror:      0,   /* Tlerror */
+	Rlerror:      4,   /* Rlerror ecode[4] */
+	Tstatfs:      4,   /* Tstatfs fid[4] */
+	Rstatfs:      60,  /* Rstatfs type[4] bsize[4] blocks[8] bfree[8] bavail[8] files[8] ffree[8] fsid[8] namelen[4] */
+	Tlopen:       8,   /* Tlopen fid[4] flags[4] */
+	Rlopen:       17,  /* Rlopen qid[13] iounit[4] */
+	Tlcreate:     18,  /* Tlcreate fid[4] name[s] flags[4] mode[4] gid[4] */
+	Rlcreate:     17,  /* Rlcreate qid[13] iounit[4] */
+	Tsymlink:     12,  /* Tsymlink fid[4] name[s] symtgt[s] gid[4] */
+	Rsymlink:     13,  /* Rsymlink qid[13] */
+	Tmknod:       22,  /* Tmknod dfid[4] name[s] mode[4] major[4] minor[4] gid[4] */
+	Rmknod:       13,  /* Rmknod qid[13] */
+	Trename:      10,  /* Trename fid[4] dfid[4] name[s] */
+	Rrename:      0,   /* Rrename */
+	Treadlink:    4,   /* Treadlink fid[4] */
+	Rreadlink:    2,   /* Rreadlink target[s] */
+	Tgetattr:     12,  /* Tgetattr fid[4] request_mask[8] */
+	Rgetattr:     153, /* Rgetattr valid[8] qid[13] mode[4] uid[4] gid[4] nlink[8] rdev[8] size[8] blksize[8] blocks[8] atime[16] mtime[16] ctime[16] btime[16] gen[8] data_version[8] */
+	Tsetattr:     60,  /* Tsetattr fid[4] valid[4] mode[4] uid[4] gid[4] size[8] atime[16] mtime[16] */
+	Rsetattr:     0,   /* Rsetattr */
+	Txattrwalk:   10,  /* Txattrwalk fid[4] newfid[4] name[s] */
+	Rxattrwalk:   8,   /* Rxattrwalk size[8] */
+	Txattrcreate: 18,  /* Txattrcreate fid[4] name[s] attr_size[8] flags[4] */
+	Rxattrcreate: 0,   /* Rxattrcreate */
+	Treaddir:     16,  /* Treaddir fid[4] offset[8] count[4] */
+	Rreaddir:     4,   /* Rreaddir count[4] */
+	Tfsync:       8,   /* Tfsync fid[4] datasync[4] */
+	Rfsync:       0,   /* Rfsync */
+	Tlock:        31,  /* Tlock fid[4] type[1] flags[4] start[8] length[8] proc_id[4] client_id[s] */
+	Rlock:        1,   /* Rlock status[1] */
+	Tgetlock:     27,  /* Tgetlock fid[4] type[1] start[8] length[8] proc_id[4] client_id[s] */
+	Rgetlock:     23,  /* Rgetlock type[1] start[8] length[8] proc_id[4] client_id[s] */
+	Tlink:        10,  /* Tlink dfid[4] fid[4] name[s] */
+	Rlink:        0,   /* Rlink */
+	Tmkdir:       14,  /* Tmkdir dfid[4] name[s] mode[4] gid[4] */
+	Rmkdir:       13,  /* Rmkdir qid[13] */
+	Trenameat:    12,  /* Trenameat olddirfid[4] oldname[s] newdirfid[4] newname[s] */
+	Rrenameat:    0,   /* Rrenameat */
+	Tunlinkat:    10,  /* Tunlinkat dirfd[4] name[s] flags[4] */
+	Runlinkat:    0,   /* Runlinkat */
+}
+
+// Returns true if the message type belongs to the 9P2000.L extension.
+func IsDotlType(t uint8) bool {
+	switch t {
+	case Tlerror, Rlerror, Tstatfs, Rstatfs, Tlopen, Rlopen, Tlcreate, Rlcreate,
+		Tsymlink, Rsymlink, Tmknod, Rmknod, Trename, Rrename, Treadlink, Rreadlink,
+		Tgetattr, Rgetattr, Tsetattr, Rsetattr, Txattrwalk, Rxattrwalk,
+		Txattrcreate, Rxattrcreate, Treaddir, Rreaddir, Tfsync, Rfsync,
+		Tlock, Rlock, Tgetlock, Rgetlock, Tlink, Rlink, Tmkdir, Rmkdir,
+		Trenameat, Rrenameat, Tunlinkat, Runlinkat:
+		return true
+	}
+
+	return false
+}
+
 func gint8(buf []byte) (uint8, []byte) { return buf[0], buf[1:len(buf)] }
 
 func gint16(buf []byte) (uint16, []byte) {
@@ -546,6 +827,11 @@ func (err *Error) Error() string {
 	return ""
 }
 
+// Returns the Errno, so errors.Is matches errors like fs.ErrNotExist.
+func (err *Error) Unwrap() error {
+	return err.Errornum
+}
+
 /* From http://swtch.com/plan9port/man/man3/dial.html
    addr is a network address of the form network!netaddr!service,
    network!netaddr, or simply netaddr. Network is tcp, udp, unix,
@@ -553,12 +839,15 @@ func (err *Error) Error() string {
    for any network in common between the source and the host netaddr.
    Netaddr can be a host name, a domain name, or a network address. 
 
-   -- we should subtract the "net" option and add, from the Dial package:
-    Known networks are "tcp", "tcp4" (IPv4-only), "tcp6" (IPv6-only), "udp",
+   -- if the network is left out or net, tcp is used. Otherwise it's
+    returned as given, for Dial (or chan9.Dial, which knows more) to
+    resolve. Known networks are "tcp", "tcp4" (IPv4-only), "tcp6" (IPv6-only), "udp",
     "udp4" (IPv4-only), "udp6" (IPv6-only), "ip", "ip4" (IPv4-only),
     "ip6" (IPv6-only), "unix" and "unixpacket".
 
-    For TCP and UDP networks, addresses have the form host:port.
+    With a service, the address returned has the form host:port, the
+    port looked up for udp on udp networks and for tcp on any other.
+    The host can be left out, or be *, to listen on any address.
     If host is a literal IPv6 address, it must be enclosed in square brackets.
     The functions JoinHostPort and SplitHostPort manipulate addresses in this form. 
  */
@@ -578,10 +867,13 @@ func ParseNetName(addr string) (string, string, error) {
 	} else {
 		netaddr = a[0]
 	}
-	//if netaddr == "" {
-	//	return "", "", &Error{"unable to parse name", EINVAL}
-	//}
-	if proto == "" { // Detect network type
+	if l == 3 && a[2] == "" || l < 3 && netaddr == "" {
+		return "", "", &Error{"unable to parse name", EINVAL}
+	}
+	if netaddr == "*" { // any address, to listen on
+		netaddr = ""
+	}
+	if proto == "" || proto == "net" { // Detect network type
 		/*if strings.Count(netaddr, "." == 3) && (
 			for i,v := range(strings.Split(netaddr, ".") {
 				if _, ok := strconv.Atoi(); !ok {
@@ -593,7 +885,7 @@ func ParseNetName(addr string) (string, string, error) {
 	}
 
 	if len(a) == 3 {
-		port, e := net.LookupPort(proto, a[2])
+		port, e := lookupPort(proto, a[2])
 		if e != nil {
 			return "", "", e
 		}
@@ -602,3 +894,22 @@ func ParseNetName(addr string) (string, string, error) {
 	return proto, netaddr, nil
 }
 
+// Ports of the Plan 9 services, rarely found in /etc/services.
+var plan9Ports = map[string]int{
+	"9fs":      564,
+	"exportfs": 17007,
+}
+
+func lookupPort(proto, service string) (int, error) {
+	if !strings.HasPrefix(proto, "udp") {
+		proto = "tcp"
+	}
+	port, e := net.LookupPort(proto, service)
+	if e != nil {
+		if p, ok := plan9Ports[service]; ok {
+			return p, nil
+		}
+	}
+
+	return port, e
+}
@@ -29,9 +29,81 @@ func TestParseNetName(t *testing.T) {
 	c += cmp_parse("192.169.0.0", "tcp", "192.169.0.0")
 	c += cmp_parse("tcp!192.169.0.0!ssh", "tcp", "192.169.0.0:22")
 	c += cmp_parse("tcp6!12::F3::15:0", "tcp6", "12::F3::15:0")
+	c += cmp_parse("net!192.169.0.0!ssh", "tcp", "192.169.0.0:22")
+	c += cmp_parse("tls!example.org!9fs", "tls", "example.org:564")
+	c += cmp_parse("!!5640", "tcp", ":5640")
+	c += cmp_parse("tcp!*!9fs", "tcp", ":564")
 	c += ck_err("!!!")
 	c += ck_err("a!!")
+	c += ck_err("tcp!")
 	if c == 0 {
 		t.Log("ParseName passed!")
 	}
 }
+
+func TestDotlRoundTrip(t *testing.T) {
+	check := func(fc *Fcall) *Fcall {
+		rc, err, sz := Unpack(fc.Pkt, true)
+		if err != nil {
+			t.Fatalf("unpack %v: %s", fc, err)
+		}
+		if sz != len(fc.Pkt) {
+			t.Errorf("unpack %v: size %d, expected %d", fc, sz, len(fc.Pkt))
+		}
+		if rc.String() != fc.String() {
+			t.Errorf("round trip mismatch:\n%v\n%v", fc, rc)
+		}
+		return rc
+	}
+
+	fc := NewFcall(8192)
+	PackTlcreate(fc, 1, "file", LORDWR|LOCREATE, 0644, 100)
+	rc := check(fc)
+	if rc.Name != "file" || rc.Lflags != LORDWR|LOCREATE || rc.Lmode != 0644 {
+		t.Errorf("bad Tlcreate: %v", rc)
+	}
+
+	fc = NewFcall(8192)
+	attr := &Attr{Valid: GETATTR_BASIC, Qid: Qid{QTDIR, 3, 42}, Mode: 040755, Size: 4096, MtimeSec: 7}
+	PackRgetattr(fc, attr)
+	rc = check(fc)
+	if rc.Attr != *attr {
+		t.Errorf("bad Rgetattr: %v", rc)
+	}
+
+	fc = NewFcall(8192)
+	PackTrenameat(fc, 1, "a", 2, "b")
+	rc = check(fc)
+	if rc.Fid != 1 || rc.Fid2 != 2 || rc.Name != "a" || rc.Newname != "b" {
+		t.Errorf("bad Trenameat: %v", rc)
+	}
+
+	fc = NewFcall(8192)
+	PackTlock(fc, 5, &Flock{LOCK_TYPE_WRLCK, LOCK_FLAGS_BLOCK, 0, 10, 99, "host"})
+	rc = check(fc)
+	if rc.Flock.ClientId != "host" || rc.Flock.Length != 10 {
+		t.Errorf("bad Tlock: %v", rc)
+	}
+
+	fc = NewFcall(8192)
+	PackRlerror(fc, uint32(ENOENT))
+	rc = check(fc)
+	if rc.Type != Rlerror || rc.Errornum != uint32(ENOENT) {
+		t.Errorf("bad Rlerror: %v", rc)
+	}
+
+	buf := make([]byte, 128)
+	n := PackDirent(&Dirent{Qid{QTDIR, 0, 1}, 1, 4, "."}, buf)
+	n += PackDirent(&Dirent{Qid{0, 0, 2}, 2, 8, "f"}, buf[n:])
+	fc = NewFcall(8192)
+	PackRreaddir(fc, buf[:n])
+	rc = check(fc)
+	des, err := UnpackDirents(rc.Data)
+	if err != nil || len(des) != 2 || des[1].Name != "f" || des[1].Offset != 2 {
+		t.Errorf("bad Rreaddir: %v %v", des, err)
+	}
+
+	if _, err, _ = Unpack(fc.Pkt[:len(fc.Pkt)-1], true); err == nil {
+		t.Errorf("short Rreaddir unpacked")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package p
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// A PipeConn is a net.Conn reading from one pipe and writing to
+// another, like the standard input and output of a process 9P is
+// spoken over.
+type PipeConn struct {
+	io.ReadCloser         // the messages come from here
+	io.WriteCloser        // and go there
+	Name           string // given as both addresses of the connection
+}
+
+var Enodeadline error = &Error{"pipe has no deadlines", EINVAL}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// Closes both pipes.
+func (c *PipeConn) Close() error {
+	rerr := c.ReadCloser.Close()
+	werr := c.WriteCloser.Close()
+	if rerr != nil {
+		return rerr
+	}
+
+	return werr
+}
+
+func (c *PipeConn) LocalAddr() net.Addr {
+	return pipeAddr(c.Name)
+}
+
+func (c *PipeConn) RemoteAddr() net.Addr {
+	return pipeAddr(c.Name)
+}
+
+// The deadlines are supported if the pipes support them, as the
+// pipes of os.Pipe and exec.Cmd do.
+func (c *PipeConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *PipeConn) SetReadDeadline(t time.Time) error {
+	if f, ok := c.ReadCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return f.SetReadDeadline(t)
+	}
+
+	return Enodeadline
+}
+
+func (c *PipeConn) SetWriteDeadline(t time.Time) error {
+	if f, ok := c.WriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return f.SetWriteDeadline(t)
+	}
+
+	return Enodeadline
+}
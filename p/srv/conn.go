@@ -9,9 +9,14 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 )
 
 func (srv *Srv) NewConn(c net.Conn) {
+	srv.newConn(c)
+}
+
+func (srv *Srv) newConn(c net.Conn) *Conn {
 	conn := new(Conn)
 	conn.Srv = srv
 	conn.Msize = srv.Msize
@@ -22,6 +27,7 @@ func (srv *Srv) NewConn(c net.Conn) {
 	conn.reqs = make(map[uint16]*Req)
 	conn.reqout = make(chan *Req, srv.Maxpend)
 	conn.done = make(chan bool)
+	conn.closed = make(chan bool)
 	conn.rchan = make(chan *p.Fcall, 64)
 	conn.prev = nil
 
@@ -41,6 +47,7 @@ func (srv *Srv) NewConn(c net.Conn) {
 
 	go conn.recv()
 	go conn.send()
+	return conn
 }
 
 func (conn *Conn) recv() {
@@ -165,6 +172,8 @@ closed:
 			op.FidDestroy(fid)
 		}
 	}
+
+	close(conn.closed)
 }
 
 func (conn *Conn) send() {
@@ -258,3 +267,19 @@ func (srv *Srv) StartListener(l net.Listener) error {
 	}
 	return nil
 }
+
+// Serves a single client over the standard input and output, for
+// servers started by their client, as chan9.DialCmd does. Returns
+// once the client hangs up. Nothing else may be written to the
+// standard output, logs go to the standard error.
+func (srv *Srv) ServeStdio() error {
+	if srv.ops == nil {
+		return &p.Error{"server not started", p.EINVAL}
+	}
+
+	c := &p.PipeConn{os.Stdin, os.Stdout, "stdio"}
+	conn := srv.newConn(c)
+	<-conn.closed
+	c.Close()
+	return nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"code.google.com/p/go9p/p"
+)
+
+// Dispatch a 9P2000.L request. The caller checked that the
+// connection speaks 9P2000.L and that the request has a valid Fid.
+func (srv *Srv) dotl(req *Req) {
+	conn := req.Conn
+	tc := req.Tc
+	fid := req.Fid
+	ops := (conn.Srv.ops).(LReqOps)
+
+	switch tc.Type {
+	case p.Tlink, p.Trename, p.Trenameat:
+		req.Fid2 = conn.FidGet(tc.Fid2)
+		if req.Fid2 == nil {
+			req.RespondError(Eunknownfid)
+			return
+		}
+	}
+
+	switch tc.Type {
+	case p.Tlopen:
+		if fid.opened {
+			req.RespondError(Eopen)
+			return
+		}
+
+		fid.Omode = p.Lflags2Omode(tc.Lflags)
+		if (fid.Type&p.QTDIR) != 0 && (fid.Omode&3) != p.OREAD {
+			req.RespondError(Eperm)
+			return
+		}
+
+		ops.Lopen(req)
+
+	case p.Tlcreate:
+		if fid.opened {
+			req.RespondError(Eopen)
+			return
+		}
+
+		if (fid.Type & p.QTDIR) == 0 {
+			req.RespondError(Enotdir)
+			return
+		}
+
+		fid.Omode = p.Lflags2Omode(tc.Lflags)
+		ops.Lcreate(req)
+
+	case p.Tgetattr:
+		ops.Getattr(req)
+
+	case p.Tsetattr:
+		ops.Setattr(req)
+
+	case p.Treaddir:
+		if !fid.opened || (fid.Type&p.QTDIR) == 0 {
+			req.RespondError(Ebaduse)
+			return
+		}
+
+		if tc.Count+p.IOHDRSZ > conn.Msize {
+			req.RespondError(Etoolarge)
+			return
+		}
+
+		ops.Readdir(req)
+
+	case p.Tmkdir, p.Tunlinkat, p.Tsymlink, p.Tmknod:
+		if (fid.Type & p.QTDIR) == 0 {
+			req.RespondError(Enotdir)
+			return
+		}
+
+		switch tc.Type {
+		case p.Tmkdir:
+			ops.Mkdir(req)
+		case p.Tunlinkat:
+			ops.Unlinkat(req)
+		default:
+			srv.dotlLink(req)
+		}
+
+	case p.Trenameat:
+		if (fid.Type&p.QTDIR) == 0 || (req.Fid2.Type&p.QTDIR) == 0 {
+			req.RespondError(Enotdir)
+			return
+		}
+
+		ops.Renameat(req)
+
+	case p.Tlink, p.Trename:
+		if (req.Fid2.Type & p.QTDIR) == 0 {
+			req.RespondError(Enotdir)
+			return
+		}
+
+		srv.dotlLink(req)
+
+	case p.Treadlink:
+		srv.dotlLink(req)
+
+	case p.Tfsync:
+		ops.Fsync(req)
+
+	case p.Tstatfs:
+		ops.Statfs(req)
+
+	case p.Tlock, p.Tgetlock:
+		lops, ok := (conn.Srv.ops).(LLockOps)
+		if !ok {
+			req.RespondError(Enosys)
+			return
+		}
+
+		if tc.Type == p.Tlock {
+			lops.Lock(req)
+		} else {
+			lops.Getlock(req)
+		}
+
+	case p.Txattrwalk:
+		xops, ok := (conn.Srv.ops).(LXattrOps)
+		if !ok {
+			req.RespondError(Enosys)
+			return
+		}
+
+		if fid.opened {
+			req.RespondError(Ebaduse)
+			return
+		}
+
+		req.Newfid = conn.FidNew(tc.Newfid)
+		if req.Newfid == nil {
+			req.RespondError(Einuse)
+			return
+		}
+
+		req.Newfid.User = fid.User
+		xops.Xattrwalk(req)
+
+	case p.Txattrcreate:
+		xops, ok := (conn.Srv.ops).(LXattrOps)
+		if !ok {
+			req.RespondError(Enosys)
+			return
+		}
+
+		if fid.opened {
+			req.RespondError(Ebaduse)
+			return
+		}
+
+		xops.Xattrcreate(req)
+	}
+}
+
+func (srv *Srv) dotlLink(req *Req) {
+	lops, ok := (req.Conn.Srv.ops).(LLinkOps)
+	if !ok {
+		req.RespondError(Enosys)
+		return
+	}
+
+	switch req.Tc.Type {
+	case p.Tsymlink:
+		lops.Symlink(req)
+	case p.Treadlink:
+		lops.Readlink(req)
+	case p.Tlink:
+		lops.Link(req)
+	case p.Tmknod:
+		lops.Mknod(req)
+	case p.Trename:
+		lops.Rename(req)
+	}
+}
+
+func (srv *Srv) lopenPost(req *Req) {
+	if req.Fid != nil {
+		req.Fid.opened = req.Rc != nil && req.Rc.Type == p.Rlopen
+	}
+}
+
+func (srv *Srv) lcreatePost(req *Req) {
+	if req.Rc != nil && req.Rc.Type == p.Rlcreate && req.Fid != nil {
+		req.Fid.Type = req.Rc.Qid.Type
+		req.Fid.opened = true
+	}
+}
+
+// The fid returned by Txattrwalk is read like an open file; the fid
+// prepared by Txattrcreate is written like one.
+func (srv *Srv) xattrwalkPost(req *Req) {
+	rc := req.Rc
+	if rc == nil || rc.Type != p.Rxattrwalk || req.Newfid == nil {
+		return
+	}
+
+	req.Newfid.Type = 0
+	req.Newfid.Omode = p.OREAD
+	req.Newfid.opened = true
+	req.Newfid.IncRef()
+}
+
+func (srv *Srv) xattrcreatePost(req *Req) {
+	if req.Rc != nil && req.Rc.Type == p.Rxattrcreate && req.Fid != nil {
+		req.Fid.Omode = p.OWRITE
+		req.Fid.opened = true
+	}
+}
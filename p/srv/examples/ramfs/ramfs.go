@@ -31,6 +31,7 @@ var addr = flag.String("addr", "!!5640", "network address")
 var debug = flag.Int("d", 0, "debuglevel")
 var blksize = flag.Int("b", 8192, "block size")
 var logsz = flag.Int("l", 2048, "log size")
+var stdio = flag.Bool("stdio", false, "serve a single client on stdin/stdout")
 var rsrv Ramfs
 
 func (f *RFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
@@ -241,6 +242,14 @@ func main() {
 	rsrv.srv.Id = "ramfs"
 	rsrv.srv.Log = l
 
+	if *stdio {
+		err = rsrv.srv.ServeStdio()
+		if err != nil {
+			goto error
+		}
+		return
+	}
+
 	srv.StartStatsServer()
 
 	net, ad, err = p.ParseNetName(*addr)
@@ -32,6 +32,7 @@ type Ufs struct {
 var addr = flag.String("addr", ":5640", "network address")
 var debug = flag.Int("d", 0, "print debug messages")
 var root = flag.String("root", "/", "root filesystem")
+var stdio = flag.Bool("stdio", false, "serve a single client on stdin/stdout")
 var Enoent = &p.Error{"file not found", p.ENOENT}
 
 func toError(err error) *p.Error {
@@ -592,6 +593,13 @@ func main() {
 	ufs.Id = "ufs"
 	ufs.Debuglevel = *debug
 	ufs.Start(ufs)
+	if *stdio {
+		if err := ufs.ServeStdio(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
 	srv.StartStatsServer()
 	err := ufs.StartNetListener("tcp", *addr)
 	if err != nil {
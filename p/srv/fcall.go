@@ -21,9 +21,13 @@ func (srv *Srv) version(req *Req) {
 		conn.Msize = tc.Msize
 	}
 
-	conn.Dotu = tc.Version == "9P2000.u" && srv.Dotu
+	_, lops := (srv.ops).(LReqOps)
+	conn.Dotl = tc.Version == p.VERSIONL && srv.Dotl && lops
+	conn.Dotu = (tc.Version == "9P2000.u" && srv.Dotu) || conn.Dotl
 	ver := "9P2000"
-	if conn.Dotu {
+	if conn.Dotl {
+		ver = p.VERSIONL
+	} else if conn.Dotu {
 		ver = "9P2000.u"
 	}
 
@@ -7,8 +7,20 @@ package srv
 import "fmt"
 import "code.google.com/p/go9p/p"
 
-// Respond to the request with Rerror message
+// Respond to the request with Rerror message (Rlerror if the
+// connection speaks 9P2000.L)
 func (req *Req) RespondError(err interface{}) {
+	if req.Conn.Dotl {
+		errornum := uint32(p.EIO)
+		if e, ok := err.(*p.Error); ok && e.Errornum != 0 {
+			errornum = uint32(e.Errornum)
+		}
+
+		p.PackRlerror(req.Rc, errornum)
+		req.Respond()
+		return
+	}
+
 	switch e := err.(type) {
 	case *p.Error:
 		p.PackRerror(req.Rc, e.Error(), uint32(e.Errornum), req.Conn.Dotu)
@@ -150,3 +162,135 @@ func (req *Req) RespondRwstat() {
 		req.Respond()
 	}
 }
+
+// Respond to the request with Rlopen message
+func (req *Req) RespondRlopen(qid *p.Qid, iounit uint32) {
+	err := p.PackRlopen(req.Rc, qid, iounit)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlcreate message
+func (req *Req) RespondRlcreate(qid *p.Qid, iounit uint32) {
+	err := p.PackRlcreate(req.Rc, qid, iounit)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rgetattr message
+func (req *Req) RespondRgetattr(attr *p.Attr) {
+	err := p.PackRgetattr(req.Rc, attr)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rreaddir message
+func (req *Req) RespondRreaddir(data []byte) {
+	err := p.PackRreaddir(req.Rc, data)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rmkdir message
+func (req *Req) RespondRmkdir(qid *p.Qid) {
+	err := p.PackRmkdir(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rsymlink message
+func (req *Req) RespondRsymlink(qid *p.Qid) {
+	err := p.PackRsymlink(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rmknod message
+func (req *Req) RespondRmknod(qid *p.Qid) {
+	err := p.PackRmknod(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rreadlink message
+func (req *Req) RespondRreadlink(target string) {
+	err := p.PackRreadlink(req.Rc, target)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rstatfs message
+func (req *Req) RespondRstatfs(st *p.Statfs) {
+	err := p.PackRstatfs(req.Rc, st)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rxattrwalk message
+func (req *Req) RespondRxattrwalk(size uint64) {
+	err := p.PackRxattrwalk(req.Rc, size)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlock message
+func (req *Req) RespondRlock(status uint8) {
+	err := p.PackRlock(req.Rc, status)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rgetlock message
+func (req *Req) RespondRgetlock(lk *p.Flock) {
+	err := p.PackRgetlock(req.Rc, lk)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to a 9P2000.L request that has an empty response (Tsetattr,
+// Trename, Txattrcreate, Tfsync, Tlink, Trenameat and Tunlinkat). The
+// response type is taken from the request.
+func (req *Req) RespondRempty() {
+	err := p.PackRempty(req.Rc, req.Tc.Type+1)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
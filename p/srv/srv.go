@@ -42,6 +42,7 @@ var Ebadoffset error = &p.Error{"bad offset in directory read", p.EINVAL}
 var Edirchange error = &p.Error{"cannot convert between files and directories", p.EINVAL}
 var Enouser error = &p.Error{"unknown user", p.EINVAL}
 var Enotimpl error = &p.Error{"not implemented", p.EINVAL}
+var Enosys error = &p.Error{"function not implemented", p.ENOSYS}
 
 // Authentication operations. The file server should implement them if
 // it requires user authentication. The authentication in 9P2000 is
@@ -133,6 +134,52 @@ type ReqOps interface {
 	Wstat(*Req)
 }
 
+// 9P2000.L operations. This interface should be implemented by file
+// servers that want to speak the 9P2000.L dialect. The dialect is only
+// negotiated if Srv.Dotl is set and the ops implement the interface.
+// The operations correspond directly to the 9P2000.L message types.
+// Tattach, Twalk, Tread, Twrite, Tclunk and Tremove are still handled
+// by the ReqOps operations.
+type LReqOps interface {
+	Lopen(*Req)
+	Lcreate(*Req)
+	Getattr(*Req)
+	Setattr(*Req)
+	Readdir(*Req)
+	Mkdir(*Req)
+	Renameat(*Req)
+	Unlinkat(*Req)
+	Fsync(*Req)
+	Statfs(*Req)
+}
+
+// Link operations (9P2000.L). This interface should be implemented if the
+// file server supports symbolic links, hard links, device nodes and the
+// older Trename. If not implemented, the requests fail with ENOSYS.
+type LLinkOps interface {
+	Symlink(*Req)
+	Readlink(*Req)
+	Link(*Req)
+	Mknod(*Req)
+	Rename(*Req)
+}
+
+// Lock operations (9P2000.L). This interface should be implemented if the
+// file server supports POSIX record locks. If not implemented, the requests
+// fail with ENOSYS.
+type LLockOps interface {
+	Lock(*Req)
+	Getlock(*Req)
+}
+
+// Extended attribute operations (9P2000.L). This interface should be
+// implemented if the file server supports extended attributes. If not
+// implemented, the requests fail with ENOSYS.
+type LXattrOps interface {
+	Xattrwalk(*Req)
+	Xattrcreate(*Req)
+}
+
 type StatsOps interface {
 	statsRegister()
 	statsUnregister()
@@ -148,6 +195,7 @@ type Srv struct {
 	Id          string    // Used for debugging and stats
 	Msize       uint32    // Maximum size of the 9P2000 messages supported by the server
 	Dotu        bool      // If true, the server supports the 9P2000.u extension
+	Dotl        bool      // If true, the server supports the 9P2000.L extension (ops must implement LReqOps)
 	Debuglevel  int       // debug level
 	Upool       p.Users   // Interface for finding users and groups known to the file server
 	Maxpend     int       // Maximum pending outgoing requests
@@ -166,6 +214,7 @@ type Conn struct {
 	Srv        *Srv
 	Msize      uint32 // maximum size of 9P2000 messages for the connection
 	Dotu       bool   // if true, both the client and the server speak 9P2000.u
+	Dotl       bool   // if true, both the client and the server speak 9P2000.L
 	Id         string // used for debugging and stats
 	Debuglevel int
 
@@ -176,6 +225,7 @@ type Conn struct {
 	reqout     chan *Req
 	rchan      chan *p.Fcall
 	done       chan bool
+	closed     chan bool // closed once the client is gone
 	prev, next *Conn
 
 	// stats
@@ -217,7 +267,8 @@ type Req struct {
 	Rc     *p.Fcall // Outgoing 9P2000 response
 	Fid    *Fid     // The Fid value for all messages that contain fid[4]
 	Afid   *Fid     // The Fid value for the messages that contain afid[4] (Tauth and Tattach)
-	Newfid *Fid     // The Fid value for the messages that contain newfid[4] (Twalk)
+	Newfid *Fid     // The Fid value for the messages that contain newfid[4] (Twalk, Txattrwalk)
+	Fid2   *Fid     // The Fid value for the messages that contain a second fid[4] (Tlink, Trename, Trenameat)
 	Conn   *Conn    // Connection that the request belongs to
 
 	status     reqStatus
@@ -371,6 +422,17 @@ func (req *Req) Process() {
 
 		case p.Twstat:
 			srv.wstat(req)
+
+		case p.Tlopen, p.Tlcreate, p.Tgetattr, p.Tsetattr, p.Treaddir,
+			p.Tmkdir, p.Trenameat, p.Tunlinkat, p.Tfsync, p.Tstatfs,
+			p.Tsymlink, p.Treadlink, p.Tlink, p.Tmknod, p.Trename,
+			p.Tlock, p.Tgetlock, p.Txattrwalk, p.Txattrcreate:
+			if !conn.Dotl {
+				req.RespondError(&p.Error{"unknown message type", p.ENOSYS})
+				return
+			}
+
+			srv.dotl(req)
 		}
 	}
 }
@@ -407,6 +469,18 @@ func (req *Req) PostProcess() {
 
 	case p.Tremove:
 		srv.removePost(req)
+
+	case p.Tlopen:
+		srv.lopenPost(req)
+
+	case p.Tlcreate:
+		srv.lcreatePost(req)
+
+	case p.Txattrwalk:
+		srv.xattrwalkPost(req)
+
+	case p.Txattrcreate:
+		srv.xattrcreatePost(req)
 	}
 
 	if req.Fid != nil {
@@ -423,6 +497,11 @@ func (req *Req) PostProcess() {
 		req.Newfid.DecRef()
 		req.Newfid = nil
 	}
+
+	if req.Fid2 != nil {
+		req.Fid2.DecRef()
+		req.Fid2 = nil
+	}
 }
 
 // The Respond method sends response back to the client. The req.Rc value
@@ -9,8 +9,11 @@ import (
 )
 
 // Creates a Fcall value from the on-the-wire representation. If
-// dotu is true, reads 9P2000.u messages. Returns the unpacked message,
-// error and how many bytes from the buffer were used by the message.
+// dotu is true, reads 9P2000.u messages. The 9P2000.L messages are
+// always recognized, since their types don't overlap with 9P2000
+// (9P2000.L connections should be unpacked with dotu set).
+// Returns the unpacked message, error and how many bytes from the
+// buffer were used by the message.
 func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 	var m uint16
 
@@ -22,6 +25,7 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 	fc.Fid = NOFID
 	fc.Afid = NOFID
 	fc.Newfid = NOFID
+	fc.Fid2 = NOFID
 
 	p := buf
 	fc.Size, p = gint32(p)
@@ -38,7 +42,19 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 	p = p[0 : fc.Size-7]
 	fc.Pkt = buf[0:fc.Size]
 	fcsz = int(fc.Size)
-	if fc.Type < Tversion || fc.Type >= Tlast {
+	if fc.Type < Tversion {
+		if !IsDotlType(fc.Type) {
+			return nil, &Error{"invalid id", EINVAL}, 0
+		}
+
+		if fc.Size-7 < minFclsize[fc.Type] {
+			return nil, &Error{"invalid size", EINVAL}, 0
+		}
+
+		return unpackl(fc, p, fcsz)
+	}
+
+	if fc.Type >= Tlast {
 		return nil, &Error{"invalid id", EINVAL}, 0
 	}
 
@@ -223,3 +239,235 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 szerror:
 	return nil, &Error{"invalid size", EINVAL}, 0
 }
+
+// Unpacks the body of a 9P2000.L message. The header is already
+// parsed and the minimum size is checked.
+func unpackl(fc *Fcall, p []byte, fcsz int) (*Fcall, error, int) {
+	switch fc.Type {
+	default:
+		return nil, &Error{"invalid message id", EINVAL}, 0
+
+	case Rlerror:
+		fc.Errornum, p = gint32(p)
+
+	case Tstatfs, Treadlink:
+		fc.Fid, p = gint32(p)
+
+	case Rstatfs:
+		st := &fc.Statfs
+		st.Type, p = gint32(p)
+		st.Bsize, p = gint32(p)
+		st.Blocks, p = gint64(p)
+		st.Bfree, p = gint64(p)
+		st.Bavail, p = gint64(p)
+		st.Files, p = gint64(p)
+		st.Ffree, p = gint64(p)
+		st.Fsid, p = gint64(p)
+		st.Namelen, p = gint32(p)
+
+	case Tlopen:
+		fc.Fid, p = gint32(p)
+		fc.Lflags, p = gint32(p)
+
+	case Rlopen, Rlcreate:
+		p = gqid(p, &fc.Qid)
+		fc.Iounit, p = gint32(p)
+
+	case Tlcreate:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 12 {
+			goto szerror
+		}
+		fc.Lflags, p = gint32(p)
+		fc.Lmode, p = gint32(p)
+		fc.Lgid, p = gint32(p)
+
+	case Tsymlink:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+		fc.Target, p = gstr(p)
+		if p == nil || len(p) < 4 {
+			goto szerror
+		}
+		fc.Lgid, p = gint32(p)
+
+	case Rsymlink, Rmknod, Rmkdir:
+		p = gqid(p, &fc.Qid)
+
+	case Tmknod:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 16 {
+			goto szerror
+		}
+		fc.Lmode, p = gint32(p)
+		fc.Major, p = gint32(p)
+		fc.Minor, p = gint32(p)
+		fc.Lgid, p = gint32(p)
+
+	case Trename, Tlink:
+		fc.Fid, p = gint32(p)
+		fc.Fid2, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Rreadlink:
+		fc.Target, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Tgetattr:
+		fc.Fid, p = gint32(p)
+		fc.Mask, p = gint64(p)
+
+	case Rgetattr:
+		a := &fc.Attr
+		a.Valid, p = gint64(p)
+		p = gqid(p, &a.Qid)
+		a.Mode, p = gint32(p)
+		a.Uid, p = gint32(p)
+		a.Gid, p = gint32(p)
+		a.Nlink, p = gint64(p)
+		a.Rdev, p = gint64(p)
+		a.Size, p = gint64(p)
+		a.Blksize, p = gint64(p)
+		a.Blocks, p = gint64(p)
+		a.AtimeSec, p = gint64(p)
+		a.AtimeNsec, p = gint64(p)
+		a.MtimeSec, p = gint64(p)
+		a.MtimeNsec, p = gint64(p)
+		a.CtimeSec, p = gint64(p)
+		a.CtimeNsec, p = gint64(p)
+		a.BtimeSec, p = gint64(p)
+		a.BtimeNsec, p = gint64(p)
+		a.Gen, p = gint64(p)
+		a.DataVersion, p = gint64(p)
+
+	case Tsetattr:
+		a := &fc.SetAttr
+		fc.Fid, p = gint32(p)
+		a.Valid, p = gint32(p)
+		a.Mode, p = gint32(p)
+		a.Uid, p = gint32(p)
+		a.Gid, p = gint32(p)
+		a.Size, p = gint64(p)
+		a.AtimeSec, p = gint64(p)
+		a.AtimeNsec, p = gint64(p)
+		a.MtimeSec, p = gint64(p)
+		a.MtimeNsec, p = gint64(p)
+
+	case Txattrwalk:
+		fc.Fid, p = gint32(p)
+		fc.Newfid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Rxattrwalk:
+		fc.Xsize, p = gint64(p)
+
+	case Txattrcreate:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 12 {
+			goto szerror
+		}
+		fc.Xsize, p = gint64(p)
+		fc.Lflags, p = gint32(p)
+
+	case Treaddir:
+		fc.Fid, p = gint32(p)
+		fc.Offset, p = gint64(p)
+		fc.Count, p = gint32(p)
+
+	case Rreaddir:
+		fc.Count, p = gint32(p)
+		if len(p) < int(fc.Count) {
+			goto szerror
+		}
+		fc.Data = p[0:fc.Count]
+		p = p[fc.Count:len(p)]
+
+	case Tfsync:
+		fc.Fid, p = gint32(p)
+		fc.Datasync, p = gint32(p)
+
+	case Tlock:
+		lk := &fc.Flock
+		fc.Fid, p = gint32(p)
+		lk.Type, p = gint8(p)
+		lk.Flags, p = gint32(p)
+		lk.Start, p = gint64(p)
+		lk.Length, p = gint64(p)
+		lk.ProcId, p = gint32(p)
+		lk.ClientId, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Rlock:
+		fc.Status, p = gint8(p)
+
+	case Tgetlock, Rgetlock:
+		lk := &fc.Flock
+		if fc.Type == Tgetlock {
+			fc.Fid, p = gint32(p)
+		}
+		lk.Type, p = gint8(p)
+		lk.Start, p = gint64(p)
+		lk.Length, p = gint64(p)
+		lk.ProcId, p = gint32(p)
+		lk.ClientId, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Tmkdir:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 8 {
+			goto szerror
+		}
+		fc.Lmode, p = gint32(p)
+		fc.Lgid, p = gint32(p)
+
+	case Trenameat:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 6 {
+			goto szerror
+		}
+		fc.Fid2, p = gint32(p)
+		fc.Newname, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Tunlinkat:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 4 {
+			goto szerror
+		}
+		fc.Lflags, p = gint32(p)
+
+	case Tlerror, Rrename, Rsetattr, Rxattrcreate, Rfsync, Rlink, Rrenameat, Runlinkat:
+	}
+
+	if len(p) > 0 {
+		goto szerror
+	}
+
+	return fc, nil, fcsz
+
+szerror:
+	return nil, &Error{"invalid size", EINVAL}, 0
+}